@@ -0,0 +1,163 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// Settings of the access log, as configured on the server.
+type Settings struct {
+	// Format is one of json, common or combined.
+	Format string `yaml:"format"`
+	// Output is stdout or the path of a file rotated once it reaches
+	// MaxSizeMB, keeping MaxBackups old files.
+	Output     string `yaml:"output"`
+	MaxSizeMB  int    `yaml:"maxSizeMB"`
+	MaxBackups int    `yaml:"maxBackups"`
+	// SampleRate is the share of requests logged, errors are always logged.
+	SampleRate float64 `yaml:"sampleRate"`
+}
+
+// RouteSettings override the access log settings of a route.
+type RouteSettings struct {
+	Disabled bool `yaml:"disabled"`
+	// SampleRate overrides Settings.SampleRate when set.
+	SampleRate float64 `yaml:"sampleRate"`
+}
+
+// Entry is one access log line. Handlers fill in what they know about the
+// request through the Entry found in the request context.
+type Entry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id,omitempty"`
+	Route           string    `json:"route"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Proto           string    `json:"proto"`
+	Status          int       `json:"status"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+	UpstreamHost    string    `json:"upstream_host,omitempty"`
+	UpstreamLatency float64   `json:"upstream_latency_ms,omitempty"`
+	Latency         float64   `json:"latency_ms"`
+	Principal       string    `json:"principal,omitempty"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// SetUpstream records the upstream host that served the request.
+func (e *Entry) SetUpstream(host string, latency time.Duration) {
+	if e == nil {
+		return
+	}
+	e.UpstreamHost = host
+	e.UpstreamLatency = milliseconds(latency)
+}
+
+// SetPrincipal records who the request was authenticated as.
+func (e *Entry) SetPrincipal(principal string) {
+	if e == nil {
+		return
+	}
+	e.Principal = principal
+}
+
+type entryKey struct{}
+
+// NewContext returns ctx carrying e.
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// FromContext returns the Entry of the request, nil outside of a logged
+// request. Entry setters are safe to call on nil.
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+// Logger writes access log entries.
+type Logger struct {
+	settings Settings
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New is constructor for Logger.
+func New(settings Settings) (*Logger, error) {
+	switch settings.Format {
+	case "":
+		settings.Format = FormatJSON
+	case FormatJSON, FormatCommon, FormatCombined:
+	default:
+		return nil, fmt.Errorf("accesslog: unknown format %q", settings.Format)
+	}
+	if settings.SampleRate <= 0 {
+		settings.SampleRate = 1
+	}
+
+	l := &Logger{settings: settings}
+	switch settings.Output {
+	case "", "stdout":
+		l.out = os.Stdout
+	default:
+		l.out = &lumberjack.Logger{
+			Filename:   settings.Output,
+			MaxSize:    settings.MaxSizeMB,
+			MaxBackups: settings.MaxBackups,
+		}
+	}
+	return l, nil
+}
+
+// Log writes e, subject to sampling.
+func (l *Logger) Log(e *Entry, sampleRate float64) {
+	if e.Status < 500 && sampleRate < 1 && rand.Float64() >= sampleRate {
+		return
+	}
+
+	var line []byte
+	switch l.settings.Format {
+	case FormatJSON:
+		line, _ = json.Marshal(e)
+	case FormatCommon:
+		line = []byte(common(e))
+	case FormatCombined:
+		line = []byte(fmt.Sprintf("%s %q %q", common(e), e.Referer, e.UserAgent))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+func common(e *Entry) string {
+	user := e.Principal
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+		e.RemoteAddr, user, e.Time.Format(clfTimeFormat), e.Method, e.Path, e.Proto, e.Status, e.BytesOut)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
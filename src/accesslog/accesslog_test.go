@@ -0,0 +1,81 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Handler(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		settings RouteSettings
+		want     string
+	}{
+		{
+			name:   "Common",
+			format: FormatCommon,
+			want:   `192.0.2.1 - account:1 [`,
+		},
+		{
+			name:   "Combined",
+			format: FormatCombined,
+			want:   `"POST /api/v1.2/commands/?a=REDACTED&token=REDACTED HTTP/1.1" 201 5 "" "test-agent"`,
+		},
+		{
+			name:     "Disabled",
+			format:   FormatJSON,
+			settings: RouteSettings{Disabled: true},
+			want:     "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			l, err := New(Settings{Format: tt.format})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			l.out = out
+
+			handler := l.Handler("commands", tt.settings, func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).SetPrincipal("account:1")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("hello"))
+			})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1.2/commands/?token=s3cret&a=b", strings.NewReader("body"))
+			req.Header.Set("User-Agent", "test-agent")
+			handler(httptest.NewRecorder(), req)
+
+			if tt.want == "" && out.Len() != 0 {
+				t.Errorf("got log line %q, want none", out.String())
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("got log line %q, want it to contain %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLogger_HandlerJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, _ := New(Settings{})
+	l.out = out
+
+	handler := l.Handler("commands", RouteSettings{}, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/x", strings.NewReader("body")))
+
+	var got Entry
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("log line %q is not json: %v", out.String(), err)
+	}
+	if got.Route != "commands" || got.Status != http.StatusForbidden || got.BytesIn != 0 || got.Method != http.MethodPut {
+		t.Errorf("got entry %+v", got)
+	}
+}
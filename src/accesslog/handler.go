@@ -0,0 +1,105 @@
+package accesslog
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"requestid"
+	"time"
+)
+
+// Handler logs every request served by next, unless disabled for the route.
+func (l *Logger) Handler(route string, settings RouteSettings, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if settings.Disabled {
+		return next
+	}
+	sampleRate := l.settings.SampleRate
+	if settings.SampleRate > 0 {
+		sampleRate = settings.SampleRate
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &Entry{
+			Time:      start,
+			RequestID: requestid.FromContext(r.Context()),
+			Route:     route,
+			Method:    r.Method,
+			Path:      redactedURI(r.URL),
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+		e.RemoteAddr, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		next(recorder, r.WithContext(NewContext(r.Context(), e)))
+
+		e.Status = recorder.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.BytesIn = body.n
+		e.BytesOut = recorder.n
+		e.Latency = milliseconds(time.Since(start))
+		l.Log(e, sampleRate)
+	}
+}
+
+// redactedURI is the path and query of u with every query value redacted,
+// query strings carrying tokens as often as not.
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	query, _ := url.ParseQuery(u.RawQuery)
+	for key := range query {
+		query[key] = []string{"REDACTED"}
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseRecorder remembers the status code and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush of the wrapped writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"health"
+	"net/http"
+	"os"
+	"routes"
+	"runtime"
+	"strings"
+	"time"
+	"types"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Version, Commit and BuildDate describe the build, they are set with
+// -ldflags "-X admin.Version=...".
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+const tokenEnv = "GATEWAY_ADMIN_TOKEN"
+
+var errNoToken = errors.New("admin: admin.token or " + tokenEnv + " must be set")
+
+// NewServer returns the admin server, or nil when the admin listener is not
+// configured or has no token to protect it with. dlq and history are nil
+// when there are no workers.
+func NewServer(config *types.ServerConfig, shared *routes.Shared, dlq DeadLetters, history CommandHistory, logger log.Logger) (*http.Server, error) {
+	if config.Admin.Port == "" {
+		return nil, nil
+	}
+	token := config.Admin.Token
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+	if token == "" {
+		level.Warn(logger).Log("msg", "admin listener disabled", "port", config.Admin.Port, "err", errNoToken)
+		return nil, nil
+	}
+
+	return &http.Server{
+		Addr:              ":" + config.Admin.Port,
+		Handler:           authenticate(token, Handler(config, shared, dlq, history, logger)),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}, nil
+}
+
+// Handler serves the admin API, without authentication. Only the dead
+// letter operations change anything, every other endpoint is read only.
+func Handler(config *types.ServerConfig, shared *routes.Shared, dlq DeadLetters, history CommandHistory, logger log.Logger) http.Handler {
+	started := time.Now()
+	mux := http.NewServeMux()
+	dead := deadLettersHandler(dlq, logger)
+	mux.Handle(deadLettersPath, dead)
+	mux.Handle(deadLettersPath+"/", dead)
+	mux.Handle(commandsPath, commandsHandler(history, logger))
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, routeInfos(config, shared))
+	})
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, upstreamInfos(config, shared))
+	})
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, limitsInfo(shared))
+	})
+	mux.HandleFunc("/captures", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, shared.Captures().Exchanges(r.URL.Query().Get("route")))
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, map[string]string{
+			"version":   Version,
+			"commit":    Commit,
+			"buildDate": BuildDate,
+			"goVersion": runtime.Version(),
+			"started":   started.Format(time.RFC3339),
+		})
+	})
+	mux.HandleFunc("/readyz", health.ReportHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(logger, w, map[string]interface{}{
+			"checksum": config.Checksum(),
+			"config":   newConfigInfo(config),
+		})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !strings.HasPrefix(r.URL.Path, deadLettersPath) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authenticate only lets requests with the bearer token through.
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(logger log.Logger, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		level.Warn(logger).Log("msg", "admin response failed", "err", err)
+	}
+}
@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"encoding/json"
+	"health"
+	"io/ioutil"
+	"logging"
+	"net/http"
+	"net/http/httptest"
+	"routes"
+	"strings"
+	"testing"
+	"types"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testServer(t *testing.T, dlq DeadLetters, history CommandHistory) *http.Server {
+	config := &types.ServerConfig{}
+	err := config.Parse([]byte(`
+port: 8000
+admin:
+  port: 8081
+  token: secret
+workers:
+  callbacks:
+    secret: callback-secret
+upstreams:
+- name: backend
+  hosts:
+  - url: http://backend
+    port: 8080
+routes:
+- name: accounts
+  location: /accounts
+  forwardUpstream: backend
+  beforeFilters:
+  - type: auth
+    strategy: token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggers, err := logging.New(logging.Settings{Level: "none"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := routes.NewShared(config, loggers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config, shared, dlq, history, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		want          int
+	}{
+		{name: "NoToken", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "WrongToken", authorization: "Bearer wrong", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "Token", authorization: "Bearer secret", method: http.MethodGet, want: http.StatusOK},
+		{name: "NotGet", authorization: "Bearer secret", method: http.MethodPost, want: http.StatusMethodNotAllowed},
+	}
+	server := testServer(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/version", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %v, want %v", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewServer_NoToken(t *testing.T) {
+	config := &types.ServerConfig{Admin: types.AdminConfig{Port: "8081"}}
+	server, err := NewServer(config, nil, nil, nil, log.NewNopLogger())
+	if err != nil || server != nil {
+		t.Errorf("NewServer() = %v, %v, want the admin listener disabled", server, err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := testServer(t, nil, nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var infos []routeInfo
+	if err := json.NewDecoder(get("/routes").Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || len(infos[0].BeforeFilters) != 1 || infos[0].BeforeFilters[0] != "auth.token" {
+		t.Errorf("/routes = %+v, want accounts with auth.token", infos)
+	}
+
+	var upstreams []upstreamInfo
+	if err := json.NewDecoder(get("/upstreams").Body).Decode(&upstreams); err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 1 || len(upstreams[0].Hosts) != 1 || upstreams[0].Hosts[0].Health != "unknown" {
+		t.Errorf("/upstreams = %+v, want backend with one unknown host", upstreams)
+	}
+
+	var limits limits
+	if err := json.NewDecoder(get("/limits").Body).Decode(&limits); err != nil {
+		t.Fatal(err)
+	}
+	if limits.Throttled == nil || limits.RetryBudget.Allowed <= 0 {
+		t.Errorf("/limits = %+v, want throttle counters and the retry budget", limits)
+	}
+
+	if rec := get("/metrics"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Errorf("/metrics = %d, want the prometheus metrics", rec.Code)
+	}
+	var report health.Report
+	if err := json.NewDecoder(get("/readyz").Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := report.Checks["config"]; !ok {
+		t.Errorf("/readyz = %+v, want the state of every check", report)
+	}
+
+	body := get("/config").Body.String()
+	if strings.Contains(body, "secret") {
+		t.Errorf("/config leaks a secret: %s", body)
+	}
+	var config struct {
+		Checksum string     `json:"checksum"`
+		Config   configInfo `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Checksum == "" || config.Config.Port != "8000" || !config.Config.Workers.CallbacksSigned {
+		t.Errorf("/config = %+v, want the checksum, port and signed callbacks", config)
+	}
+}
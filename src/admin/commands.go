@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"worker"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// CommandHistory is the state history of the commands run by the command
+// queue workers, implemented by *worker.Manager.
+type CommandHistory interface {
+	History(id uint64) ([]worker.Transition, error)
+}
+
+const commandsPath = "/commands/"
+
+// commandsHandler serves
+//
+//	GET /commands/{id}/history state transitions, oldest first
+func commandsHandler(history CommandHistory, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, "workers are not configured", http.StatusNotFound)
+			return
+		}
+
+		rest := strings.TrimPrefix(r.URL.Path, commandsPath)
+		if !strings.HasSuffix(rest, "/history") {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(rest, "/history"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid command id", http.StatusBadRequest)
+			return
+		}
+
+		transitions, err := history.History(id)
+		switch {
+		case err == nil:
+			writeJSON(logger, w, transitions)
+		case err == worker.ErrHistoryNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			level.Error(logger).Log("msg", "command history failed", "id", id, "err", err)
+			http.Error(w, "command history failed", http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"worker"
+)
+
+type fakeHistory map[uint64][]worker.Transition
+
+func (f fakeHistory) History(id uint64) ([]worker.Transition, error) {
+	history, ok := f[id]
+	if !ok {
+		return nil, worker.ErrHistoryNotFound
+	}
+	return history, nil
+}
+
+func TestCommands(t *testing.T) {
+	history := fakeHistory{7: {{CommandID: 7, From: "", To: "pending"}, {CommandID: 7, From: "pending", To: "running"}}}
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		history CommandHistory
+		want    int
+		wantLen int
+	}{
+		{name: "history", method: http.MethodGet, path: "/commands/7/history", history: history, want: http.StatusOK, wantLen: 2},
+		{name: "unknown command", method: http.MethodGet, path: "/commands/8/history", history: history, want: http.StatusNotFound},
+		{name: "invalid id", method: http.MethodGet, path: "/commands/x/history", history: history, want: http.StatusBadRequest},
+		{name: "no history path", method: http.MethodGet, path: "/commands/7", history: history, want: http.StatusNotFound},
+		{name: "read only", method: http.MethodPost, path: "/commands/7/history", history: history, want: http.StatusMethodNotAllowed},
+		{name: "no workers", method: http.MethodGet, path: "/commands/7/history", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := testServer(t, nil, tt.history)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %v, want %v", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var got []worker.Transition
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("got %d transitions, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"worker"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DeadLetters is the dead letter queue of the command queue workers,
+// implemented by *worker.Manager.
+type DeadLetters interface {
+	DeadLetters(offset, limit int) (*worker.DeadLetterPage, error)
+	DeadLetter(id string) (*worker.DeadLetter, error)
+	RequeueDeadLetter(id string) error
+	PurgeDeadLetter(id string) error
+	PurgeDeadLetters() (int, error)
+}
+
+const deadLettersPath = "/deadletters"
+
+// Pages of the dead letter list, limit defaulting to defaultDeadLettersLimit
+// and bounded by maxDeadLettersLimit.
+const (
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 1000
+)
+
+// deadLettersHandler serves
+//
+//	GET    /deadletters              list, ?offset=&limit= to page
+//	DELETE /deadletters              purge all
+//	GET    /deadletters/{id}         inspect
+//	DELETE /deadletters/{id}         purge
+//	POST   /deadletters/{id}/requeue requeue
+func deadLettersHandler(dlq DeadLetters, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dlq == nil {
+			http.Error(w, "workers are not configured", http.StatusNotFound)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, deadLettersPath), "/")
+		requeue := strings.HasSuffix(id, "/requeue")
+		id = strings.TrimSuffix(id, "/requeue")
+		if strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		var err error
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			offset, limit, ok := pageParams(r)
+			if !ok {
+				http.Error(w, "offset and limit must be positive integers", http.StatusBadRequest)
+				return
+			}
+			var page *worker.DeadLetterPage
+			if page, err = dlq.DeadLetters(offset, limit); err == nil {
+				writeJSON(logger, w, page)
+			}
+		case id == "" && r.Method == http.MethodDelete:
+			var purged int
+			if purged, err = dlq.PurgeDeadLetters(); err == nil {
+				writeJSON(logger, w, map[string]int{"purged": purged})
+			}
+		case id == "":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case requeue && r.Method == http.MethodPost:
+			if err = dlq.RequeueDeadLetter(id); err == nil {
+				writeJSON(logger, w, map[string]string{"requeued": id})
+			}
+		case requeue:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case r.Method == http.MethodGet:
+			var letter *worker.DeadLetter
+			if letter, err = dlq.DeadLetter(id); err == nil {
+				writeJSON(logger, w, letter)
+			}
+		case r.Method == http.MethodDelete:
+			if err = dlq.PurgeDeadLetter(id); err == nil {
+				writeJSON(logger, w, map[string]string{"purged": id})
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+		switch {
+		case err == nil:
+		case err == worker.ErrDeadLetterNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			level.Error(logger).Log("msg", "dead letter operation failed", "method", r.Method, "id", id, "err", err)
+			http.Error(w, "dead letter operation failed", http.StatusInternalServerError)
+		}
+	})
+}
+
+// pageParams returns the offset and limit query parameters of r, false if
+// either is invalid.
+func pageParams(r *http.Request) (offset, limit int, ok bool) {
+	limit = defaultDeadLettersLimit
+	query := r.URL.Query()
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if limit > maxDeadLettersLimit {
+		limit = maxDeadLettersLimit
+	}
+	return offset, limit, true
+}
@@ -0,0 +1,153 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"worker"
+)
+
+type fakeDeadLetters struct {
+	letters  map[string]worker.DeadLetter
+	requeued []string
+}
+
+func (f *fakeDeadLetters) DeadLetters(offset, limit int) (*worker.DeadLetterPage, error) {
+	ids := make([]string, 0, len(f.letters))
+	for id := range f.letters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	page := &worker.DeadLetterPage{DeadLetters: []worker.DeadLetter{}, Offset: offset, Total: len(ids)}
+	for i := offset; i < len(ids) && len(page.DeadLetters) < limit; i++ {
+		page.DeadLetters = append(page.DeadLetters, f.letters[ids[i]])
+	}
+	return page, nil
+}
+
+func (f *fakeDeadLetters) DeadLetter(id string) (*worker.DeadLetter, error) {
+	d, ok := f.letters[id]
+	if !ok {
+		return nil, worker.ErrDeadLetterNotFound
+	}
+	return &d, nil
+}
+
+func (f *fakeDeadLetters) RequeueDeadLetter(id string) error {
+	if err := f.PurgeDeadLetter(id); err != nil {
+		return err
+	}
+	f.requeued = append(f.requeued, id)
+	return nil
+}
+
+func (f *fakeDeadLetters) PurgeDeadLetter(id string) error {
+	if _, ok := f.letters[id]; !ok {
+		return worker.ErrDeadLetterNotFound
+	}
+	delete(f.letters, id)
+	return nil
+}
+
+func (f *fakeDeadLetters) PurgeDeadLetters() (int, error) {
+	n := len(f.letters)
+	f.letters = map[string]worker.DeadLetter{}
+	return n, nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		want        int
+		wantLeft    int
+		wantRequeue bool
+	}{
+		{name: "List", method: http.MethodGet, path: "/deadletters", want: http.StatusOK, wantLeft: 2},
+		{name: "Inspect", method: http.MethodGet, path: "/deadletters/0-1-1", want: http.StatusOK, wantLeft: 2},
+		{name: "InspectMissing", method: http.MethodGet, path: "/deadletters/0-9-9", want: http.StatusNotFound, wantLeft: 2},
+		{name: "Requeue", method: http.MethodPost, path: "/deadletters/0-1-1/requeue", want: http.StatusOK, wantLeft: 1, wantRequeue: true},
+		{name: "RequeueNotPost", method: http.MethodGet, path: "/deadletters/0-1-1/requeue", want: http.StatusMethodNotAllowed, wantLeft: 2},
+		{name: "Purge", method: http.MethodDelete, path: "/deadletters/0-1-1", want: http.StatusOK, wantLeft: 1},
+		{name: "ListBadLimit", method: http.MethodGet, path: "/deadletters?limit=-1", want: http.StatusBadRequest, wantLeft: 2},
+		{name: "PurgeAll", method: http.MethodDelete, path: "/deadletters", want: http.StatusOK, wantLeft: 0},
+		{name: "PostElsewhere", method: http.MethodPost, path: "/routes", want: http.StatusMethodNotAllowed, wantLeft: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlq := &fakeDeadLetters{letters: map[string]worker.DeadLetter{
+				"0-1-1": {ID: "0-1-1", CommandID: 1},
+				"1-2-2": {ID: "1-2-2", CommandID: 2},
+			}}
+			server := testServer(t, dlq, nil)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %v, want %v: %s", rec.Code, tt.want, rec.Body)
+			}
+			if len(dlq.letters) != tt.wantLeft {
+				t.Errorf("%d dead letters left, want %d", len(dlq.letters), tt.wantLeft)
+			}
+			if got := len(dlq.requeued) == 1; got != tt.wantRequeue {
+				t.Errorf("requeued = %v, want %v", dlq.requeued, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestDeadLetters_Page(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{name: "Default", path: "/deadletters", want: []string{"0-1-1", "1-2-2", "2-3-3"}},
+		{name: "Limit", path: "/deadletters?limit=2", want: []string{"0-1-1", "1-2-2"}},
+		{name: "Offset", path: "/deadletters?offset=2&limit=2", want: []string{"2-3-3"}},
+		{name: "PastTheEnd", path: "/deadletters?offset=5", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlq := &fakeDeadLetters{letters: map[string]worker.DeadLetter{
+				"0-1-1": {ID: "0-1-1", CommandID: 1},
+				"1-2-2": {ID: "1-2-2", CommandID: 2},
+				"2-3-3": {ID: "2-3-3", CommandID: 3},
+			}}
+			server := testServer(t, dlq, nil)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			var page worker.DeadLetterPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("status = %v, body %s: %v", rec.Code, rec.Body, err)
+			}
+			got := []string{}
+			for _, d := range page.DeadLetters {
+				got = append(got, d.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) || page.Total != 3 {
+				t.Errorf("page = %v of %d, want %v of 3", got, page.Total, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadLetters_NoWorkers(t *testing.T) {
+	server := testServer(t, nil, nil)
+	req := httptest.NewRequest(http.MethodGet, "/deadletters", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,232 @@
+package admin
+
+import (
+	"filters"
+	"limiter"
+	"metrics"
+	"routes"
+	"time"
+	"types"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type routeInfo struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Upstream string `json:"upstream,omitempty"`
+	// filter chains in the order they run, as type.strategy
+	BeforeFilters       []string               `json:"beforeFilters"`
+	AfterFilters        []string               `json:"afterFilters"`
+	MaxRequestBodyBytes int64                  `json:"maxRequestBodyBytes"`
+	Timeouts            types.UpstreamTimeouts `json:"timeouts"`
+	Retry               *types.RetryPolicy     `json:"retry,omitempty"`
+	Concurrency         *limiterInfo           `json:"concurrency,omitempty"`
+}
+
+type upstreamInfo struct {
+	Name        string              `json:"name"`
+	Hosts       []routes.HostStatus `json:"hosts"`
+	Concurrency *limiterInfo        `json:"concurrency,omitempty"`
+}
+
+type limiterInfo struct {
+	Name     string `json:"name"`
+	Limit    int    `json:"limit"`
+	InFlight int    `json:"inFlight"`
+	Queued   int    `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// limits are the rate-limit counters: the concurrency limiters, the requests
+// rejected by throttle filters per strategy and the shared retry budget.
+type limits struct {
+	Concurrency []limiterInfo      `json:"concurrency"`
+	Throttled   map[string]float64 `json:"throttled"`
+	RetryBudget retryBudgetInfo    `json:"retryBudget"`
+}
+
+type retryBudgetInfo struct {
+	// Requests and Retries seen over the window of the budget, which
+	// allows Allowed retries.
+	Requests int     `json:"requests"`
+	Retries  int     `json:"retries"`
+	Allowed  float64 `json:"allowed"`
+}
+
+// configInfo is what /config serves of the config. Fields are copied one by
+// one so that a new setting, a secret in particular, is not served unless
+// added here.
+type configInfo struct {
+	Port                string            `json:"port"`
+	AdminPort           string            `json:"adminPort"`
+	ShutdownTimeout     time.Duration     `json:"shutdownTimeout"`
+	DrainDelay          time.Duration     `json:"drainDelay"`
+	ReadHeaderTimeout   time.Duration     `json:"readHeaderTimeout"`
+	ReadTimeout         time.Duration     `json:"readTimeout"`
+	WriteTimeout        time.Duration     `json:"writeTimeout"`
+	IdleTimeout         time.Duration     `json:"idleTimeout"`
+	MaxHeaderBytes      int               `json:"maxHeaderBytes"`
+	MaxRequestBodyBytes int64             `json:"maxRequestBodyBytes"`
+	MaxConnections      int               `json:"maxConnections"`
+	RetryBudget         types.RetryBudget `json:"retryBudget"`
+	AccessLogFormat     string            `json:"accessLogFormat"`
+	InstrumentBackend   string            `json:"instrumentBackend"`
+	TracingExporter     string            `json:"tracingExporter"`
+	LogLevel            string            `json:"logLevel"`
+	OptionalHealth      []string          `json:"optionalHealth"`
+	Workers             workersInfo       `json:"workers"`
+	Routes              []string          `json:"routes"`
+	Upstreams           []string          `json:"upstreams"`
+}
+
+type workersInfo struct {
+	Servers           int           `json:"servers"`
+	Queue             string        `json:"queue"`
+	Concurrency       int           `json:"concurrency"`
+	MaxInFlight       int           `json:"maxInFlight"`
+	VisibilityTimeout time.Duration `json:"visibilityTimeout"`
+	BufferSize        int           `json:"bufferSize"`
+	CallbackRetries   int           `json:"callbackRetries"`
+	CallbacksSigned   bool          `json:"callbacksSigned"`
+}
+
+func newConfigInfo(config *types.ServerConfig) configInfo {
+	info := configInfo{
+		Port:                config.Port,
+		AdminPort:           config.Admin.Port,
+		ShutdownTimeout:     config.ShutdownTimeout,
+		DrainDelay:          config.DrainDelay,
+		ReadHeaderTimeout:   config.ReadHeaderTimeout,
+		ReadTimeout:         config.ReadTimeout,
+		WriteTimeout:        config.WriteTimeout,
+		IdleTimeout:         config.IdleTimeout,
+		MaxHeaderBytes:      config.MaxHeaderBytes,
+		MaxRequestBodyBytes: config.MaxRequestBodyBytes,
+		MaxConnections:      config.MaxConnections,
+		RetryBudget:         config.RetryBudget,
+		AccessLogFormat:     config.AccessLog.Format,
+		InstrumentBackend:   config.Instrument.Backend,
+		TracingExporter:     config.Tracing.Exporter,
+		LogLevel:            config.Logging.Level,
+		OptionalHealth:      config.Health.Optional,
+		Workers: workersInfo{
+			Servers:           len(config.Workers.Servers),
+			Queue:             config.Workers.Queue,
+			Concurrency:       config.Workers.Concurrency,
+			MaxInFlight:       config.Workers.MaxInFlight,
+			VisibilityTimeout: config.Workers.VisibilityTimeout,
+			BufferSize:        config.Workers.BufferSize,
+			CallbackRetries:   config.Workers.Callbacks.Retries,
+			CallbacksSigned:   config.Workers.Callbacks.SigningSecret() != "",
+		},
+	}
+	for _, route := range config.Routes {
+		info.Routes = append(info.Routes, route.Name)
+	}
+	for _, upstream := range config.Upstreams {
+		info.Upstreams = append(info.Upstreams, upstream.Name)
+	}
+	return info
+}
+
+func routeInfos(config *types.ServerConfig, shared *routes.Shared) []routeInfo {
+	limiters := limiterInfosByName(shared)
+	infos := make([]routeInfo, 0, len(config.Routes))
+	for _, route := range config.Routes {
+		infos = append(infos, routeInfo{
+			Name:                route.Name,
+			Location:            route.Location,
+			Upstream:            route.ForwardUpstream,
+			BeforeFilters:       filterChain(route.BeforeFilters),
+			AfterFilters:        filterChain(route.AfterFilters),
+			MaxRequestBodyBytes: route.MaxRequestBodyBytes,
+			Timeouts:            route.Timeouts,
+			Retry:               route.Retry,
+			Concurrency:         limiters["route:"+route.Name],
+		})
+	}
+	return infos
+}
+
+func upstreamInfos(config *types.ServerConfig, shared *routes.Shared) []upstreamInfo {
+	limiters := limiterInfosByName(shared)
+	infos := make([]upstreamInfo, 0, len(config.Upstreams))
+	for _, upstream := range config.Upstreams {
+		infos = append(infos, upstreamInfo{
+			Name:        upstream.Name,
+			Hosts:       shared.Hosts(upstream),
+			Concurrency: limiters["upstream:"+upstream.Name],
+		})
+	}
+	return infos
+}
+
+func limiterInfos(shared *routes.Shared) []limiterInfo {
+	var infos []limiterInfo
+	for _, l := range shared.Limiters() {
+		infos = append(infos, newLimiterInfo(l))
+	}
+	return infos
+}
+
+func limitsInfo(shared *routes.Shared) limits {
+	requests, retries, allowed := shared.RetryBudget().Stats()
+	return limits{
+		Concurrency: limiterInfos(shared),
+		Throttled:   counterValues(metrics.Throttled, "strategy"),
+		RetryBudget: retryBudgetInfo{Requests: requests, Retries: retries, Allowed: allowed},
+	}
+}
+
+// counterValues returns the values of counter by label.
+func counterValues(counter *prometheus.CounterVec, label string) map[string]float64 {
+	collected := make(chan prometheus.Metric)
+	go func() {
+		counter.Collect(collected)
+		close(collected)
+	}()
+
+	values := make(map[string]float64)
+	for metric := range collected {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			continue
+		}
+		for _, pair := range m.GetLabel() {
+			if pair.GetName() == label {
+				values[pair.GetValue()] += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func limiterInfosByName(shared *routes.Shared) map[string]*limiterInfo {
+	infos := make(map[string]*limiterInfo)
+	for _, l := range shared.Limiters() {
+		info := newLimiterInfo(l)
+		infos[l.Name()] = &info
+	}
+	return infos
+}
+
+func newLimiterInfo(l *limiter.Limiter) limiterInfo {
+	limit, inFlight, queued := l.Stats()
+	return limiterInfo{
+		Name:     l.Name(),
+		Limit:    limit,
+		InFlight: inFlight,
+		Queued:   queued,
+		Rejected: l.Rejected(),
+	}
+}
+
+func filterChain(chain []filters.Filter) []string {
+	names := make([]string, 0, len(chain))
+	for _, filter := range chain {
+		names = append(names, filter.Type+"."+filter.Strategy)
+	}
+	return names
+}
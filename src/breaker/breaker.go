@@ -0,0 +1,261 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// State of a circuit.
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return "unknown"
+}
+
+var (
+	// ErrOpen is returned by Allow while the circuit rejects requests.
+	ErrOpen = errors.New("circuit open")
+
+	defaultConsecutiveFailures = 5
+	defaultMinRequests         = 20
+	defaultWindow              = 10 * time.Second
+	defaultOpenTimeout         = 30 * time.Second
+	defaultHalfOpenRequests    = 1
+)
+
+// Settings of a circuit breaker, as configured on an upstream.
+type Settings struct {
+	// ConsecutiveFailures trips the circuit after that many failures in a row.
+	ConsecutiveFailures int `yaml:"consecutiveFailures"`
+	// ErrorRate trips the circuit once the share of failures in Window
+	// reaches it, as long as at least MinRequests were seen. 0 disables it.
+	ErrorRate   float64       `yaml:"errorRate"`
+	MinRequests int           `yaml:"minRequests"`
+	Window      time.Duration `yaml:"window"`
+	// OpenTimeout is how long the circuit stays open before letting
+	// HalfOpenRequests probes through. Probes whose outcome was not
+	// reported within OpenTimeout are given up on and new ones let through.
+	OpenTimeout      time.Duration `yaml:"openTimeout"`
+	HalfOpenRequests int           `yaml:"halfOpenRequests"`
+	// PerHost keeps a circuit per upstream host instead of one per upstream.
+	PerHost bool `yaml:"perHost"`
+}
+
+func (s *Settings) setDefaults() {
+	if s.ConsecutiveFailures <= 0 && s.ErrorRate <= 0 {
+		s.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if s.MinRequests <= 0 {
+		s.MinRequests = defaultMinRequests
+	}
+	if s.Window < time.Second {
+		s.Window = defaultWindow
+	}
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = defaultOpenTimeout
+	}
+	if s.HalfOpenRequests <= 0 {
+		s.HalfOpenRequests = defaultHalfOpenRequests
+	}
+}
+
+// OnStateChange is called after a circuit changed state.
+type OnStateChange func(b *Breaker, from, to State)
+
+// Breaker is a circuit breaker for one upstream or upstream host.
+type Breaker struct {
+	upstream string
+	host     string
+	settings Settings
+	onChange OnStateChange
+
+	mu          sync.Mutex
+	state       State
+	generation  uint64
+	openedAt    time.Time
+	probedAt    time.Time
+	consecutive int
+	probes      int
+	successes   int
+	buckets     []bucket
+}
+
+type bucket struct {
+	second    int64
+	successes int
+	failures  int
+}
+
+// New is constructor for Breaker. host is empty for a per upstream circuit.
+func New(upstream, host string, settings Settings, onChange OnStateChange) *Breaker {
+	settings.setDefaults()
+	return &Breaker{
+		upstream: upstream,
+		host:     host,
+		settings: settings,
+		onChange: onChange,
+		buckets:  make([]bucket, int(settings.Window/time.Second)),
+	}
+}
+
+// Upstream the circuit belongs to.
+func (b *Breaker) Upstream() string {
+	return b.upstream
+}
+
+// Host the circuit belongs to, empty for a per upstream circuit.
+func (b *Breaker) Host() string {
+	return b.host
+}
+
+// State of the circuit.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a request may go through. When it may, done must be
+// called with the outcome of the request.
+func (b *Breaker) Allow() (done func(success bool), err error) {
+	b.mu.Lock()
+	now := time.Now()
+	from := b.state
+
+	if b.state == Open && now.Sub(b.openedAt) >= b.settings.OpenTimeout {
+		b.setState(HalfOpen, now)
+	}
+	// the outcome of the probes was lost, e.g. their client went away
+	if b.state == HalfOpen && b.probes >= b.settings.HalfOpenRequests && now.Sub(b.probedAt) >= b.settings.OpenTimeout {
+		b.setState(HalfOpen, now)
+	}
+
+	switch {
+	case b.state == Open:
+		err = ErrOpen
+	case b.state == HalfOpen && b.probes >= b.settings.HalfOpenRequests:
+		err = ErrOpen
+	case b.state == HalfOpen:
+		b.probes++
+		b.probedAt = now
+	}
+	to, generation := b.state, b.generation
+	b.mu.Unlock()
+
+	b.notify(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return func(success bool) {
+		b.record(generation, success)
+	}, nil
+}
+
+func (b *Breaker) record(generation uint64, success bool) {
+	b.mu.Lock()
+
+	// outcome of a request let through before the last transition
+	if generation != b.generation {
+		b.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	from := b.state
+	switch b.state {
+	case HalfOpen:
+		if !success {
+			b.setState(Open, now)
+			break
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenRequests {
+			b.setState(Closed, now)
+		}
+	case Closed:
+		current := b.bucket(now)
+		if success {
+			current.successes++
+			b.consecutive = 0
+			break
+		}
+		current.failures++
+		b.consecutive++
+		if b.shouldTrip(now) {
+			b.setState(Open, now)
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// shouldTrip must be called with mu held.
+func (b *Breaker) shouldTrip(now time.Time) bool {
+	if b.settings.ConsecutiveFailures > 0 && b.consecutive >= b.settings.ConsecutiveFailures {
+		return true
+	}
+	if b.settings.ErrorRate <= 0 {
+		return false
+	}
+
+	oldest := now.Unix() - int64(len(b.buckets))
+	var successes, failures int
+	for _, bucket := range b.buckets {
+		if bucket.second > oldest {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	total := successes + failures
+	return total >= b.settings.MinRequests && float64(failures)/float64(total) >= b.settings.ErrorRate
+}
+
+// bucket must be called with mu held.
+func (b *Breaker) bucket(now time.Time) *bucket {
+	second := now.Unix()
+	current := &b.buckets[second%int64(len(b.buckets))]
+	if current.second != second {
+		*current = bucket{second: second}
+	}
+	return current
+}
+
+// setState must be called with mu held.
+func (b *Breaker) setState(state State, now time.Time) {
+	b.state = state
+	b.generation++
+	b.consecutive = 0
+	b.probes = 0
+	b.successes = 0
+	if state == Open {
+		b.openedAt = now
+	}
+	if state == Closed {
+		for i := range b.buckets {
+			b.buckets[i] = bucket{}
+		}
+	}
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.onChange != nil {
+		b.onChange(b, from, to)
+	}
+}
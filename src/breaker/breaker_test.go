@@ -0,0 +1,119 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker_Trip(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		outcomes []bool
+		want     State
+	}{
+		{
+			name:     "ConsecutiveFailures",
+			settings: Settings{ConsecutiveFailures: 3},
+			outcomes: []bool{false, false, false},
+			want:     Open,
+		},
+		{
+			name:     "SuccessResetsConsecutiveFailures",
+			settings: Settings{ConsecutiveFailures: 3},
+			outcomes: []bool{false, false, true, false, false},
+			want:     Closed,
+		},
+		{
+			name:     "ErrorRate",
+			settings: Settings{ErrorRate: 0.5, MinRequests: 4},
+			outcomes: []bool{true, false, true, false},
+			want:     Open,
+		},
+		{
+			name:     "ErrorRateBelowMinRequests",
+			settings: Settings{ErrorRate: 0.5, MinRequests: 10},
+			outcomes: []bool{false, false, false},
+			want:     Closed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("upstream", "", tt.settings, nil)
+			for _, success := range tt.outcomes {
+				done, err := b.Allow()
+				if err != nil {
+					t.Fatalf("Allow() error = %v", err)
+				}
+				done(success)
+			}
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	var transitions []State
+	b := New("upstream", "", Settings{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Millisecond}, func(b *Breaker, from, to State) {
+		transitions = append(transitions, to)
+	})
+
+	done, _ := b.Allow()
+	done(false)
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Fatalf("Allow() error = %v, want %v", err, ErrOpen)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	probe, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() after OpenTimeout error = %v", err)
+	}
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() beyond HalfOpenRequests error = %v, want %v", err, ErrOpen)
+	}
+	probe(true)
+
+	want := []State{Open, HalfOpen, Closed}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestBreaker_LostProbe(t *testing.T) {
+	b := New("upstream", "", Settings{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Millisecond}, nil)
+	done, _ := b.Allow()
+	done(false)
+
+	time.Sleep(20 * time.Millisecond)
+	lost, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() after OpenTimeout error = %v", err)
+	}
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Fatalf("Allow() while probing error = %v, want %v", err, ErrOpen)
+	}
+
+	// the first probe never reports back
+	time.Sleep(20 * time.Millisecond)
+	probe, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() once the probe is lost error = %v", err)
+	}
+	// a late outcome of the lost probe is ignored
+	lost(false)
+	if got := b.State(); got != HalfOpen {
+		t.Fatalf("State() after the lost probe reported = %v, want %v", got, HalfOpen)
+	}
+	probe(true)
+	if got := b.State(); got != Closed {
+		t.Errorf("State() = %v, want %v", got, Closed)
+	}
+}
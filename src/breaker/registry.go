@@ -0,0 +1,60 @@
+package breaker
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry keeps the circuit breakers of every upstream, so that routes
+// forwarding to the same upstream share its circuits.
+type Registry struct {
+	onChange OnStateChange
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewRegistry is constructor for Registry, onChange is set on every Breaker
+// it creates.
+func NewRegistry(onChange OnStateChange) *Registry {
+	return &Registry{
+		onChange: onChange,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// Get returns the breaker of upstream (and host when settings.PerHost),
+// creating it on first use.
+func (r *Registry) Get(upstream, host string, settings Settings) *Breaker {
+	if !settings.PerHost {
+		host = ""
+	}
+	key := upstream + "/" + host
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[key]
+	if !ok {
+		b = New(upstream, host, settings, r.onChange)
+		r.breakers[key] = b
+	}
+	return b
+}
+
+// Breakers returns every breaker sorted by upstream and host.
+func (r *Registry) Breakers() []*Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breakers := make([]*Breaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	sort.Slice(breakers, func(i, j int) bool {
+		if breakers[i].upstream != breakers[j].upstream {
+			return breakers[i].upstream < breakers[j].upstream
+		}
+		return breakers[i].host < breakers[j].host
+	})
+	return breakers
+}
@@ -0,0 +1,49 @@
+package capture
+
+import "sync"
+
+// Buffer keeps the most recent exchanges, dropping the oldest once full.
+type Buffer struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	next      int
+	full      bool
+}
+
+// NewBuffer is constructor for Buffer, size defaults to 100.
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return &Buffer{exchanges: make([]Exchange, size)}
+}
+
+// Add an exchange, overwriting the oldest one if the buffer is full.
+func (b *Buffer) Add(e Exchange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.exchanges[b.next] = e
+	b.next = (b.next + 1) % len(b.exchanges)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Exchanges returns the buffered exchanges of route, oldest first, or of
+// every route when route is empty.
+func (b *Buffer) Exchanges(route string) []Exchange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ordered := b.exchanges[:b.next]
+	if b.full {
+		ordered = append(append([]Exchange{}, b.exchanges[b.next:]...), b.exchanges[:b.next]...)
+	}
+	exchanges := []Exchange{}
+	for _, e := range ordered {
+		if route == "" || e.Route == route {
+			exchanges = append(exchanges, e)
+		}
+	}
+	return exchanges
+}
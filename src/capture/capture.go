@@ -0,0 +1,207 @@
+package capture
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"requestid"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBodyBytes = 4096
+	defaultBufferSize   = 100
+)
+
+// alwaysRedacted headers carry credentials on every route.
+var alwaysRedacted = []string{"Authorization", "Proxy-Authorization", "X-Auth-Token", "Cookie", "Set-Cookie"}
+
+// alwaysRedactedQuery parameters carry credentials on every route.
+var alwaysRedactedQuery = []string{"token", "access_token", "api_key", "apikey", "password", "secret", "signature"}
+
+// alwaysRedactedFields carry credentials on every route, they are masked
+// at any depth of JSON and form bodies.
+var alwaysRedactedFields = []string{"password", "token", "access_token", "api_key", "apikey", "secret", "authorization"}
+
+// Settings enable debug capture of the upstream exchanges of a route.
+type Settings struct {
+	// SampleRate is the fraction of requests captured, all of them when 0.
+	SampleRate float64 `yaml:"sampleRate"`
+	// MaxBodyBytes caps how much of each body is kept, the rest is
+	// streamed through untouched.
+	MaxBodyBytes int `yaml:"maxBodyBytes"`
+	// RedactHeaders are masked on top of Authorization, X-Auth-Token and
+	// cookies.
+	RedactHeaders []string `yaml:"redactHeaders"`
+	// RedactQuery are query parameters masked in the captured URL on top of
+	// token, access_token, api_key, password, secret and signature. "*"
+	// matches any parameter.
+	RedactQuery []string `yaml:"redactQuery"`
+	// RedactFields are JSON field paths, like "user.password", masked in
+	// JSON and form bodies on top of the password, token, secret and
+	// authorization fields found at any depth. "*" matches any field.
+	RedactFields []string `yaml:"redactFields"`
+}
+
+func (s *Settings) setDefaults() {
+	if s.SampleRate <= 0 || s.SampleRate > 1 {
+		s.SampleRate = 1
+	}
+	if s.MaxBodyBytes <= 0 {
+		s.MaxBodyBytes = defaultMaxBodyBytes
+	}
+}
+
+// Exchange is a captured upstream request and its response.
+type Exchange struct {
+	Time                  time.Time   `json:"time"`
+	RequestID             string      `json:"requestId,omitempty"`
+	Route                 string      `json:"route"`
+	Method                string      `json:"method"`
+	URL                   string      `json:"url"`
+	RequestHeaders        http.Header `json:"requestHeaders"`
+	RequestBody           string      `json:"requestBody,omitempty"`
+	RequestBodyTruncated  bool        `json:"requestBodyTruncated,omitempty"`
+	Status                int         `json:"status,omitempty"`
+	ResponseHeaders       http.Header `json:"responseHeaders,omitempty"`
+	ResponseBody          string      `json:"responseBody,omitempty"`
+	ResponseBodyTruncated bool        `json:"responseBodyTruncated,omitempty"`
+	// Latency in milliseconds until the response body was consumed.
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Transport returns a RoundTripper which captures a sample of the exchanges
+// going through next into buffer.
+func Transport(route string, settings Settings, buffer *Buffer, next http.RoundTripper) http.RoundTripper {
+	settings.setDefaults()
+	headerNames := append(append([]string{}, alwaysRedacted...), settings.RedactHeaders...)
+	queryNames := append(append([]string{}, alwaysRedactedQuery...), settings.RedactQuery...)
+	return &transport{
+		route:    route,
+		settings: settings,
+		redactor: newRedactor(headerNames, queryNames, alwaysRedactedFields, settings.RedactFields),
+		buffer:   buffer,
+		next:     next,
+	}
+}
+
+type transport struct {
+	route    string
+	settings Settings
+	redactor *redactor
+	buffer   *Buffer
+	next     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.settings.SampleRate < 1 && rand.Float64() >= t.settings.SampleRate {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	e := &Exchange{
+		Time:           start,
+		RequestID:      requestid.FromContext(req.Context()),
+		Route:          t.route,
+		Method:         req.Method,
+		URL:            t.redactor.url(req.URL),
+		RequestHeaders: t.redactor.headers(req.Header),
+	}
+	var requestBody *cappedBuffer
+	if req.Body != nil && req.Body != http.NoBody {
+		requestBody = &cappedBuffer{max: t.settings.MaxBodyBytes}
+		req.Body = &teeReadCloser{ReadCloser: req.Body, capture: requestBody}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	e.RequestBody, e.RequestBodyTruncated = t.redactor.body(req.Header.Get("Content-Type"), requestBody)
+	if err != nil {
+		e.Error = err.Error()
+		e.Latency = milliseconds(time.Since(start))
+		t.buffer.Add(*e)
+		return resp, err
+	}
+
+	e.Status = resp.StatusCode
+	e.ResponseHeaders = t.redactor.headers(resp.Header)
+	responseBody := &cappedBuffer{max: t.settings.MaxBodyBytes}
+	resp.Body = &teeReadCloser{
+		ReadCloser: resp.Body,
+		capture:    responseBody,
+		onClose: func() {
+			e.ResponseBody, e.ResponseBodyTruncated = t.redactor.body(resp.Header.Get("Content-Type"), responseBody)
+			e.Latency = milliseconds(time.Since(start))
+			t.buffer.Add(*e)
+		},
+	}
+	return resp, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it. It is written from
+// the transport and read from the proxy, hence the lock.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	max       int
+	data      []byte
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := b.max - len(b.data)
+	if len(p) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.data = append(b.data, p...)
+}
+
+func (b *cappedBuffer) bytes() ([]byte, bool) {
+	if b == nil {
+		return nil, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.data...), b.truncated
+}
+
+// teeReadCloser copies what is read through it into capture.
+type teeReadCloser struct {
+	io.ReadCloser
+	capture *cappedBuffer
+	onClose func()
+	once    sync.Once
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	err := t.ReadCloser.Close()
+	if t.onClose != nil {
+		t.once.Do(t.onClose)
+	}
+	return err
+}
+
+func isJSON(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isForm(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "application/x-www-form-urlencoded")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,179 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// withheld replaces bodies that cannot be redacted reliably.
+const withheld = "[WITHHELD: truncated body cannot be redacted]"
+
+type redactor struct {
+	headerNames []string
+	queryNames  []string
+	// fieldNames are masked wherever they are found in a body.
+	fieldNames []string
+	fields     [][]string
+}
+
+func newRedactor(headerNames, queryNames, fieldNames, fields []string) *redactor {
+	r := &redactor{queryNames: queryNames, fieldNames: fieldNames}
+	for _, name := range headerNames {
+		r.headerNames = append(r.headerNames, http.CanonicalHeaderKey(name))
+	}
+	for _, field := range fields {
+		r.fields = append(r.fields, strings.Split(field, "."))
+	}
+	return r
+}
+
+// headers returns a copy of h with sensitive values masked.
+func (r *redactor) headers(h http.Header) http.Header {
+	clone := h.Clone()
+	for _, name := range r.headerNames {
+		if _, ok := clone[name]; ok {
+			clone[name] = []string{redacted}
+		}
+	}
+	return clone
+}
+
+// url returns u with the password and sensitive query values masked.
+func (r *redactor) url(u *url.URL) string {
+	clone := *u
+	if password, ok := u.User.Password(); ok && password != "" {
+		clone.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if u.RawQuery == "" {
+		return clone.String()
+	}
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		clone.RawQuery = redacted
+		return clone.String()
+	}
+	for key := range values {
+		for _, name := range r.queryNames {
+			if name == "*" || strings.EqualFold(name, key) {
+				values[key] = []string{redacted}
+			}
+		}
+	}
+	clone.RawQuery = values.Encode()
+	return clone.String()
+}
+
+// body returns the captured body with the configured fields masked. Bodies
+// which are neither JSON nor forms are kept as they are.
+func (r *redactor) body(contentType string, captured *cappedBuffer) (string, bool) {
+	data, truncated := captured.bytes()
+	if len(data) == 0 || len(r.fields) == 0 && len(r.fieldNames) == 0 {
+		return string(data), truncated
+	}
+
+	switch {
+	case isJSON(contentType):
+		if truncated {
+			return withheld, truncated
+		}
+		return r.json(data), truncated
+	case isForm(contentType):
+		return r.form(data), truncated
+	}
+	return string(data), truncated
+}
+
+func (r *redactor) json(data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return withheld
+	}
+	redactNames(v, r.fieldNames)
+	for _, path := range r.fields {
+		redactPath(v, path)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return withheld
+	}
+	return string(out)
+}
+
+// form redacts the top level fields of a url encoded body.
+func (r *redactor) form(data []byte) string {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return withheld
+	}
+	for key := range values {
+		if matchesName(key, r.fieldNames) {
+			values[key] = []string{redacted}
+		}
+	}
+	for _, path := range r.fields {
+		if len(path) != 1 {
+			continue
+		}
+		for key := range values {
+			if path[0] == "*" || path[0] == key {
+				values[key] = []string{redacted}
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// redactPath masks the fields of v at path, arrays are walked through.
+func redactPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				v[key] = redacted
+				continue
+			}
+			redactPath(child, path[1:])
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactPath(child, path)
+		}
+	}
+}
+
+// redactNames masks the fields of v named one of names, at any depth.
+func redactNames(v interface{}, names []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if matchesName(key, names) {
+				v[key] = redacted
+				continue
+			}
+			redactNames(child, names)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactNames(child, names)
+		}
+	}
+}
+
+func matchesName(key string, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,12 +4,18 @@ import (
 	"net/http"
 )
 
-func AuthFactory(name string) func(w http.ResponseWriter, r *http.Request) {
+// TokenStore looks up the fields of auth tokens, failing when the field
+// cannot be read or does not exist.
+type TokenStore interface {
+	GetStringKeyFromMap(main_key string, sub_key string) (string, error)
+}
+
+func AuthFactory(name string, tokens TokenStore) func(w http.ResponseWriter, r *http.Request) {
 	switch name {
 	case "session":
 		return sessionAuthMethod()
 	case "token":
-		return tokenAuthMethod()
+		return tokenAuthMethod(tokens)
 	case "tugboat":
 		return tugboatAuthMethod()
 	default:
@@ -1,31 +1,34 @@
 package auth
 
 import (
+	"accesslog"
 	"fmt"
+	"logging"
 	"net/http"
-	"redis_local"
+
+	"github.com/go-kit/kit/log/level"
 )
 
-func tokenAuthMethod() func(w http.ResponseWriter, r *http.Request) {
+// tokenAuthMethod accepts requests whose X-Auth-Token belongs to an account,
+// writing nothing so that the route answers them. Requests without a token,
+// with an unknown one or whose token cannot be looked up are rejected.
+func tokenAuthMethod(tokens TokenStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		return_text := ""
+		logger := logging.FromContext(r.Context())
 		token := r.Header.Get("X-Auth-Token")
-		if token != "" {
-			return_text += "Token is not null:" + token + "\n"
-			search_key := fmt.Sprintf("auth_token:%s", token)
-			account_id := redis_local.GetStringKeyFromMap(search_key, "account_id")
-			if account_id == "" {
-				return_text += "Could not validate account using the given token" + "\n"
-			} else {
-				return_text += "Authenicated, user is from Account id:" + account_id + "\n"
-				fmt.Fprintln(w, return_text)
-				fmt.Printf("\n%+v\n", w)
-				return
-			}
-		} else {
-			return_text = "Token is empty"
+		if token == "" {
+			http.Error(w, "Token is empty", http.StatusForbidden)
+			level.Info(logger).Log("msg", "authentication failed", "token_present", false)
+			return
+		}
+		search_key := fmt.Sprintf("auth_token:%s", token)
+		account_id, err := tokens.GetStringKeyFromMap(search_key, "account_id")
+		if err != nil || account_id == "" {
+			http.Error(w, "Could not validate account using the given token", http.StatusForbidden)
+			level.Info(logger).Log("msg", "authentication failed", "token_present", true, "err", err)
+			return
 		}
-		http.Error(w, return_text, http.StatusForbidden)
-		fmt.Println("%+v", w)
+		accesslog.FromContext(r.Context()).SetPrincipal("account:" + account_id)
+		level.Debug(logger).Log("msg", "authenticated", "account_id", account_id)
 	}
 }
@@ -5,8 +5,15 @@ import (
 	"filters/headers"
 	"filters/throttle"
 	"fmt"
-	"log"
+	"logging"
+	"metrics"
 	"net/http"
+	"requestid"
+	"tracing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Filter struct {
@@ -14,20 +21,57 @@ type Filter struct {
 	Strategy string `yaml:"strategy"`
 }
 
-func PerformFilters(routeFilters []Filter, w http.ResponseWriter, r *http.Request) {
+// PerformFilters runs routeFilters in order. A filter answering with an
+// error status rejects the request: the rest are skipped and it returns false.
+func PerformFilters(logger log.Logger, tokens auth.TokenStore, routeFilters []Filter, w http.ResponseWriter, r *http.Request) bool {
+	logger = log.With(logger, "request_id", requestid.FromContext(r.Context()))
 	for _, filter := range routeFilters {
-		log.Println("Called: ", filter.Type, filter.Strategy)
-		perform_function := FiltersFactory(filter.Type, filter.Strategy)
-		perform_function(w, r)
+		level.Debug(logger).Log("msg", "filter called", "type", filter.Type, "strategy", filter.Strategy)
+		perform_function := FiltersFactory(filter.Type, filter.Strategy, tokens)
+		ctx, span := tracing.Start(r.Context(), "filter "+filter.Type+"."+filter.Strategy)
+		ctx = logging.NewContext(ctx, log.With(logger, "filter", filter.Type+"."+filter.Strategy))
+		recorder := &statusRecorder{ResponseWriter: w}
+		perform_function(recorder, r.WithContext(ctx))
+		if recorder.status != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		}
+		span.End()
+		countRejection(filter, recorder.status)
+		if recorder.status >= http.StatusBadRequest {
+			level.Debug(logger).Log("msg", "filter rejected request", "type", filter.Type, "strategy", filter.Strategy, "status", recorder.status)
+			return false
+		}
+	}
+	return true
+}
+
+// countRejection counts requests rejected by auth and throttle filters.
+func countRejection(filter Filter, status int) {
+	switch {
+	case filter.Type == "auth" && (status == http.StatusUnauthorized || status == http.StatusForbidden):
+		metrics.AuthFailures.WithLabelValues(filter.Strategy).Inc()
+	case filter.Type == "throttle" && status == http.StatusTooManyRequests:
+		metrics.Throttled.WithLabelValues(filter.Strategy).Inc()
 	}
 }
 
+// statusRecorder remembers the status code written by a filter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
 type filterMethod func(w http.ResponseWriter, r *http.Request)
 
-func FiltersFactory(filterType string, strategy string) filterMethod {
+func FiltersFactory(filterType string, strategy string, tokens auth.TokenStore) filterMethod {
 	switch filterType {
 	case "auth":
-		return auth.AuthFactory(strategy)
+		return auth.AuthFactory(strategy, tokens)
 	case "throttle":
 		return throttle.ThrottleFactory(strategy)
 	case "headers":
@@ -0,0 +1,141 @@
+package filters
+
+import (
+	"errors"
+	"io/ioutil"
+	"metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPerformFilters(t *testing.T) {
+	tests := []struct {
+		name          string
+		filters       []Filter
+		wantNext      bool
+		wantStatus    int
+		wantAuth      float64
+		wantThrottled float64
+	}{
+		{
+			name:       "Passed",
+			filters:    []Filter{{Type: "throttle", Strategy: "default"}, {Type: "headers", Strategy: "default"}},
+			wantNext:   true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "AuthFailure",
+			filters:    []Filter{{Type: "auth", Strategy: "session"}, {Type: "headers", Strategy: "default"}},
+			wantStatus: http.StatusForbidden,
+			wantAuth:   1,
+		},
+		{
+			name:       "UnknownFilter",
+			filters:    []Filter{{Type: "unknown"}},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("session"))
+			throttled := testutil.ToFloat64(metrics.Throttled.WithLabelValues("default"))
+
+			w := httptest.NewRecorder()
+			next := PerformFilters(log.NewLogfmtLogger(ioutil.Discard), nil, tt.filters, w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if next != tt.wantNext {
+				t.Errorf("PerformFilters() = %v, want %v", next, tt.wantNext)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("session")) - auth; got != tt.wantAuth {
+				t.Errorf("auth failures = %v, want %v", got, tt.wantAuth)
+			}
+			if got := testutil.ToFloat64(metrics.Throttled.WithLabelValues("default")) - throttled; got != tt.wantThrottled {
+				t.Errorf("throttled = %v, want %v", got, tt.wantThrottled)
+			}
+		})
+	}
+}
+
+func TestCountRejection(t *testing.T) {
+	tests := []struct {
+		name          string
+		filter        Filter
+		status        int
+		wantAuth      float64
+		wantThrottled float64
+	}{
+		{name: "Unauthorized", filter: Filter{Type: "auth", Strategy: "token"}, status: http.StatusUnauthorized, wantAuth: 1},
+		{name: "Forbidden", filter: Filter{Type: "auth", Strategy: "token"}, status: http.StatusForbidden, wantAuth: 1},
+		{name: "Authenticated", filter: Filter{Type: "auth", Strategy: "token"}, status: 0},
+		{name: "Throttled", filter: Filter{Type: "throttle", Strategy: "token"}, status: http.StatusTooManyRequests, wantThrottled: 1},
+		{name: "ForbiddenByThrottle", filter: Filter{Type: "throttle", Strategy: "token"}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("token"))
+			throttled := testutil.ToFloat64(metrics.Throttled.WithLabelValues("token"))
+			countRejection(tt.filter, tt.status)
+			if got := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("token")) - auth; got != tt.wantAuth {
+				t.Errorf("auth failures = %v, want %v", got, tt.wantAuth)
+			}
+			if got := testutil.ToFloat64(metrics.Throttled.WithLabelValues("token")) - throttled; got != tt.wantThrottled {
+				t.Errorf("throttled = %v, want %v", got, tt.wantThrottled)
+			}
+		})
+	}
+}
+
+// tokenStore maps "auth_token:<token>" keys to account ids.
+type tokenStore map[string]string
+
+func (s tokenStore) GetStringKeyFromMap(main_key string, sub_key string) (string, error) {
+	if main_key == "auth_token:down" {
+		return "", errors.New("connection refused")
+	}
+	account, ok := s[main_key]
+	if !ok {
+		return "", errors.New("redigo: nil returned")
+	}
+	return account, nil
+}
+
+func TestPerformFilters_token(t *testing.T) {
+	tokens := tokenStore{"auth_token:valid": "42"}
+	tests := []struct {
+		name       string
+		token      string
+		wantNext   bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Valid", token: "valid", wantNext: true, wantStatus: http.StatusOK},
+		{name: "Empty", wantStatus: http.StatusForbidden, wantBody: "Token is empty\n"},
+		{name: "Unknown", token: "unknown", wantStatus: http.StatusForbidden, wantBody: "Could not validate account using the given token\n"},
+		{name: "StoreDown", token: "down", wantStatus: http.StatusForbidden, wantBody: "Could not validate account using the given token\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("X-Auth-Token", tt.token)
+			}
+			w := httptest.NewRecorder()
+			next := PerformFilters(log.NewLogfmtLogger(ioutil.Discard), tokens, []Filter{{Type: "auth", Strategy: "token"}}, w, r)
+			if next != tt.wantNext {
+				t.Errorf("PerformFilters() = %v, want %v", next, tt.wantNext)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// draining is flipped once shutdown starts so that readiness fails while
+// in-flight requests are still being served.
+var draining int32
+
+// configLoaded is set once the config has been parsed.
+var configLoaded int32
+
+var errConfigNotLoaded = errors.New("config not loaded")
+
+const defaultCheckTimeout = time.Second
+
+// CheckFunc reports whether a dependency is usable.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name     string
+	required bool
+	run      CheckFunc
+}
+
+var (
+	mu           sync.Mutex
+	checks       []check
+	checkTimeout = defaultCheckTimeout
+)
+
+// StartDraining marks the gateway as no longer ready for new traffic.
+func StartDraining() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// Draining reports whether shutdown has started.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// ConfigLoaded marks the config as loaded.
+func ConfigLoaded() {
+	atomic.StoreInt32(&configLoaded, 1)
+}
+
+// SetCheckTimeout bounds how long a single readiness check may take.
+func SetCheckTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	checkTimeout = timeout
+}
+
+// Register adds a dependency to readiness. A failing dependency only fails
+// readiness when it is required, otherwise it is just reported.
+func Register(name string, required bool, run CheckFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check{name: name, required: required, run: run})
+}
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is the body of health responses.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// LiveHandler answers liveness probes, the process is alive as long as it
+// serves them.
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, Report{Status: "ok"})
+}
+
+// ReadyHandler answers readiness probes with the overall status only, the
+// errors of the checks being kept for ReportHandler.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := Ready(r.Context())
+	writeReport(w, readyCode(report), Report{Status: report.Status})
+}
+
+// ReportHandler answers readiness probes with the state of every
+// dependency, it is meant for the admin listener.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	report := Ready(r.Context())
+	writeReport(w, readyCode(report), report)
+}
+
+func readyCode(report Report) int {
+	if report.Status != "ok" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// Ready runs every check concurrently.
+func Ready(ctx context.Context) Report {
+	mu.Lock()
+	all := append([]check{{name: "config", required: true, run: checkConfig}}, checks...)
+	timeout := checkTimeout
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]CheckResult, len(all))
+	var wg sync.WaitGroup
+	for i, c := range all {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			results[i] = CheckResult{Status: "ok", Required: c.required}
+			if err := c.run(ctx); err != nil {
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: "ok", Checks: make(map[string]CheckResult, len(all))}
+	for i, c := range all {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != "ok" && c.required {
+			report.Status = "unavailable"
+		}
+	}
+	if Draining() {
+		report.Status = "draining"
+	}
+	return report
+}
+
+func checkConfig(ctx context.Context) error {
+	if atomic.LoadInt32(&configLoaded) == 0 {
+		return errConfigNotLoaded
+	}
+	return nil
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func reset() {
+	checks = nil
+	checkTimeout = defaultCheckTimeout
+	configLoaded = 0
+	draining = 0
+}
+
+func TestReadyHandler(t *testing.T) {
+	failing := func(ctx context.Context) error { return errors.New("unreachable") }
+	passing := func(ctx context.Context) error { return nil }
+	hanging := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name       string
+		loaded     bool
+		draining   bool
+		register   func()
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:       "Ready",
+			loaded:     true,
+			register:   func() { Register("redis", true, passing) },
+			wantCode:   http.StatusOK,
+			wantStatus: "ok",
+		},
+		{
+			name:       "ConfigNotLoaded",
+			register:   func() {},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "unavailable",
+		},
+		{
+			name:       "RequiredFailing",
+			loaded:     true,
+			register:   func() { Register("redis", true, failing) },
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "unavailable",
+		},
+		{
+			name:       "OptionalFailing",
+			loaded:     true,
+			register:   func() { Register("redis", false, failing) },
+			wantCode:   http.StatusOK,
+			wantStatus: "ok",
+		},
+		{
+			name:   "RequiredTimingOut",
+			loaded: true,
+			register: func() {
+				SetCheckTimeout(10 * time.Millisecond)
+				Register("upstream:backend", true, hanging)
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "unavailable",
+		},
+		{
+			name:       "Draining",
+			loaded:     true,
+			draining:   true,
+			register:   func() { Register("redis", true, passing) },
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "draining",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			if tt.loaded {
+				ConfigLoaded()
+			}
+			if tt.draining {
+				StartDraining()
+			}
+			tt.register()
+
+			for _, handler := range []struct {
+				name        string
+				serve       http.HandlerFunc
+				wantDetails bool
+			}{
+				{name: "ReadyHandler", serve: ReadyHandler},
+				{name: "ReportHandler", serve: ReportHandler, wantDetails: true},
+			} {
+				rec := httptest.NewRecorder()
+				handler.serve(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+				if rec.Code != tt.wantCode {
+					t.Errorf("%s status code = %v, want %v", handler.name, rec.Code, tt.wantCode)
+				}
+				var report Report
+				if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+					t.Fatal(err)
+				}
+				if report.Status != tt.wantStatus {
+					t.Errorf("%s status = %v, want %v", handler.name, report.Status, tt.wantStatus)
+				}
+				if _, ok := report.Checks["config"]; ok != handler.wantDetails {
+					t.Errorf("%s checks = %v, want them reported %v", handler.name, report.Checks, handler.wantDetails)
+				}
+			}
+		})
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	reset()
+	StartDraining()
+	rec := httptest.NewRecorder()
+	LiveHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status code = %v, want %v", rec.Code, http.StatusOK)
+	}
+}
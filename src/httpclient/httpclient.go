@@ -7,17 +7,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
-	"bitbucket.org/qubole/gateway/internal/instrument"
-	"bitbucket.org/qubole/gateway/internal/logger"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/go-retryablehttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"instrument"
+	"requestid"
 )
 
-var glogger = logger.Create(os.Stdout)
-
 // Response ...
 type Response struct {
 	Body    []byte
@@ -30,10 +34,24 @@ type RetryOptions struct {
 	WaitMin    float64
 	WaitMax    float64
 	CheckRetry retryablehttp.CheckRetry
+	// Backoff defaults to retryablehttp.DefaultBackoff
+	Backoff retryablehttp.Backoff
+	// Budget, when set, caps retries across every client sharing it
+	Budget *RetryBudget
+	// Logger receives retry logs, they are dropped without one
+	Logger log.Logger
+	// Name keys the retry metrics, e.g. the route or the upstream, defaults
+	// to the host of the request. The path is not used for it is
+	// unbounded.
+	Name string
 }
 
 //Client ...
 func (ro *RetryOptions) Client() *http.Client {
+	return ro.retryableClient().StandardClient()
+}
+
+func (ro *RetryOptions) retryableClient() *retryablehttp.Client {
 
 	rc := retryablehttp.NewClient()
 
@@ -42,17 +60,30 @@ func (ro *RetryOptions) Client() *http.Client {
 	}
 
 	if ro.WaitMin > 0.0 {
-		rc.RetryWaitMin = time.Duration(ro.WaitMin) * time.Second
+		rc.RetryWaitMin = time.Duration(ro.WaitMin * float64(time.Second))
 	}
 
 	if ro.WaitMax > 0.0 {
-		rc.RetryWaitMax = time.Duration(ro.WaitMax) * time.Second
+		rc.RetryWaitMax = time.Duration(ro.WaitMax * float64(time.Second))
 	}
 
 	if ro.CheckRetry != nil {
 		rc.CheckRetry = ro.CheckRetry
 	}
 
+	if ro.Backoff != nil {
+		rc.Backoff = ro.Backoff
+	}
+
+	logger := ro.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	if ro.Budget != nil {
+		rc.CheckRetry = ro.Budget.wrap(rc.CheckRetry, logger)
+	}
+
 	// dont use default logger of retryablehttp
 	rc.Logger = nil
 
@@ -62,20 +93,35 @@ func (ro *RetryOptions) Client() *http.Client {
 		path := req.URL.Path
 		method := req.Method
 
+		if retry == 0 && ro.Budget != nil {
+			ro.Budget.deposit()
+		}
+
+		name := ro.metricName(req)
+
 		if retry > 0 {
-			instrument.Increment(strings.ReplaceAll(fmt.Sprintf("infra.gateway.%v.retried", path), "/", "."))
-			glogger.Log("retryablehttp", fmt.Sprintf("Retrying %v %v, Attempt: %v", method, path, retry))
+			instrument.Increment(fmt.Sprintf("infra.gateway.%v.retried", name))
+			level.Info(logger).Log("retryablehttp", fmt.Sprintf("Retrying %v %v, Attempt: %v", method, path, retry), "request_id", requestid.FromContext(req.Context()))
 		}
 
 		if retry == rc.RetryMax {
-			// eg: infra.gateway.tugboat.authenticate.retries.exhausted
-			metric := strings.ReplaceAll(fmt.Sprintf("infra.gateway.%v.retries.exhausted", path), "/", ".")
-			instrument.Increment(metric)
-			glogger.Log("retryablehttp", fmt.Sprintf("Retries Exhausted for %v %v", method, path))
+			// eg: infra.gateway.tugboat.retries.exhausted
+			instrument.Increment(fmt.Sprintf("infra.gateway.%v.retries.exhausted", name))
+			level.Warn(logger).Log("retryablehttp", fmt.Sprintf("Retries Exhausted for %v %v", method, path), "request_id", requestid.FromContext(req.Context()))
 		}
 	}
 
-	return rc.StandardClient()
+	return rc
+}
+
+// metricName is the Name of ro, or the host of req, as a single segment of
+// a metric name.
+func (ro *RetryOptions) metricName(req *http.Request) string {
+	name := ro.Name
+	if name == "" {
+		name = req.URL.Hostname()
+	}
+	return strings.NewReplacer(".", "_", "/", "_", ":", "_").Replace(name)
 }
 
 // Client ...
@@ -93,6 +139,13 @@ func Client(req *http.Request, ro *RetryOptions) *http.Client {
 
 // Post return (statusCode, body, error)
 func Post(ctx context.Context, url string, body interface{}, headers ...map[string]string) (*Response, int, error) {
+	return PostWithRetries(ctx, nil, url, body, headers...)
+}
+
+// PostWithRetries return (statusCode, body, error)
+// This method does a retry on failure, the receiver has to tolerate the
+// body being posted more than once.
+func PostWithRetries(ctx context.Context, ro *RetryOptions, url string, body interface{}, headers ...map[string]string) (*Response, int, error) {
 	js, err := json.Marshal(body)
 	if err != nil {
 		return nil, 0, err
@@ -103,7 +156,7 @@ func Post(ctx context.Context, url string, body interface{}, headers ...map[stri
 		return nil, 0, err
 	}
 
-	return perform(ctx, nil, req, headers...)
+	return perform(ctx, ro, req, headers...)
 }
 
 // GetWithRetries return (statusCode, body, error)
@@ -132,6 +185,8 @@ func Get(ctx context.Context, url string, query map[string]interface{}, headers
 }
 
 func perform(ctx context.Context, ro *RetryOptions, req *http.Request, headers ...map[string]string) (*Response, int, error) {
+	ctx, span := otel.Tracer("httpclient").Start(ctx, req.Method+" "+req.URL.Path, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
 	req = req.WithContext(ctx)
 
 	// Set converts key to canonicalMIMEkey X-Api-Token
@@ -142,7 +197,15 @@ func perform(ctx context.Context, ro *RetryOptions, req *http.Request, headers .
 		}
 	}
 
+	if id := requestid.FromContext(ctx); id != "" && req.Header.Get(requestid.Header) == "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	// propagate the trace to the receiving service
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
 	resp, err := Client(req, ro).Do(req)
+	endSpan(span, resp, err)
 
 	// An error is returned if caused by client policy (such as CheckRedirect),
 	// or failure to speak HTTP (such as a network connectivity problem).
@@ -167,3 +230,16 @@ func perform(ctx context.Context, ro *RetryOptions, req *http.Request, headers .
 
 	return &Response{Body: b, Headers: resp.Header}, resp.StatusCode, nil
 }
+
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
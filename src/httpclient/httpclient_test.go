@@ -456,3 +456,57 @@ func TestGetWithRetriesWithoutRetries(t *testing.T) {
 	}
 
 }
+
+func TestPostWithRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		ro         *httpclient.RetryOptions
+		successTry int
+		wantTries  int
+		wantStatus int
+	}{
+		{
+			name: "RetriesWithTheSameBody",
+			ro: &httpclient.RetryOptions{
+				Max:     3,
+				WaitMax: 0.2,
+				WaitMin: 0.1,
+			},
+			successTry: 3,
+			wantTries:  3,
+			wantStatus: 200,
+		},
+		{
+			name:       "NoRetriesWhenRetryOptionisNotProvided",
+			successTry: 3,
+			wantTries:  1,
+			wantStatus: 502,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tries := 0
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tries++
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != `{"state":"running"}` {
+					t.Errorf("try %d body = %s", tries, body)
+				}
+				if tries >= tt.successTry {
+					w.WriteHeader(200)
+				} else {
+					w.WriteHeader(502)
+				}
+			}))
+			defer testServer.Close()
+
+			_, got, _ := httpclient.PostWithRetries(context.Background(), tt.ro, testServer.URL, map[string]string{"state": "running"})
+			if got != tt.wantStatus {
+				t.Errorf("PostWithRetries() status = %v, want %v", got, tt.wantStatus)
+			}
+			if tries != tt.wantTries {
+				t.Errorf("PostWithRetries() tried %v times, want %v", tries, tt.wantTries)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"requestid"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Transport returns a RoundTripper which sends requests through base and
+// retries them according to the RetryOptions. Unlike Client it never
+// follows redirects and hands the last response back as is once retries are
+// exhausted, which is what a proxy wants.
+// When idempotentOnly is set, requests with non idempotent methods go
+// through base exactly once.
+func (ro *RetryOptions) Transport(base http.RoundTripper, idempotentOnly bool) http.RoundTripper {
+	rc := ro.retryableClient()
+	rc.HTTPClient = &http.Client{
+		Transport: base,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	rc.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	return &retryTransport{
+		base:           base,
+		retrying:       &retryablehttp.RoundTripper{Client: rc},
+		budget:         ro.Budget,
+		idempotentOnly: idempotentOnly,
+	}
+}
+
+type retryTransport struct {
+	base           http.RoundTripper
+	retrying       http.RoundTripper
+	budget         *RetryBudget
+	idempotentOnly bool
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.idempotentOnly && !isIdempotent(req.Method) {
+		if t.budget != nil {
+			t.budget.deposit()
+		}
+		return t.base.RoundTrip(req)
+	}
+
+	// server side requests carry RequestURI which http.Client refuses
+	outreq := req.WithContext(context.WithValue(req.Context(), methodKey{}, req.Method))
+	outreq.RequestURI = ""
+	return t.retrying.RoundTrip(outreq)
+}
+
+// methodKey is the context key of the method of the request being retried,
+// for StatusRetryPolicy to know whether it may be sent again.
+type methodKey struct{}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// StatusRetryPolicy retries transport errors when onConnectFailure is set,
+// and responses whose status code is one of statuses. Requests with non
+// idempotent methods, which the upstream may have acted on before a reset
+// or a timeout, are only retried when the connection could not be made.
+func StatusRetryPolicy(onConnectFailure bool, statuses []int) retryablehttp.CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		// do not retry once the client went away
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+
+		if err != nil {
+			if !onConnectFailure {
+				return false, nil
+			}
+			method, _ := ctx.Value(methodKey{}).(string)
+			return isIdempotent(method) || isConnectError(err), nil
+		}
+
+		for _, status := range statuses {
+			if resp.StatusCode == status {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// isConnectError reports whether err is a failure to connect, the request
+// not having been sent.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// JitterBackoff is exponential backoff with full jitter between min and the
+// exponential step, so that retries from many requests spread out instead
+// of hitting a struggling upstream in lock step.
+func JitterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	backoff := min << uint(attemptNum)
+	if backoff > max || backoff < min {
+		backoff = max
+	}
+	if backoff <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(backoff-min)))
+}
+
+// RetryBudget limits retries to a ratio of the requests seen over a sliding
+// window, plus a floor of MinPerSecond, to keep retries from amplifying an
+// outage into a retry storm.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu      sync.Mutex
+	buckets []budgetBucket
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewRetryBudget is constructor for RetryBudget.
+// window is rounded to whole seconds.
+func NewRetryBudget(ratio float64, minPerSecond int, window time.Duration) *RetryBudget {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		buckets:      make([]budgetBucket, seconds),
+	}
+}
+
+// bucket returns the bucket for the current second, the caller must hold mu.
+func (b *RetryBudget) bucket() *budgetBucket {
+	now := time.Now().Unix()
+	bucket := &b.buckets[now%int64(len(b.buckets))]
+	if bucket.second != now {
+		*bucket = budgetBucket{second: now}
+	}
+	return bucket
+}
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	b.bucket().requests++
+	b.mu.Unlock()
+}
+
+// withdraw reports whether a retry fits in the budget, and if so records it.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, retries, allowed := b.window()
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.bucket().retries++
+	return true
+}
+
+// Stats returns the requests and retries seen over the window and how many
+// retries it allows.
+func (b *RetryBudget) Stats() (requests, retries int, allowed float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.window()
+}
+
+// window sums the buckets of the window, the caller must hold mu.
+func (b *RetryBudget) window() (requests, retries int, allowed float64) {
+	current := b.bucket()
+	oldest := current.second - int64(len(b.buckets))
+	for _, bucket := range b.buckets {
+		if bucket.second > oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed = float64(b.minPerSecond*len(b.buckets)) + b.ratio*float64(requests)
+	return requests, retries, allowed
+}
+
+func (b *RetryBudget) wrap(check retryablehttp.CheckRetry, logger log.Logger) retryablehttp.CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		retry, checkErr := check(ctx, resp, err)
+		if retry && !b.withdraw() {
+			level.Warn(logger).Log("retryablehttp", "retry budget exhausted", "request_id", requestid.FromContext(ctx))
+			return false, checkErr
+		}
+		return retry, checkErr
+	}
+}
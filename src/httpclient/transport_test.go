@@ -0,0 +1,244 @@
+package httpclient_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/gateway/internal/httpclient"
+	"instrument"
+)
+
+func TestRetryOptions_Transport(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		budget         *httpclient.RetryBudget
+		idempotentOnly bool
+		successTry     int
+		wantStatus     int
+		wantTries      int
+	}{
+		{
+			name:       "RetriesUntilSuccess",
+			method:     http.MethodGet,
+			successTry: 2,
+			wantStatus: http.StatusOK,
+			wantTries:  2,
+		},
+		{
+			name:       "ReturnsLastResponseWhenExhausted",
+			method:     http.MethodGet,
+			successTry: 10,
+			wantStatus: http.StatusServiceUnavailable,
+			wantTries:  4, // retries + original
+		},
+		{
+			name:           "NoRetryForNonIdempotent",
+			method:         http.MethodPost,
+			idempotentOnly: true,
+			successTry:     2,
+			wantStatus:     http.StatusServiceUnavailable,
+			wantTries:      1,
+		},
+		{
+			name:           "RetryNonIdempotentWhenAllowed",
+			method:         http.MethodPost,
+			idempotentOnly: false,
+			successTry:     2,
+			wantStatus:     http.StatusOK,
+			wantTries:      2,
+		},
+		{
+			name:       "NoRetryWhenBudgetExhausted",
+			method:     http.MethodGet,
+			budget:     httpclient.NewRetryBudget(0, 0, time.Second),
+			successTry: 2,
+			wantStatus: http.StatusServiceUnavailable,
+			wantTries:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tries := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tries++
+				if tries >= tt.successTry {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			ro := &httpclient.RetryOptions{
+				Max:        3,
+				WaitMin:    0.001,
+				WaitMax:    0.01,
+				CheckRetry: httpclient.StatusRetryPolicy(true, []int{http.StatusServiceUnavailable}),
+				Backoff:    httpclient.JitterBackoff,
+				Budget:     tt.budget,
+			}
+			transport := ro.Transport(http.DefaultTransport, tt.idempotentOnly)
+
+			req := httptest.NewRequest(tt.method, server.URL, strings.NewReader("body"))
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status got = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if tries != tt.wantTries {
+				t.Errorf("Tries got = %v, want %v", tries, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestStatusRetryPolicy_ConnectFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	ro := &httpclient.RetryOptions{
+		Max:        2,
+		WaitMin:    0.001,
+		WaitMax:    0.01,
+		CheckRetry: httpclient.StatusRetryPolicy(true, nil),
+	}
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	if _, err := ro.Transport(http.DefaultTransport, true).RoundTrip(req); err == nil {
+		t.Errorf("RoundTrip() to a closed server should fail")
+	}
+}
+
+func TestStatusRetryPolicy_Timeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		wantTries int32
+	}{
+		{name: "Idempotent", method: http.MethodGet, wantTries: 3},
+		{name: "NonIdempotent", method: http.MethodPost, wantTries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries int32
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&tries, 1)
+				ioutil.ReadAll(r.Body)
+				<-release
+			}))
+			defer server.Close()
+			defer close(release)
+
+			ro := &httpclient.RetryOptions{
+				Max:        2,
+				WaitMin:    0.001,
+				WaitMax:    0.01,
+				CheckRetry: httpclient.StatusRetryPolicy(true, nil),
+			}
+			base := &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}
+			defer base.CloseIdleConnections()
+			req := httptest.NewRequest(tt.method, server.URL, strings.NewReader("body"))
+			if _, err := ro.Transport(base, false).RoundTrip(req); err == nil {
+				t.Errorf("RoundTrip() to a hung upstream should fail")
+			}
+			if got := atomic.LoadInt32(&tries); got != tt.wantTries {
+				t.Errorf("Tries got = %v, want %v", got, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestJitterBackoff(t *testing.T) {
+	min, max := 10*time.Millisecond, 100*time.Millisecond
+	for attempt := 0; attempt < 10; attempt++ {
+		got := httpclient.JitterBackoff(min, max, attempt, nil)
+		if got < min || got > max {
+			t.Errorf("JitterBackoff(%v) = %v, want between %v and %v", attempt, got, min, max)
+		}
+	}
+}
+
+func TestRetryOptions_Metrics(t *testing.T) {
+	tests := []struct {
+		name string
+		ro   httpclient.RetryOptions
+		want string
+	}{
+		{
+			name: "Named",
+			ro:   httpclient.RetryOptions{Name: "tugboat"},
+			want: "infra.gateway.tugboat",
+		},
+		{
+			name: "Host",
+			want: "infra.gateway.127_0_0_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := instrument.NewMemory()
+			instrument.SetSink(m, 1)
+			defer instrument.SetSink(instrument.NewMemory(), 1)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			ro := tt.ro
+			ro.Max, ro.WaitMin, ro.WaitMax = 2, 0.001, 0.01
+			ro.CheckRetry = httpclient.StatusRetryPolicy(false, []int{http.StatusServiceUnavailable})
+			req := httptest.NewRequest(http.MethodGet, server.URL+"/accounts/42/commands?id=7", nil)
+			resp, err := ro.Transport(http.DefaultTransport, true).RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if got := m.Counter(tt.want + ".retried"); got != 2 {
+				t.Errorf("%s.retried = %v, want 2", tt.want, got)
+			}
+			if got := m.Counter(tt.want + ".retries.exhausted"); got != 1 {
+				t.Errorf("%s.retries.exhausted = %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryBudget_Stats(t *testing.T) {
+	budget := httpclient.NewRetryBudget(0.5, 1, time.Second)
+	ro := &httpclient.RetryOptions{
+		Max:        3,
+		WaitMin:    0.001,
+		WaitMax:    0.01,
+		CheckRetry: httpclient.StatusRetryPolicy(false, []int{http.StatusServiceUnavailable}),
+		Budget:     budget,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resp, err := ro.Transport(http.DefaultTransport, true).RoundTrip(httptest.NewRequest(http.MethodGet, server.URL, nil))
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+
+	// the floor of 1 plus half of the request allows 1.5, a retry is let
+	// through while fewer were made, so two are
+	if requests, retries, allowed := budget.Stats(); requests != 1 || retries != 2 || allowed != 1.5 {
+		t.Errorf("Stats() = %v, %v, %v, want 1, 2, 1.5", requests, retries, allowed)
+	}
+}
@@ -0,0 +1,111 @@
+package instrument
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sink receives metrics. Tags are key:value pairs, sinks without tag
+// support drop them. rate is the share of events the caller samples, 1 when
+// every event is reported.
+type Sink interface {
+	Count(name string, value int64, rate float64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, value time.Duration, rate float64, tags ...string)
+	Histogram(name string, value float64, rate float64, tags ...string)
+	Close() error
+}
+
+// Settings of the metrics sink, as configured on the server.
+type Settings struct {
+	// Backend is one of none, statsd or dogstatsd.
+	Backend string `yaml:"backend"`
+	// Address of the statsd agent, eg. 127.0.0.1:8125.
+	Address string `yaml:"address"`
+	// Prefix is prepended to every metric name.
+	Prefix string `yaml:"prefix"`
+	// Tags are added to every metric.
+	Tags []string `yaml:"tags"`
+	// SampleRate applies to counters, timings and histograms.
+	SampleRate float64 `yaml:"sampleRate"`
+	// FlushInterval bounds how long metrics are buffered before being sent.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+}
+
+var (
+	mu         sync.RWMutex
+	sink       Sink = discard{}
+	sampleRate      = 1.0
+)
+
+// New returns the sink described by settings.
+func New(settings Settings) (Sink, error) {
+	switch settings.Backend {
+	case "", "none":
+		return discard{}, nil
+	case "statsd":
+		return NewStatsd(settings, false)
+	case "dogstatsd":
+		return NewStatsd(settings, true)
+	}
+	return nil, fmt.Errorf("instrument: unknown backend %q", settings.Backend)
+}
+
+// SetSink replaces the sink used by the package level functions.
+func SetSink(s Sink, rate float64) {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sink, sampleRate = s, rate
+}
+
+func current() (Sink, float64) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return sink, sampleRate
+}
+
+// Increment counter name by one.
+func Increment(name string, tags ...string) {
+	Count(name, 1, tags...)
+}
+
+// Count adds value to counter name.
+func Count(name string, value int64, tags ...string) {
+	s, rate := current()
+	s.Count(name, value, rate, tags...)
+}
+
+// Gauge sets gauge name to value.
+func Gauge(name string, value float64, tags ...string) {
+	s, _ := current()
+	s.Gauge(name, value, tags...)
+}
+
+// Timing records a duration for timer name.
+func Timing(name string, value time.Duration, tags ...string) {
+	s, rate := current()
+	s.Timing(name, value, rate, tags...)
+}
+
+// Since records the time elapsed since start for timer name.
+func Since(name string, start time.Time, tags ...string) {
+	Timing(name, time.Since(start), tags...)
+}
+
+// Histogram records value for histogram name.
+func Histogram(name string, value float64, tags ...string) {
+	s, rate := current()
+	s.Histogram(name, value, rate, tags...)
+}
+
+type discard struct{}
+
+func (discard) Count(string, int64, float64, ...string)          {}
+func (discard) Gauge(string, float64, ...string)                 {}
+func (discard) Timing(string, time.Duration, float64, ...string) {}
+func (discard) Histogram(string, float64, float64, ...string)    {}
+func (discard) Close() error                                     { return nil }
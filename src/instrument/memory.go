@@ -0,0 +1,96 @@
+package instrument
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps metrics in memory so that tests can assert on them. Metrics
+// are keyed by name followed by their sorted tags, eg.
+// gateway.requests#route:default,status:2xx.
+type Memory struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	timings    map[string][]time.Duration
+	histograms map[string][]float64
+}
+
+// NewMemory is constructor for Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]float64),
+		timings:    make(map[string][]time.Duration),
+		histograms: make(map[string][]float64),
+	}
+}
+
+func (m *Memory) Count(name string, value int64, _ float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[key(name, tags)] += value
+}
+
+func (m *Memory) Gauge(name string, value float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[key(name, tags)] = value
+}
+
+func (m *Memory) Timing(name string, value time.Duration, _ float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key(name, tags)
+	m.timings[k] = append(m.timings[k], value)
+}
+
+func (m *Memory) Histogram(name string, value float64, _ float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key(name, tags)
+	m.histograms[k] = append(m.histograms[k], value)
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Counter returns the value of a counter.
+func (m *Memory) Counter(name string, tags ...string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[key(name, tags)]
+}
+
+// GaugeValue returns the last value of a gauge.
+func (m *Memory) GaugeValue(name string, tags ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gauges[key(name, tags)]
+}
+
+// Timings returns every duration recorded for a timer.
+func (m *Memory) Timings(name string, tags ...string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Duration{}, m.timings[key(name, tags)]...)
+}
+
+// Histograms returns every value recorded for a histogram.
+func (m *Memory) Histograms(name string, tags ...string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64{}, m.histograms[key(name, tags)]...)
+}
+
+func key(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return name + "#" + strings.Join(sorted, ",")
+}
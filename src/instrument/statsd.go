@@ -0,0 +1,156 @@
+package instrument
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPacketSize keeps datagrams below the usual ethernet MTU.
+	maxPacketSize = 1432
+
+	defaultFlushInterval = time.Second
+)
+
+// Statsd sends metrics over UDP in statsd line format, with DogStatsD tags
+// when dog is set. Lines are buffered into datagrams of up to
+// maxPacketSize bytes and sent at least every FlushInterval.
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+	dog    bool
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStatsd is constructor for Statsd.
+func NewStatsd(settings Settings, dog bool) (*Statsd, error) {
+	conn, err := net.Dial("udp", settings.Address)
+	if err != nil {
+		return nil, err
+	}
+	if settings.FlushInterval <= 0 {
+		settings.FlushInterval = defaultFlushInterval
+	}
+
+	s := &Statsd{
+		conn:   conn,
+		prefix: settings.Prefix,
+		tags:   settings.Tags,
+		dog:    dog,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.loopFlush(settings.FlushInterval)
+	return s, nil
+}
+
+func (s *Statsd) Count(name string, value int64, rate float64, tags ...string) {
+	if sampled(rate) {
+		s.write(name, strconv.FormatInt(value, 10), "c", rate, tags)
+	}
+}
+
+func (s *Statsd) Gauge(name string, value float64, tags ...string) {
+	s.write(name, strconv.FormatFloat(value, 'f', -1, 64), "g", 1, tags)
+}
+
+func (s *Statsd) Timing(name string, value time.Duration, rate float64, tags ...string) {
+	if sampled(rate) {
+		ms := float64(value) / float64(time.Millisecond)
+		s.write(name, strconv.FormatFloat(ms, 'f', -1, 64), "ms", rate, tags)
+	}
+}
+
+func (s *Statsd) Histogram(name string, value float64, rate float64, tags ...string) {
+	if !sampled(rate) {
+		return
+	}
+	kind := "h"
+	if !s.dog {
+		// plain statsd has no histograms, timers aggregate the same way
+		kind = "ms"
+	}
+	s.write(name, strconv.FormatFloat(value, 'f', -1, 64), kind, rate, tags)
+}
+
+// Close flushes buffered metrics and closes the connection.
+func (s *Statsd) Close() error {
+	close(s.stop)
+	<-s.done
+	s.flush()
+	return s.conn.Close()
+}
+
+// write buffers name:value|kind|@rate|#tags.
+func (s *Statsd) write(name, value, kind string, rate float64, tags []string) {
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(name)
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(kind)
+	if rate < 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	if s.dog && len(s.tags)+len(tags) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(append(append([]string{}, s.tags...), tags...), ","))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len() > 0 && s.buf.Len()+1+line.Len() > maxPacketSize {
+		s.flushLocked()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line.String())
+}
+
+func (s *Statsd) loopFlush(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *Statsd) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked must be called with mu held. Send errors are dropped, metrics
+// are best effort.
+func (s *Statsd) flushLocked() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	_, _ = s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+}
+
+func sampled(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
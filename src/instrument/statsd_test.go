@@ -0,0 +1,85 @@
+package instrument
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	tests := []struct {
+		name  string
+		dog   bool
+		emit  func(s Sink)
+		wants []string
+	}{
+		{
+			name: "Statsd",
+			emit: func(s Sink) {
+				s.Count("requests", 2, 1, "route:default")
+				s.Timing("latency", 1500*time.Microsecond, 1)
+				s.Histogram("size", 10, 1)
+			},
+			wants: []string{"gw.requests:2|c", "gw.latency:1.5|ms", "gw.size:10|ms"},
+		},
+		{
+			name: "DogStatsd",
+			dog:  true,
+			emit: func(s Sink) {
+				s.Count("requests", 1, 1, "route:default")
+				s.Gauge("in_flight", 3)
+				s.Histogram("size", 10, 1)
+			},
+			wants: []string{"gw.requests:1|c|#env:test,route:default", "gw.in_flight:3|g|#env:test", "gw.size:10|h|#env:test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket() error = %v", err)
+			}
+			defer agent.Close()
+
+			s, err := NewStatsd(Settings{Address: agent.LocalAddr().String(), Prefix: "gw.", Tags: []string{"env:test"}, FlushInterval: time.Hour}, tt.dog)
+			if err != nil {
+				t.Fatalf("NewStatsd() error = %v", err)
+			}
+			tt.emit(s)
+			s.Close()
+
+			buf := make([]byte, maxPacketSize)
+			agent.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := agent.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom() error = %v", err)
+			}
+			got := strings.Split(string(buf[:n]), "\n")
+			if strings.Join(got, "\n") != strings.Join(tt.wants, "\n") {
+				t.Errorf("got %q, want %q", got, tt.wants)
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	SetSink(m, 1)
+	defer SetSink(discard{}, 1)
+
+	Increment("requests", "status:2xx", "route:default")
+	Count("requests", 2, "route:default", "status:2xx")
+	Gauge("in_flight", 4)
+	Timing("latency", time.Second)
+
+	if got := m.Counter("requests", "route:default", "status:2xx"); got != 3 {
+		t.Errorf("Counter() = %v, want 3", got)
+	}
+	if got := m.GaugeValue("in_flight"); got != 4 {
+		t.Errorf("GaugeValue() = %v, want 4", got)
+	}
+	if got := m.Timings("latency"); len(got) != 1 || got[0] != time.Second {
+		t.Errorf("Timings() = %v, want [1s]", got)
+	}
+}
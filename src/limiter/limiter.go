@@ -0,0 +1,204 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSaturated is returned by Acquire when no slot became free in time.
+	ErrSaturated = errors.New("concurrency limit reached")
+
+	defaultBackoffRatio  = 0.9
+	defaultQueueTimeout  = time.Second
+	defaultBackoffWindow = time.Second
+)
+
+// Settings of a concurrency limiter, as configured on a route or upstream.
+type Settings struct {
+	// Max requests in flight, also the starting limit in adaptive mode.
+	Max int `yaml:"max"`
+	// QueueSize requests may wait up to QueueTimeout for a slot, others
+	// are rejected straight away.
+	QueueSize    int           `yaml:"queueSize"`
+	QueueTimeout time.Duration `yaml:"queueTimeout"`
+	// Adaptive tunes the limit from observed latency when set.
+	Adaptive *Adaptive `yaml:"adaptive"`
+}
+
+// Adaptive settings for AIMD limit tuning: the limit grows by one while
+// requests are saturating it and finish within Latency, and shrinks by
+// BackoffRatio when a request takes longer, at most once per BackoffWindow
+// so that a burst of slow requests backs off once.
+type Adaptive struct {
+	MinLimit      int           `yaml:"minLimit"`
+	MaxLimit      int           `yaml:"maxLimit"`
+	Latency       time.Duration `yaml:"latency"`
+	BackoffRatio  float64       `yaml:"backoffRatio"`
+	BackoffWindow time.Duration `yaml:"backoffWindow"`
+}
+
+func (s *Settings) setDefaults() {
+	if s.Max <= 0 {
+		s.Max = 1
+	}
+	if s.QueueSize > 0 && s.QueueTimeout <= 0 {
+		s.QueueTimeout = defaultQueueTimeout
+	}
+	if s.Adaptive == nil {
+		return
+	}
+	if s.Adaptive.MinLimit <= 0 {
+		s.Adaptive.MinLimit = 1
+	}
+	if s.Adaptive.MaxLimit < s.Max {
+		s.Adaptive.MaxLimit = s.Max
+	}
+	if s.Adaptive.BackoffRatio <= 0 || s.Adaptive.BackoffRatio >= 1 {
+		s.Adaptive.BackoffRatio = defaultBackoffRatio
+	}
+	if s.Adaptive.BackoffWindow <= 0 {
+		s.Adaptive.BackoffWindow = defaultBackoffWindow
+	}
+}
+
+// Limiter caps the number of requests in flight.
+type Limiter struct {
+	name     string
+	settings Settings
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	waiters  *list.List
+	rejected uint64
+	// backedOff is when the adaptive limit was last decreased.
+	backedOff time.Time
+}
+
+// New is constructor for Limiter.
+func New(name string, settings Settings) *Limiter {
+	settings.setDefaults()
+	return &Limiter{
+		name:     name,
+		settings: settings,
+		limit:    settings.Max,
+		waiters:  list.New(),
+	}
+}
+
+// Name of the route or upstream the limiter guards.
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Stats returns the current limit, requests in flight and queued requests.
+func (l *Limiter) Stats() (limit, inFlight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.inFlight, l.waiters.Len()
+}
+
+// Rejected returns the number of requests turned away since start.
+func (l *Limiter) Rejected() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected
+}
+
+// Acquire a slot, waiting in the queue if there is room in it. release must
+// be called once the request is done.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	l.mu.Lock()
+	if l.inFlight < l.limit {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.releaser(time.Now()), nil
+	}
+	if l.waiters.Len() >= l.settings.QueueSize {
+		l.rejected++
+		l.mu.Unlock()
+		return nil, ErrSaturated
+	}
+	ready := make(chan struct{})
+	waiter := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.settings.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return l.releaser(time.Now()), nil
+	case <-timer.C:
+		err = ErrSaturated
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// a slot was handed over while giving up, pass it on
+		l.inFlight--
+		l.grant()
+	default:
+		l.waiters.Remove(waiter)
+	}
+	if err == ErrSaturated {
+		l.rejected++
+	}
+	return nil, err
+}
+
+func (l *Limiter) releaser(start time.Time) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(time.Since(start))
+		})
+	}
+}
+
+func (l *Limiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	saturated := l.inFlight >= l.limit
+	l.inFlight--
+	if l.settings.Adaptive != nil {
+		l.adapt(time.Now(), latency, saturated)
+	}
+	l.grant()
+}
+
+// adapt must be called with mu held.
+func (l *Limiter) adapt(now time.Time, latency time.Duration, saturated bool) {
+	adaptive := l.settings.Adaptive
+	switch {
+	case adaptive.Latency > 0 && latency > adaptive.Latency:
+		if now.Sub(l.backedOff) < adaptive.BackoffWindow {
+			return
+		}
+		l.backedOff = now
+		l.limit = int(float64(l.limit) * adaptive.BackoffRatio)
+		if l.limit < adaptive.MinLimit {
+			l.limit = adaptive.MinLimit
+		}
+	case saturated && l.limit < adaptive.MaxLimit:
+		l.limit++
+	}
+}
+
+// grant hands free slots to queued requests, it must be called with mu held.
+func (l *Limiter) grant() {
+	for l.inFlight < l.limit && l.waiters.Len() > 0 {
+		ready := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.inFlight++
+		close(ready)
+	}
+}
@@ -0,0 +1,139 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Acquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		held     int
+		wantErr  error
+	}{
+		{
+			name:     "BelowLimit",
+			settings: Settings{Max: 2},
+			held:     1,
+			wantErr:  nil,
+		},
+		{
+			name:     "SaturatedWithoutQueue",
+			settings: Settings{Max: 2},
+			held:     2,
+			wantErr:  ErrSaturated,
+		},
+		{
+			name:     "QueueTimeout",
+			settings: Settings{Max: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond},
+			held:     1,
+			wantErr:  ErrSaturated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.name, tt.settings)
+			for i := 0; i < tt.held; i++ {
+				if _, err := l.Acquire(context.Background()); err != nil {
+					t.Fatalf("Acquire() error = %v", err)
+				}
+			}
+			if _, err := l.Acquire(context.Background()); err != tt.wantErr {
+				t.Errorf("Acquire() error = %v, want %v", err, tt.wantErr)
+			}
+			wantRejected := uint64(0)
+			if tt.wantErr != nil {
+				wantRejected = 1
+			}
+			if got := l.Rejected(); got != wantRejected {
+				t.Errorf("Rejected() = %v, want %v", got, wantRejected)
+			}
+		})
+	}
+}
+
+func TestLimiter_QueueHandOver(t *testing.T) {
+	l := New("queue", Settings{Max: 1, QueueSize: 1, QueueTimeout: time.Second})
+	release, _ := l.Acquire(context.Background())
+
+	acquired := make(chan error)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		acquired <- err
+	}()
+
+	for _, _, queued := l.Stats(); queued == 0; _, _, queued = l.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background()); err != ErrSaturated {
+		t.Errorf("Acquire() with full queue error = %v, want %v", err, ErrSaturated)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("queued Acquire() error = %v", err)
+	}
+	if _, inFlight, queued := l.Stats(); inFlight != 1 || queued != 0 {
+		t.Errorf("Stats() inFlight = %v queued = %v, want 1 and 0", inFlight, queued)
+	}
+}
+
+func TestLimiter_Adaptive(t *testing.T) {
+	l := New("adaptive", Settings{Max: 10, Adaptive: &Adaptive{MinLimit: 2, MaxLimit: 20, Latency: time.Millisecond, BackoffRatio: 0.5}})
+
+	release, _ := l.Acquire(context.Background())
+	time.Sleep(5 * time.Millisecond)
+	release()
+	if limit, _, _ := l.Stats(); limit != 5 {
+		t.Errorf("limit after slow request = %v, want 5", limit)
+	}
+
+	var releases []func()
+	for i := 0; i < 5; i++ {
+		release, _ := l.Acquire(context.Background())
+		releases = append(releases, release)
+	}
+	releases[0]()
+	if limit, _, _ := l.Stats(); limit != 6 {
+		t.Errorf("limit after fast saturated request = %v, want 6", limit)
+	}
+}
+
+func TestLimiter_AdaptBackoffWindow(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		// offsets of the slow requests from start
+		slow []time.Duration
+		want int
+	}{
+		{
+			name: "Once",
+			slow: []time.Duration{0},
+			want: 8,
+		},
+		{
+			name: "BurstWithinWindow",
+			slow: []time.Duration{0, time.Millisecond, 500 * time.Millisecond, 999 * time.Millisecond},
+			want: 8,
+		},
+		{
+			name: "AcrossWindows",
+			slow: []time.Duration{0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond},
+			want: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.name, Settings{Max: 10, Adaptive: &Adaptive{Latency: time.Millisecond, BackoffRatio: 0.8, BackoffWindow: time.Second}})
+			for _, offset := range tt.slow {
+				l.adapt(start.Add(offset), time.Second, false)
+			}
+			if limit, _, _ := l.Stats(); limit != tt.want {
+				t.Errorf("limit = %v, want %v", limit, tt.want)
+			}
+		})
+	}
+}
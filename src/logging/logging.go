@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Settings configure the gateway logs.
+type Settings struct {
+	// Level is debug, info, warn, error or none, info by default.
+	Level string `yaml:"level"`
+	// Format is logfmt or json, logfmt by default.
+	Format string `yaml:"format"`
+	// Packages override Level per package, e.g. "routes: debug".
+	Packages map[string]string `yaml:"packages"`
+}
+
+// Loggers hands out the logger of every package, so that they all share one
+// output and format.
+type Loggers struct {
+	base     log.Logger
+	level    level.Option
+	packages map[string]level.Option
+}
+
+// New is constructor for Loggers writing to w.
+func New(settings Settings, w io.Writer) (*Loggers, error) {
+	var base log.Logger
+	switch strings.ToLower(settings.Format) {
+	case "", "logfmt":
+		base = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case "json":
+		base = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", settings.Format)
+	}
+
+	defaultLevel, err := parseLevel(settings.Level)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loggers{
+		base:     log.With(base, "ts", log.DefaultTimestampUTC),
+		level:    defaultLevel,
+		packages: make(map[string]level.Option),
+	}
+	for pkg, name := range settings.Packages {
+		if l.packages[pkg], err = parseLevel(name); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// For returns the logger of pkg, filtered at its level.
+func (l *Loggers) For(pkg string) log.Logger {
+	option, ok := l.packages[pkg]
+	if !ok {
+		option = l.level
+	}
+	return level.NewFilter(log.With(l.base, "pkg", pkg), option)
+}
+
+func parseLevel(name string) (level.Option, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "", "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	case "none":
+		return level.AllowNone(), nil
+	}
+	return nil, fmt.Errorf("logging: unknown level %q", name)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger.
+func NewContext(ctx context.Context, logger log.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or one discarding
+// everything if there is none.
+func FromContext(ctx context.Context) log.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(log.Logger); ok {
+		return logger
+	}
+	return log.NewNopLogger()
+}
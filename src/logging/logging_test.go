@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestLoggers_For(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  Settings
+		pkg       string
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{name: "DefaultLevel", settings: Settings{}, pkg: "routes", wantDebug: false, wantInfo: true},
+		{name: "DebugLevel", settings: Settings{Level: "debug"}, pkg: "routes", wantDebug: true, wantInfo: true},
+		{name: "PackageOverride", settings: Settings{Packages: map[string]string{"routes": "debug"}}, pkg: "routes", wantDebug: true, wantInfo: true},
+		{name: "OtherPackage", settings: Settings{Packages: map[string]string{"routes": "debug"}}, pkg: "filters", wantDebug: false, wantInfo: true},
+		{name: "Silenced", settings: Settings{Packages: map[string]string{"routes": "error"}}, pkg: "routes", wantDebug: false, wantInfo: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			loggers, err := New(tt.settings, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger := loggers.For(tt.pkg)
+			level.Debug(logger).Log("msg", "debug line")
+			level.Info(logger).Log("msg", "info line")
+
+			if got := strings.Contains(out.String(), "debug line"); got != tt.wantDebug {
+				t.Errorf("debug logged = %v, want %v", got, tt.wantDebug)
+			}
+			if got := strings.Contains(out.String(), "info line"); got != tt.wantInfo {
+				t.Errorf("info logged = %v, want %v", got, tt.wantInfo)
+			}
+			if tt.wantInfo && !strings.Contains(out.String(), "pkg="+tt.pkg) {
+				t.Errorf("output %q lacks pkg=%s", out.String(), tt.pkg)
+			}
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+	}{
+		{name: "Level", settings: Settings{Level: "loud"}},
+		{name: "PackageLevel", settings: Settings{Packages: map[string]string{"routes": "loud"}}},
+		{name: "Format", settings: Settings{Format: "xml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.settings, &bytes.Buffer{}); err == nil {
+				t.Errorf("New() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) == nil {
+		t.Fatal("FromContext() without logger = nil, want nop logger")
+	}
+	var out bytes.Buffer
+	loggers, _ := New(Settings{Format: "json"}, &out)
+	ctx := NewContext(context.Background(), loggers.For("filters"))
+	level.Info(FromContext(ctx)).Log("msg", "from context")
+	if !strings.Contains(out.String(), `"msg":"from context"`) {
+		t.Errorf("output %q, want the json line", out.String())
+	}
+}
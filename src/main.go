@@ -1,36 +1,222 @@
 package main
 
 import (
-	"fmt"
+	"admin"
+	"context"
+	"errors"
+	"health"
+	"instrument"
 	"io/ioutil"
-	"log"
+	"logging"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"redis_local"
 	"routes"
+	"syscall"
+	"time"
+	"tracing"
 	"types"
+	"worker"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/qubole/edith/pkg/apps/edith"
+	"golang.org/x/net/netutil"
 )
 
-func start_server(port string, configuredRoutes []types.RouteConfig, upstreamsMap map[string]types.Upstream) {
+func start_server(config *types.ServerConfig, upstreamsMap map[string]types.Upstream, loggers *logging.Loggers) {
+	logger := loggers.For("main")
 	mux := http.NewServeMux()
-	for _, route := range configuredRoutes {
+	mux.HandleFunc("/healthz", health.LiveHandler)
+	mux.HandleFunc("/readyz", health.ReadyHandler)
+	sink, err := instrument.New(config.Instrument)
+	if err != nil {
+		fatal(logger, err)
+	}
+	instrument.SetSink(sink, config.Instrument.SampleRate)
+	defer sink.Close()
+
+	shutdownTracing, err := tracing.Init(config.Tracing)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	tokens := redis_local.New(redis_local.DefaultAddress, loggers.For("redis_local"))
+	shared, err := routes.NewShared(config, loggers, tokens)
+	if err != nil {
+		fatal(logger, err)
+	}
+	register_health_checks(config, shared, tokens)
+	for _, route := range config.Routes {
 		upstream := upstreamsMap[route.ForwardUpstream]
-		mux.HandleFunc(route.Location, routes.HandlersFactory(route.Location, route.BeforeFilters, route.AfterFilters, upstream))
+		mux.HandleFunc(route.Location, routes.HandlersFactory(route, upstream, shared))
+	}
+
+	workers := start_workers(config, loggers)
+	var dlq admin.DeadLetters
+	var history admin.CommandHistory
+	if workers != nil {
+		dlq = workers.manager
+		history = workers.manager
+	}
+	adminServer, err := admin.NewServer(config, shared, dlq, history, loggers.For("admin"))
+	if err != nil {
+		fatal(logger, err)
+	}
+	if adminServer != nil {
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal(logger, err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:              ":" + config.Port,
+		Handler:           mux,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal(logger, err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		wait_for_signal(logger)
+		shutdown(server, workers, config, logger)
+		if adminServer != nil {
+			adminServer.Close()
+		}
+	}()
+
+	if err := server.Serve(netutil.LimitListener(listener, config.MaxConnections)); err != http.ErrServerClosed {
+		fatal(logger, err)
+	}
+	<-stopped
+}
+
+// register_health_checks makes readiness depend on redis and on every
+// upstream a route forwards to having a reachable host, unless configured
+// as optional.
+func register_health_checks(config *types.ServerConfig, shared *routes.Shared, tokens *redis_local.Client) {
+	health.SetCheckTimeout(config.Health.CheckTimeout)
+	health.Register("redis", config.Health.Required("redis"), tokens.Ping)
+	for _, upstream := range config.Upstreams {
+		upstream := upstream
+		name := "upstream:" + upstream.Name
+		required := config.Health.Required(name) && config.Routed(upstream.Name)
+		health.Register(name, required, func(ctx context.Context) error {
+			return shared.CheckUpstream(ctx, upstream)
+		})
+	}
+}
+
+func wait_for_signal(logger log.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	level.Info(logger).Log("msg", "received signal", "signal", <-signals)
+}
+
+// shutdown fails readiness, waits for load balancers to notice and then
+// drains in-flight requests and worker queues until config.ShutdownTimeout
+// expires.
+func shutdown(server *http.Server, workers *workers, config *types.ServerConfig, logger log.Logger) {
+	health.StartDraining()
+	level.Info(logger).Log("msg", "draining", "delay", config.DrainDelay)
+	time.Sleep(config.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	// stopped even when requests outlived the timeout, for the buffered
+	// commands to be flushed
+	if workers != nil {
+		err = errors.Join(err, workers.stop(ctx))
+	}
+	if err != nil {
+		level.Warn(logger).Log("msg", "shutdown did not complete", "err", err)
+		return
 	}
-	log.Fatal(http.ListenAndServe(":"+port, mux))
+	level.Info(logger).Log("msg", "shutdown complete")
+}
+
+// workers process the redis command queues alongside the HTTP server.
+type workers struct {
+	manager    *worker.Manager
+	supervisor *worker.Supervisor
+}
+
+// start_workers boots the command queue workers under a supervisor, nil
+// when no redis servers are configured.
+func start_workers(config *types.ServerConfig, loggers *logging.Loggers) *workers {
+	if len(config.Workers.Servers) == 0 {
+		return nil
+	}
+	logger := loggers.For("worker")
+	manager := worker.NewManager(config.Workers.Servers, &edith.Codec{},
+		worker.BaseLogger(logger),
+		worker.CmdQueue(config.Workers.Queue),
+		worker.CmdQueueTimeout(int64(config.Workers.PopTimeout/time.Second)),
+		worker.Concurrency(config.Workers.Concurrency),
+		worker.MaxInFlight(config.Workers.MaxInFlight),
+		worker.TypeLimits(config.Workers.TypeLimits),
+		worker.VisibilityTimeout(config.Workers.VisibilityTimeout),
+		worker.BufferSize(config.Workers.BufferSize),
+		worker.PushTimeout(config.Workers.PushTimeout),
+		worker.SpillToRedis(config.Workers.SpillToRedis),
+		worker.Journal(config.Workers.JournalDir),
+		worker.CallbackRetries(config.Workers.Callbacks.Retries, config.Workers.Callbacks.WaitMin, config.Workers.Callbacks.WaitMax),
+		worker.CallbackSecret(config.Workers.Callbacks.SigningSecret()),
+	)
+	supervisor := worker.NewSupervisor(logger)
+	supervisor.Start(manager.Runnables()...)
+	return &workers{manager: manager, supervisor: supervisor}
+}
+
+// stop flushes the commands buffered for redis, then stops every worker
+// whether or not they were all flushed.
+func (w *workers) stop(ctx context.Context) error {
+	err := w.manager.Drain(ctx)
+	return errors.Join(err, w.supervisor.Stop(ctx))
+}
+
+// fatal logs err and exits, like log.Fatal.
+func fatal(logger log.Logger, err error) {
+	level.Error(logger).Log("msg", "fatal", "err", err)
+	os.Exit(1)
 }
 
 func main() {
+	// until the config is loaded
+	logger := log.NewLogfmtLogger(os.Stderr)
 	data, err := ioutil.ReadFile("config.yaml")
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
 	config := &types.ServerConfig{}
 	if err := config.Parse(data); err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
+	}
+	loggers, err := logging.New(config.Logging, os.Stdout)
+	if err != nil {
+		fatal(logger, err)
 	}
-	fmt.Printf("%+v", config)
+	// the config is served by the admin API, printing it would leak the
+	// admin token
+	level.Info(loggers.For("main")).Log("msg", "loaded config", "checksum", config.Checksum())
+	health.ConfigLoaded()
 	upstreamsMap := make(map[string]types.Upstream)
 	for _, upstream := range config.Upstreams {
 		upstreamsMap[upstream.Name] = upstream
 	}
-	start_server(config.Port, config.Routes, upstreamsMap)
+	start_server(config, upstreamsMap, loggers)
 }
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_requests_total",
+		Help: "Requests served per route, method, status class and upstream.",
+	}, []string{"route", "method", "status_class", "upstream"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_request_duration_seconds",
+		Help:    "Time to serve requests per route, method, status class and upstream.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status_class", "upstream"})
+
+	RequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_requests_in_flight",
+		Help: "Requests being served per route.",
+	}, []string{"route"})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_auth_failures_total",
+		Help: "Requests rejected by auth filters per strategy.",
+	}, []string{"strategy"})
+
+	Throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_throttled_requests_total",
+		Help: "Requests rejected by throttle filters per strategy.",
+	}, []string{"strategy"})
+
+	// UpstreamHostUp is 1 while the last request proxied to the host
+	// succeeded and 0 after it failed.
+	UpstreamHostUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_upstream_host_up",
+		Help: "Whether the last request proxied to the upstream host succeeded.",
+	}, []string{"upstream", "host"})
+
+	// CircuitState is 0 while closed, 1 while half-open and 2 while open.
+	CircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_upstream_circuit_state",
+		Help: "Circuit breaker state per upstream: 0 closed, 1 half-open, 2 open.",
+	}, []string{"upstream", "host"})
+
+	CircuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_circuit_transitions_total",
+		Help: "Circuit breaker state transitions per upstream.",
+	}, []string{"upstream", "host", "from", "to"})
+
+	ConcurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_concurrency_limit",
+		Help: "Current concurrency limit per route or upstream.",
+	}, []string{"limiter"})
+
+	ConcurrencyRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_concurrency_rejected_total",
+		Help: "Requests rejected because a concurrency limit was saturated.",
+	}, []string{"limiter"})
+
+	WorkerBufferDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_worker_buffer_depth",
+		Help: "Commands buffered for redis per worker queue.",
+	}, []string{"queue"})
+
+	WorkerBufferCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_worker_buffer_capacity",
+		Help: "Size of the command buffer per worker queue.",
+	}, []string{"queue"})
+
+	// WorkerPushes result is buffered, spilled to redis directly or
+	// rejected because the buffer stayed full.
+	WorkerPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_worker_pushes_total",
+		Help: "Commands pushed per worker queue and result.",
+	}, []string{"queue", "result"})
+
+	// WorkerPushFallbacks fallback is failover to another worker redis,
+	// journal to disk, or dropped.
+	WorkerPushFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_worker_push_fallbacks_total",
+		Help: "Commands their worker redis did not take per queue and fallback.",
+	}, []string{"queue", "fallback"})
+
+	// WorkerCallbacks result is delivered, outboxed after failing,
+	// redelivered from the outbox, expired in it, or failed without it.
+	WorkerCallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_worker_callbacks_total",
+		Help: "Command state callbacks per worker queue and result.",
+	}, []string{"queue", "result"})
+)
+
+// StatusClass of an http status code, eg. 2xx.
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import "testing"
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{status: 200, want: "2xx"},
+		{status: 204, want: "2xx"},
+		{status: 302, want: "3xx"},
+		{status: 404, want: "4xx"},
+		{status: 503, want: "5xx"},
+		{status: 0, want: "unknown"},
+		{status: 600, want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := StatusClass(tt.status); got != tt.want {
+			t.Errorf("StatusClass(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
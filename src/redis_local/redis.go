@@ -1,26 +1,35 @@
 package redis_local
 
 import (
+	"context"
+	"sync"
+	"time"
 
-	// Import the redigo/redis package.
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/gomodule/redigo/redis"
-	"fmt"
 )
 
-var redis_conn redis.Conn;
+// DefaultAddress of the redis server holding auth tokens.
+const DefaultAddress = "redis:6379"
 
-func init() {
-	redis_conn, _ = redis.Dial("tcp", "redis:6379")
+// Client reads auth tokens from redis over a connection it reuses.
+type Client struct {
+	address string
+	logger  log.Logger
+
+	mu   sync.Mutex
+	conn redis.Conn
+}
+
+// New is constructor for Client, it connects on first use.
+func New(address string, logger log.Logger) *Client {
+	return &Client{address: address, logger: logger}
 }
-func GetStringKeyFromMap(main_key string, sub_key string) string{
-	// Establish a connection to the Redis server listening on port
-	// 6379 of the local machine. 6379 is the default port, so unless
-	// you've already changed the Redis configuration file this should
-	// work.
-	// Importantly, use defer to ensure the connection is always
-	// properly closed before exiting the main() function.
-	
 
+// GetStringKeyFromMap returns the field sub_key of the hash main_key, a
+// missing field is reported as redis.ErrNil.
+func (c *Client) GetStringKeyFromMap(main_key string, sub_key string) (string, error) {
 	// Send our command across the connection. The first parameter to
 	// Do() is always the name of the Redis command (in this example
 	// HMSET), optionally followed by any necessary arguments (in this
@@ -29,16 +38,44 @@ func GetStringKeyFromMap(main_key string, sub_key string) string{
 	// if err != nil {
 	// 	log.Fatal(err)
 	// }
-	if redis_conn == nil {
-		redis_conn, _ = redis.Dial("tcp", "redis:6379")
-		fmt.Println("CREATED")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := redis.Dial("tcp", c.address)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "connection failed", "address", c.address, "err", err)
+			return "", err
+		}
+		c.conn = conn
+		level.Debug(c.logger).Log("msg", "connection created")
 	} else {
-		fmt.Println("REUSED")
+		level.Debug(c.logger).Log("msg", "connection reused")
+	}
+	val, err := redis.String(c.conn.Do("HGET", main_key, sub_key))
+	if err != nil {
+		// a broken connection is dialed again on next use
+		if c.conn.Err() != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		return "", err
+	}
+	return val, nil
+}
+
+// Ping checks that redis answers on a fresh connection, within the deadline
+// of ctx if it has one.
+func (c *Client) Ping(ctx context.Context) error {
+	timeout := time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
 	}
-	//redis_conn, _ = redis.Dial("tcp", "127.0.0.1:6379")
-	val, err := redis.String(redis_conn.Do("HGET", main_key, sub_key))
+	conn, err := redis.Dial("tcp", c.address, redis.DialConnectTimeout(timeout),
+		redis.DialReadTimeout(timeout), redis.DialWriteTimeout(timeout))
 	if err != nil {
-		return "ERROR fetching data"
+		return err
 	}
-	return val
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
 }
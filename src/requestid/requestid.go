@@ -0,0 +1,74 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// Header carries the request ID between clients, the gateway and upstreams.
+const Header = "X-Request-Id"
+
+// maxLength caps incoming IDs so a client cannot bloat every log line.
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a random (version 4) UUID.
+func New() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Handler accepts the caller's request ID, or generates one, and makes it
+// available to next through the request context and header. Keeping it in
+// the request header forwards it upstream; it is also echoed to the client.
+func Handler(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+		r.Header.Set(Header, id)
+		w.Header().Set(Header, id)
+		next(w, r.WithContext(NewContext(r.Context(), id)))
+	}
+}
+
+// valid reports whether id is safe to log and forward as is.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// StripResponse removes the request ID of an upstream response, for the one
+// Handler echoes to the client not to be sent twice. It is meant for
+// httputil.ReverseProxy.ModifyResponse.
+func StripResponse(resp *http.Response) error {
+	resp.Header.Del(Header)
+	return nil
+}
@@ -0,0 +1,65 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "Accepted", incoming: "abc-123", keep: true},
+		{name: "Missing", incoming: ""},
+		{name: "TooLong", incoming: strings.Repeat("a", maxLength+1)},
+		{name: "ControlCharacters", incoming: "abc\x00def"},
+		{name: "Spaces", incoming: "abc def"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext, fromHeader string
+			handler := Handler(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = FromContext(r.Context())
+				fromHeader = r.Header.Get(Header)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(Header, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if tt.keep && fromContext != tt.incoming {
+				t.Errorf("FromContext() = %q, want %q", fromContext, tt.incoming)
+			}
+			if !tt.keep && !uuidPattern.MatchString(fromContext) {
+				t.Errorf("FromContext() = %q, want a generated UUID", fromContext)
+			}
+			if fromHeader != fromContext {
+				t.Errorf("forwarded header = %q, want %q", fromHeader, fromContext)
+			}
+			if got := rec.Header().Get(Header); got != fromContext {
+				t.Errorf("response header = %q, want %q", got, fromContext)
+			}
+		})
+	}
+}
+
+func TestNewIsUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := New()
+		if seen[id] {
+			t.Fatalf("New() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
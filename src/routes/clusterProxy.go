@@ -2,14 +2,21 @@ package routes
 
 import (
 	"filters"
+	"filters/auth"
 	"fmt"
-	"log"
 	"net/http"
+	"requestid"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
 type ClusterProxy struct {
 	beforeFilters []filters.Filter
 	afterFilters  []filters.Filter
+	logger        log.Logger
+	filterLogger  log.Logger
+	tokens        auth.TokenStore
 }
 
 func (route ClusterProxy) Print() string {
@@ -22,9 +29,11 @@ func (route ClusterProxy) RouteNext(w http.ResponseWriter, r *http.Request) {
 
 func (route ClusterProxy) HandlerMethod() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Req: %s %s\n", r.Host, r.URL.Path)
-		filters.PerformFilters(route.beforeFilters, w, r)
+		level.Debug(route.logger).Log("msg", "request", "host", r.Host, "path", r.URL.Path, "request_id", requestid.FromContext(r.Context()))
+		if !filters.PerformFilters(route.filterLogger, route.tokens, route.beforeFilters, w, r) {
+			return
+		}
 		route.RouteNext(w, r)
-		filters.PerformFilters(route.afterFilters, w, r)
+		filters.PerformFilters(route.filterLogger, route.tokens, route.afterFilters, w, r)
 	}
 }
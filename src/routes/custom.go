@@ -2,10 +2,14 @@ package routes
 
 import (
 	"filters"
+	"filters/auth"
 	"fmt"
-	"log"
 	"net/http"
+	"requestid"
 	"types"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
 type CustomRoute struct {
@@ -13,6 +17,10 @@ type CustomRoute struct {
 	beforeFilters []filters.Filter
 	afterFilters  []filters.Filter
 	upstream      types.Upstream
+	proxy         http.Handler
+	logger        log.Logger
+	filterLogger  log.Logger
+	tokens        auth.TokenStore
 }
 
 func (route CustomRoute) Print() string {
@@ -20,6 +28,10 @@ func (route CustomRoute) Print() string {
 }
 
 func (route CustomRoute) RouteNext(w http.ResponseWriter, r *http.Request) {
+	if len(route.upstream.Hosts) > 0 {
+		route.proxy.ServeHTTP(w, r)
+		return
+	}
 	fmt.Fprintln(w, "Reached next route of Custom route:", route.route)
 	fmt.Fprintln(w, "Fowarding to one of", len(route.upstream.Hosts), " upstreams among:")
 	for i, host := range route.upstream.Hosts {
@@ -31,9 +43,11 @@ func (route CustomRoute) RouteNext(w http.ResponseWriter, r *http.Request) {
 
 func (route CustomRoute) HandlerMethod() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Req: %s %s\n", r.Host, r.URL.Path)
-		filters.PerformFilters(route.beforeFilters, w, r)
+		level.Debug(route.logger).Log("msg", "request", "host", r.Host, "path", r.URL.Path, "request_id", requestid.FromContext(r.Context()))
+		if !filters.PerformFilters(route.filterLogger, route.tokens, route.beforeFilters, w, r) {
+			return
+		}
 		route.RouteNext(w, r)
-		filters.PerformFilters(route.afterFilters, w, r)
+		filters.PerformFilters(route.filterLogger, route.tokens, route.afterFilters, w, r)
 	}
 }
@@ -1,11 +1,117 @@
 package routes
 
 import (
-	"filters"
+	"instrument"
+	"limiter"
+	"metrics"
 	"net/http"
+	"requestid"
+	"time"
+	"tracing"
 	"types"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func HandlersFactory(name string, beforeFilters []filters.Filter, afterFilters []filters.Filter, upstream types.Upstream) func(w http.ResponseWriter, r *http.Request) {
-	return RoutesFactory(name, beforeFilters, afterFilters, upstream).HandlerMethod()
+func HandlersFactory(route types.RouteConfig, upstream types.Upstream, shared *Shared) func(w http.ResponseWriter, r *http.Request) {
+	proxy := newUpstreamProxy(route, upstream, shared)
+	handler := RoutesFactory(route.Location, route.BeforeFilters, route.AfterFilters, upstream, proxy, shared.loggers, shared.tokens).HandlerMethod()
+	if l, ok := shared.limiters["route:"+route.Name]; ok {
+		handler = limitConcurrency(l, handler)
+	}
+	handler = limitRequestBody(route.MaxRequestBodyBytes, handler)
+	handler = instrumentRequests(route, handler)
+	handler = shared.accessLog.Handler(route.Name, route.AccessLog, handler)
+	handler = traceRequests(route, handler)
+	return requestid.Handler(handler)
+}
+
+// traceRequests starts a server span per request, continuing the trace of
+// the caller if any.
+func traceRequests(route types.RouteConfig, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, "route "+route.Name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route.Location),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("request.id", requestid.FromContext(r.Context())),
+			))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	}
+}
+
+// instrumentRequests records request count, latency and requests in flight.
+func instrumentRequests(route types.RouteConfig, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	upstream := route.ForwardUpstream
+	if upstream == "" {
+		upstream = "none"
+	}
+	inFlight := metrics.RequestsInFlight.WithLabelValues(route.Name)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		statusClass := metrics.StatusClass(recorder.status)
+		labels := []string{route.Name, r.Method, statusClass, upstream}
+		metrics.Requests.WithLabelValues(labels...).Inc()
+		metrics.RequestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+		tags := []string{"route:" + route.Name, "method:" + r.Method, "status_class:" + statusClass, "upstream:" + upstream}
+		instrument.Increment("gateway.requests", tags...)
+		instrument.Since("gateway.request.duration", start, tags...)
+	}
+}
+
+// limitRequestBody rejects bodies larger than limit with 413. Requests
+// without a Content-Length are cut off by http.MaxBytesReader once they
+// cross the limit.
+func limitRequestBody(limit int64, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limit > 0 {
+			if r.ContentLength > limit {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// limitConcurrency rejects requests with 503 once l is saturated and its
+// queue is full or the wait timed out.
+func limitConcurrency(l *limiter.Limiter, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, err := l.Acquire(r.Context())
+		if err != nil {
+			metrics.ConcurrencyRejected.WithLabelValues(l.Name()).Inc()
+			http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() {
+			release()
+			limit, _, _ := l.Stats()
+			metrics.ConcurrencyLimit.WithLabelValues(l.Name()).Set(float64(limit))
+		}()
+		next(w, r)
+	}
 }
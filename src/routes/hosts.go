@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+	"types"
+)
+
+// HostStatus is the health of an upstream host as seen by proxied requests.
+type HostStatus struct {
+	Host string `json:"host"`
+	// Health is up or down after the last proxied request, unknown before
+	// the first one.
+	Health      string     `json:"health"`
+	LastChecked *time.Time `json:"lastChecked,omitempty"`
+	Circuit     string     `json:"circuit,omitempty"`
+}
+
+type hostState struct {
+	up      bool
+	checked time.Time
+}
+
+// hostHealth keeps the outcome of the last request proxied to each host.
+type hostHealth struct {
+	mu    sync.Mutex
+	hosts map[string]hostState
+}
+
+func (h *hostHealth) record(upstream, host string, up bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hosts[upstream+"/"+host] = hostState{up: up, checked: time.Now()}
+}
+
+func (h *hostHealth) get(upstream, host string) (hostState, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.hosts[upstream+"/"+host]
+	return state, ok
+}
+
+// hostTarget returns the URL requests to host are proxied to.
+func hostTarget(host types.UpstreamHost) (*url.URL, error) {
+	target, err := url.Parse(host.Url)
+	if err != nil {
+		return nil, err
+	}
+	target.Host = fmt.Sprintf("%s:%d", target.Hostname(), host.Port)
+	return target, nil
+}
@@ -0,0 +1,204 @@
+package routes
+
+import (
+	"accesslog"
+	"breaker"
+	"capture"
+	"context"
+	"errors"
+	"httpclient"
+	"instrument"
+	"metrics"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"requestid"
+	"sync/atomic"
+	"time"
+	"tracing"
+	"types"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type targetKey struct{}
+
+// upstreamProxy forwards requests to the hosts of an upstream in round
+// robin order, skipping hosts whose circuit is open.
+type upstreamProxy struct {
+	upstream string
+	logger   log.Logger
+	hosts    *hostHealth
+	targets  []*url.URL
+	// breakers[i] guards targets[i], entries are nil without a circuit
+	// breaker and all the same breaker when it is per upstream.
+	breakers []*breaker.Breaker
+	next     uint64
+	proxy    *httputil.ReverseProxy
+}
+
+// newUpstreamProxy returns the proxy for route, behind the concurrency limit
+// of the upstream if it has one.
+func newUpstreamProxy(route types.RouteConfig, upstream types.Upstream, shared *Shared) http.Handler {
+	p := &upstreamProxy{upstream: upstream.Name, logger: shared.logger, hosts: shared.hosts}
+	for _, host := range upstream.Hosts {
+		target, err := hostTarget(host)
+		if err != nil {
+			level.Warn(shared.logger).Log("msg", "skipping invalid host", "host", host.Url, "upstream", upstream.Name, "err", err)
+			continue
+		}
+		p.targets = append(p.targets, target)
+
+		var b *breaker.Breaker
+		if upstream.CircuitBreaker != nil {
+			b = shared.breakers.Get(upstream.Name, target.Host, *upstream.CircuitBreaker)
+			metrics.CircuitState.WithLabelValues(b.Upstream(), b.Host()).Set(float64(b.State()))
+		}
+		p.breakers = append(p.breakers, b)
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		Director:     p.direct,
+		Transport:    upstreamTransport(route, shared),
+		ErrorHandler: p.handleError,
+		// the request ID is set already, whether the upstream echoes it or not
+		ModifyResponse: requestid.StripResponse,
+	}
+	if l, ok := shared.limiters["upstream:"+upstream.Name]; ok {
+		return http.HandlerFunc(limitConcurrency(l, p.ServeHTTP))
+	}
+	return p
+}
+
+func (p *upstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(p.targets) == 0 {
+		http.Error(w, "No upstream hosts configured", http.StatusBadGateway)
+		return
+	}
+
+	target, done, err := p.pick()
+	if err != nil {
+		http.Error(w, "Upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, span := tracing.Start(r.Context(), "upstream "+p.upstream,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("net.peer.name", target.Host)))
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	// deferred for the outcome to be recorded when the proxy panics with
+	// http.ErrAbortHandler as well
+	defer func() {
+		latency := time.Since(start)
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		span.End()
+		accesslog.FromContext(r.Context()).SetUpstream(target.Host, latency)
+		instrument.Timing("gateway.upstream.duration", latency, "upstream:"+p.upstream, "host:"+target.Host, "status_class:"+metrics.StatusClass(recorder.status))
+		p.record(r, target, done, recorder.status)
+	}()
+	p.proxy.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, targetKey{}, target)))
+}
+
+// record the outcome of a request proxied to target with the health of the
+// host and its circuit.
+func (p *upstreamProxy) record(r *http.Request, target *url.URL, done func(success bool), status int) {
+	// a client going away says nothing about the upstream, a half-open
+	// circuit gives up on the probe after its OpenTimeout
+	if r.Context().Err() != nil {
+		return
+	}
+	success := status < http.StatusInternalServerError
+	if done != nil {
+		done(success)
+	}
+	up := 0.0
+	if success {
+		up = 1
+	}
+	metrics.UpstreamHostUp.WithLabelValues(p.upstream, target.Host).Set(up)
+	p.hosts.record(p.upstream, target.Host, success)
+}
+
+// pick returns the next target in round robin order whose circuit lets the
+// request through.
+func (p *upstreamProxy) pick() (*url.URL, func(success bool), error) {
+	start := atomic.AddUint64(&p.next, 1)
+	for i := range p.targets {
+		index := (start + uint64(i)) % uint64(len(p.targets))
+		if p.breakers[index] == nil {
+			return p.targets[index], nil, nil
+		}
+		if done, err := p.breakers[index].Allow(); err == nil {
+			return p.targets[index], done, nil
+		}
+	}
+	return nil, nil, breaker.ErrOpen
+}
+
+func (p *upstreamProxy) direct(r *http.Request) {
+	target := r.Context().Value(targetKey{}).(*url.URL)
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	tracing.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		r.Header.Set("User-Agent", "")
+	}
+}
+
+func upstreamTransport(route types.RouteConfig, shared *Shared) http.RoundTripper {
+	transport := retryTransport(route, shared.retryBudget, shared.loggers.For("httpclient"))
+	if route.DebugCapture != nil {
+		// outside of retries, so that a request is captured once
+		transport = capture.Transport(route.Name, *route.DebugCapture, shared.captures, transport)
+	}
+	return transport
+}
+
+func retryTransport(route types.RouteConfig, budget *httpclient.RetryBudget, logger log.Logger) http.RoundTripper {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   route.Timeouts.Connect,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: route.Timeouts.Response,
+		IdleConnTimeout:       route.Timeouts.Idle,
+		MaxIdleConnsPerHost:   100,
+	}
+	if route.Retry == nil || route.Retry.Max <= 0 {
+		return transport
+	}
+
+	ro := &httpclient.RetryOptions{
+		Max:        route.Retry.Max,
+		WaitMin:    route.Retry.WaitMin.Seconds(),
+		WaitMax:    route.Retry.WaitMax.Seconds(),
+		CheckRetry: httpclient.StatusRetryPolicy(route.Retry.OnConnectFailure, route.Retry.OnStatus),
+		Backoff:    httpclient.JitterBackoff,
+		Budget:     budget,
+		Logger:     logger,
+		Name:       route.Name,
+	}
+	return ro.Transport(transport, !route.Retry.NonIdempotent)
+}
+
+func (p *upstreamProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	level.Error(p.logger).Log("msg", "proxy error", "upstream", p.upstream, "method", r.Method, "path", r.URL.Path, "err", err, "request_id", requestid.FromContext(r.Context()))
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -2,21 +2,26 @@ package routes
 
 import (
 	"filters"
-	"log"
+	"filters/auth"
+	"logging"
+	"net/http"
 	"types"
+
+	"github.com/go-kit/kit/log/level"
 )
 
-func RoutesFactory(name string, beforeFilters []filters.Filter, afterFilters []filters.Filter, upstream types.Upstream) types.RoutesInterface {
-	log.Println("Name is", name)
+func RoutesFactory(name string, beforeFilters []filters.Filter, afterFilters []filters.Filter, upstream types.Upstream, proxy http.Handler, loggers *logging.Loggers, tokens auth.TokenStore) types.RoutesInterface {
+	logger, filterLogger := loggers.For("routes"), loggers.For("filters")
+	level.Debug(logger).Log("msg", "creating route", "name", name)
 	switch name {
 	case "/cluster-proxy":
-		log.Println("return CP object with", beforeFilters, afterFilters)
-		return &ClusterProxy{beforeFilters, afterFilters}
+		level.Debug(logger).Log("msg", "return CP object", "beforeFilters", len(beforeFilters), "afterFilters", len(afterFilters))
+		return &ClusterProxy{beforeFilters, afterFilters, logger, filterLogger, tokens}
 	case "/":
-		log.Println("return tugboat", beforeFilters, afterFilters)
-		return &Tugboat{beforeFilters, afterFilters}
+		level.Debug(logger).Log("msg", "return tugboat", "beforeFilters", len(beforeFilters), "afterFilters", len(afterFilters))
+		return &Tugboat{beforeFilters, afterFilters, logger, filterLogger, tokens}
 	default:
-		log.Println("return Custom object with: ", name, upstream)
-		return &CustomRoute{name, beforeFilters, afterFilters, upstream}
+		level.Debug(logger).Log("msg", "return Custom object", "name", name, "upstream", upstream.Name)
+		return &CustomRoute{name, beforeFilters, afterFilters, upstream, proxy, logger, filterLogger, tokens}
 	}
 }
@@ -0,0 +1,476 @@
+package routes
+
+import (
+	"breaker"
+	"context"
+	"filters"
+	"io/ioutil"
+	"logging"
+	"metrics"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"requestid"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"types"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testShared returns the Shared state of config, logging nothing.
+func testShared(t *testing.T, config *types.ServerConfig) *Shared {
+	t.Helper()
+	loggers, err := logging.New(logging.Settings{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := NewShared(config, loggers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shared
+}
+
+// testUpstream returns an upstream named name proxying to servers.
+func testUpstream(t *testing.T, name string, servers ...*httptest.Server) types.Upstream {
+	t.Helper()
+	upstream := types.Upstream{Name: name}
+	for _, server := range servers {
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.ParseInt(u.Port(), 10, 64)
+		upstream.Hosts = append(upstream.Hosts, types.UpstreamHost{Url: "http://" + u.Hostname(), Port: port})
+	}
+	return upstream
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int64
+		body          string
+		contentLength int64
+		want          int
+	}{
+		{
+			name:          "UnderLimit",
+			limit:         10,
+			body:          "hello",
+			contentLength: 5,
+			want:          http.StatusOK,
+		},
+		{
+			name:          "ContentLengthOverLimit",
+			limit:         4,
+			body:          "hello",
+			contentLength: 5,
+			want:          http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "ChunkedOverLimit",
+			limit:         4,
+			body:          "hello",
+			contentLength: -1,
+			want:          http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "NoLimit",
+			body:          "hello",
+			contentLength: 5,
+			want:          http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := limitRequestBody(tt.limit, func(w http.ResponseWriter, r *http.Request) {
+				if _, err := ioutil.ReadAll(r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				}
+			})
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	tests := []struct {
+		name        string
+		traceparent string
+		status      int
+		wantStatus  codes.Code
+	}{
+		{
+			name:       "Root",
+			status:     http.StatusOK,
+			wantStatus: codes.Unset,
+		},
+		{
+			name:        "Continued",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			status:      http.StatusOK,
+			wantStatus:  codes.Unset,
+		},
+		{
+			name:       "ServerError",
+			status:     http.StatusBadGateway,
+			wantStatus: codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := types.RouteConfig{Name: tt.name, Location: "/traced"}
+			handler := traceRequests(route, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/traced", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			handler(httptest.NewRecorder(), r)
+
+			var span sdktrace.ReadOnlySpan
+			for _, ended := range recorder.Ended() {
+				if ended.Name() == "route "+tt.name {
+					span = ended
+				}
+			}
+			if span == nil {
+				t.Fatalf("no span named %q", "route "+tt.name)
+			}
+			if got := span.Status().Code; got != tt.wantStatus {
+				t.Errorf("span status = %v, want %v", got, tt.wantStatus)
+			}
+			if tt.traceparent != "" && span.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("span parent = %v, want the caller's trace", span.Parent().TraceID())
+			}
+			wantAttribute := attribute.Int("http.status_code", tt.status)
+			found := false
+			for _, kv := range span.Attributes() {
+				found = found || kv == wantAttribute
+			}
+			if !found {
+				t.Errorf("span attributes = %v, want %v", span.Attributes(), wantAttribute)
+			}
+		})
+	}
+}
+
+func TestInstrumentRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		route     types.RouteConfig
+		status    int
+		wantClass string
+		wantLabel string
+	}{
+		{
+			name:      "Implicit200",
+			route:     types.RouteConfig{Name: "instrumented", ForwardUpstream: "api"},
+			wantClass: "2xx",
+			wantLabel: "api",
+		},
+		{
+			name:      "Error",
+			route:     types.RouteConfig{Name: "instrumented", ForwardUpstream: "api"},
+			status:    http.StatusBadGateway,
+			wantClass: "5xx",
+			wantLabel: "api",
+		},
+		{
+			name:      "NoUpstream",
+			route:     types.RouteConfig{Name: "instrumented"},
+			status:    http.StatusNotFound,
+			wantClass: "4xx",
+			wantLabel: "none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := metrics.Requests.WithLabelValues(tt.route.Name, http.MethodGet, tt.wantClass, tt.wantLabel)
+			before := testutil.ToFloat64(requests)
+
+			var inFlight float64
+			handler := instrumentRequests(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				inFlight = testutil.ToFloat64(metrics.RequestsInFlight.WithLabelValues(tt.route.Name))
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+			})
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := testutil.ToFloat64(requests) - before; got != 1 {
+				t.Errorf("requests = %v, want 1", got)
+			}
+			if inFlight != 1 {
+				t.Errorf("in flight while serving = %v, want 1", inFlight)
+			}
+			if got := testutil.ToFloat64(metrics.RequestsInFlight.WithLabelValues(tt.route.Name)); got != 0 {
+				t.Errorf("in flight once served = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestCustomRoute_HandlerMethod(t *testing.T) {
+	tests := []struct {
+		name          string
+		beforeFilters []filters.Filter
+		want          int
+		wantProxied   bool
+	}{
+		{
+			name:          "Proxied",
+			beforeFilters: []filters.Filter{{Type: "throttle", Strategy: "default"}},
+			want:          http.StatusOK,
+			wantProxied:   true,
+		},
+		{
+			name:          "RejectedByFilter",
+			beforeFilters: []filters.Filter{{Type: "auth", Strategy: "session"}},
+			want:          http.StatusForbidden,
+		},
+		{
+			name:          "UnknownFilter",
+			beforeFilters: []filters.Filter{{Type: "unknown"}},
+			want:          http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxied = true
+			}))
+			defer server.Close()
+
+			config := &types.ServerConfig{}
+			shared := testShared(t, config)
+			upstream := testUpstream(t, "api", server)
+			route := types.RouteConfig{Name: "api", Location: "/api", BeforeFilters: tt.beforeFilters}
+			handler := RoutesFactory(route.Location, route.BeforeFilters, nil, upstream, newUpstreamProxy(route, upstream, shared), shared.loggers, shared.tokens).HandlerMethod()
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if proxied != tt.wantProxied {
+				t.Errorf("proxied = %v, want %v", proxied, tt.wantProxied)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxy_ServeHTTP(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		upstream types.Upstream
+		// requests sent before the one checked
+		warmup     int
+		want       int
+		wantHealth string
+	}{
+		{
+			name:       "Proxied",
+			upstream:   testUpstream(t, "ok", ok),
+			want:       http.StatusOK,
+			wantHealth: "up",
+		},
+		{
+			name:       "UpstreamError",
+			upstream:   testUpstream(t, "failing", failing),
+			want:       http.StatusInternalServerError,
+			wantHealth: "down",
+		},
+		{
+			name:       "Unreachable",
+			upstream:   testUpstream(t, "closed", closed),
+			want:       http.StatusBadGateway,
+			wantHealth: "down",
+		},
+		{
+			name:     "NoHosts",
+			upstream: types.Upstream{Name: "empty"},
+			want:     http.StatusBadGateway,
+		},
+		{
+			name: "CircuitOpen",
+			upstream: func() types.Upstream {
+				u := testUpstream(t, "tripped", failing)
+				u.CircuitBreaker = &breaker.Settings{ConsecutiveFailures: 1}
+				return u
+			}(),
+			warmup:     1,
+			want:       http.StatusServiceUnavailable,
+			wantHealth: "down",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &types.ServerConfig{Upstreams: []types.Upstream{tt.upstream}}
+			shared := testShared(t, config)
+			proxy := newUpstreamProxy(types.RouteConfig{Name: tt.name}, tt.upstream, shared)
+
+			for i := 0; i < tt.warmup; i++ {
+				proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/ping", nil))
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/ping", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && w.Header().Get("X-Path") != "/v1/ping" {
+				t.Errorf("upstream path = %q, want %q", w.Header().Get("X-Path"), "/v1/ping")
+			}
+			for _, host := range shared.Hosts(tt.upstream) {
+				if host.Health != tt.wantHealth {
+					t.Errorf("health of %s = %q, want %q", host.Host, host.Health, tt.wantHealth)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamProxy_RequestID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestid.Header, r.Header.Get(requestid.Header))
+	}))
+	defer server.Close()
+
+	upstream := testUpstream(t, "echo", server)
+	shared := testShared(t, &types.ServerConfig{Upstreams: []types.Upstream{upstream}})
+	handler := requestid.Handler(newUpstreamProxy(types.RouteConfig{Name: "echo"}, upstream, shared).ServeHTTP)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/ping", nil)
+	req.Header.Set(requestid.Header, "abc-123")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if got := w.Header().Values(requestid.Header); len(got) != 1 || got[0] != "abc-123" {
+		t.Errorf("%s = %q, want it once", requestid.Header, got)
+	}
+}
+
+func TestUpstreamProxy_CancelledProbe(t *testing.T) {
+	// 0 answers 200, 1 fails, 2 hangs until the client goes away
+	var mode int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(&mode) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	upstream := testUpstream(t, "probed", server)
+	upstream.CircuitBreaker = &breaker.Settings{ConsecutiveFailures: 1, OpenTimeout: 20 * time.Millisecond}
+	shared := testShared(t, &types.ServerConfig{Upstreams: []types.Upstream{upstream}})
+	proxy := newUpstreamProxy(types.RouteConfig{Name: "probed"}, upstream, shared)
+	serve := func(ctx context.Context) int {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		return w.Code
+	}
+
+	serve(context.Background())
+	time.Sleep(30 * time.Millisecond)
+
+	// the probe is cancelled by its client
+	atomic.StoreInt32(&mode, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	serve(ctx)
+	cancel()
+	if got := serve(context.Background()); got != http.StatusServiceUnavailable {
+		t.Fatalf("status while probing = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	atomic.StoreInt32(&mode, 0)
+	time.Sleep(30 * time.Millisecond)
+	if got := serve(context.Background()); got != http.StatusOK {
+		t.Fatalf("status once the probe is given up on = %d, want %d", got, http.StatusOK)
+	}
+	if got := shared.Hosts(upstream)[0].Circuit; got != breaker.Closed.String() {
+		t.Errorf("circuit = %q, want %q", got, breaker.Closed.String())
+	}
+}
+
+func TestShared_CheckUpstream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	upstream := types.Upstream{
+		Name:           "backend",
+		Hosts:          []types.UpstreamHost{{Url: "http://127.0.0.1", Port: int64(addr.Port)}},
+		CircuitBreaker: &breaker.Settings{ConsecutiveFailures: 1},
+	}
+	shared := testShared(t, &types.ServerConfig{Upstreams: []types.Upstream{upstream}})
+	proxy := newUpstreamProxy(types.RouteConfig{Name: "backend"}, upstream, shared)
+
+	if err := shared.CheckUpstream(context.Background(), upstream); err != nil {
+		t.Fatalf("CheckUpstream() error = %v", err)
+	}
+
+	// the host goes away, its circuit opens on the next request
+	listener.Close()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if err := shared.CheckUpstream(context.Background(), upstream); err == nil {
+		t.Fatal("CheckUpstream() with the host down should fail")
+	}
+
+	// it comes back while no request reaches it
+	listener, err = net.Listen("tcp", addr.String())
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	defer listener.Close()
+	if err := shared.CheckUpstream(context.Background(), upstream); err != nil {
+		t.Errorf("CheckUpstream() once the host is back error = %v", err)
+	}
+	if got := shared.Hosts(upstream)[0].Circuit; got != breaker.Open.String() {
+		t.Errorf("circuit = %q, want %q", got, breaker.Open.String())
+	}
+}
+
+func TestShared_CheckUpstreamNoHosts(t *testing.T) {
+	shared := testShared(t, &types.ServerConfig{})
+	if err := shared.CheckUpstream(context.Background(), types.Upstream{Name: "empty"}); err == nil {
+		t.Error("CheckUpstream() without hosts should fail")
+	}
+}
@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"accesslog"
+	"breaker"
+	"capture"
+	"context"
+	"filters/auth"
+	"fmt"
+	"httpclient"
+	"limiter"
+	"logging"
+	"metrics"
+	"net"
+	"sort"
+	"types"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Shared is the state shared by the handlers of every route.
+type Shared struct {
+	retryBudget *httpclient.RetryBudget
+	breakers    *breaker.Registry
+	hosts       *hostHealth
+	// concurrency limiters by name, "route:<name>" or "upstream:<name>"
+	limiters  map[string]*limiter.Limiter
+	accessLog *accesslog.Logger
+	// exchanges captured on routes with debug capture enabled
+	captures *capture.Buffer
+	// tokens are looked up by auth filters
+	tokens  auth.TokenStore
+	loggers *logging.Loggers
+	logger  log.Logger
+}
+
+// NewShared is constructor for Shared.
+func NewShared(config *types.ServerConfig, loggers *logging.Loggers, tokens auth.TokenStore) (*Shared, error) {
+	accessLog, err := accesslog.New(config.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Shared{
+		retryBudget: httpclient.NewRetryBudget(config.RetryBudget.Ratio, config.RetryBudget.MinPerSecond, config.RetryBudget.Window),
+		hosts:       &hostHealth{hosts: make(map[string]hostState)},
+		limiters:    make(map[string]*limiter.Limiter),
+		accessLog:   accessLog,
+		captures:    capture.NewBuffer(config.DebugCaptureBufferSize),
+		tokens:      tokens,
+		loggers:     loggers,
+		logger:      loggers.For("routes"),
+	}
+	s.breakers = breaker.NewRegistry(s.circuitStateChanged)
+	for _, route := range config.Routes {
+		if route.Concurrency != nil {
+			s.addLimiter("route:"+route.Name, *route.Concurrency)
+		}
+	}
+	for _, upstream := range config.Upstreams {
+		if upstream.Concurrency != nil {
+			s.addLimiter("upstream:"+upstream.Name, *upstream.Concurrency)
+		}
+	}
+	return s, nil
+}
+
+func (s *Shared) addLimiter(name string, settings limiter.Settings) {
+	s.limiters[name] = limiter.New(name, settings)
+}
+
+// Breakers of every upstream.
+func (s *Shared) Breakers() *breaker.Registry {
+	return s.breakers
+}
+
+// RetryBudget shared by the routes retrying requests.
+func (s *Shared) RetryBudget() *httpclient.RetryBudget {
+	return s.retryBudget
+}
+
+// Captures are the exchanges captured on routes with debug capture enabled.
+func (s *Shared) Captures() *capture.Buffer {
+	return s.captures
+}
+
+// Limiters returns every concurrency limiter sorted by name.
+func (s *Shared) Limiters() []*limiter.Limiter {
+	limiters := make([]*limiter.Limiter, 0, len(s.limiters))
+	for _, l := range s.limiters {
+		limiters = append(limiters, l)
+	}
+	sort.Slice(limiters, func(i, j int) bool { return limiters[i].Name() < limiters[j].Name() })
+	return limiters
+}
+
+// Hosts returns the health and circuit state of every host of upstream.
+func (s *Shared) Hosts(upstream types.Upstream) []HostStatus {
+	var hosts []HostStatus
+	for _, host := range upstream.Hosts {
+		target, err := hostTarget(host)
+		if err != nil {
+			continue
+		}
+		status := HostStatus{Host: target.Host, Health: "unknown"}
+		if state, ok := s.hosts.get(upstream.Name, target.Host); ok {
+			status.Health = "down"
+			if state.up {
+				status.Health = "up"
+			}
+			checked := state.checked
+			status.LastChecked = &checked
+		}
+		if upstream.CircuitBreaker != nil {
+			status.Circuit = s.breakers.Get(upstream.Name, target.Host, *upstream.CircuitBreaker).State().String()
+		}
+		hosts = append(hosts, status)
+	}
+	return hosts
+}
+
+// CheckUpstream fails unless a host of upstream accepts connections. The
+// hosts are dialed rather than judged by the last proxied requests, which
+// would keep an upstream unready until traffic came back to it.
+func (s *Shared) CheckUpstream(ctx context.Context, upstream types.Upstream) error {
+	if len(upstream.Hosts) == 0 {
+		return fmt.Errorf("upstream %s has no hosts", upstream.Name)
+	}
+	var dialer net.Dialer
+	var err error
+	for _, host := range upstream.Hosts {
+		target, tErr := hostTarget(host)
+		if tErr != nil {
+			err = tErr
+			continue
+		}
+		conn, dErr := dialer.DialContext(ctx, "tcp", target.Host)
+		if dErr != nil {
+			err = dErr
+			continue
+		}
+		conn.Close()
+		return nil
+	}
+	return fmt.Errorf("upstream %s has no reachable host: %w", upstream.Name, err)
+}
+
+func (s *Shared) circuitStateChanged(b *breaker.Breaker, from, to breaker.State) {
+	level.Warn(s.logger).Log("msg", "circuit state changed", "upstream", b.Upstream(), "host", b.Host(), "from", from, "to", to)
+	metrics.CircuitState.WithLabelValues(b.Upstream(), b.Host()).Set(float64(to))
+	metrics.CircuitTransitions.WithLabelValues(b.Upstream(), b.Host(), from.String(), to.String()).Inc()
+}
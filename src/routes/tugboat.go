@@ -2,13 +2,20 @@ package routes
 
 import (
 	"filters"
-	"log"
+	"filters/auth"
 	"net/http"
+	"requestid"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
 type Tugboat struct {
 	beforeFilters []filters.Filter
 	afterFilters  []filters.Filter
+	logger        log.Logger
+	filterLogger  log.Logger
+	tokens        auth.TokenStore
 }
 
 func (route Tugboat) Print() string {
@@ -21,9 +28,11 @@ func (route Tugboat) RouteNext(w http.ResponseWriter, r *http.Request) {
 
 func (route Tugboat) HandlerMethod() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Req: %s %s\n", r.Host, r.URL.Path)
-		filters.PerformFilters(route.beforeFilters, w, r)
+		level.Debug(route.logger).Log("msg", "request", "host", r.Host, "path", r.URL.Path, "request_id", requestid.FromContext(r.Context()))
+		if !filters.PerformFilters(route.filterLogger, route.tokens, route.beforeFilters, w, r) {
+			return
+		}
 		route.RouteNext(w, r)
-		filters.PerformFilters(route.afterFilters, w, r)
+		filters.PerformFilters(route.filterLogger, route.tokens, route.afterFilters, w, r)
 	}
 }
@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+
+	defaultServiceName = "gateway"
+)
+
+var defaultPropagators = []string{"tracecontext", "b3"}
+
+// Settings of tracing, as configured on the server.
+type Settings struct {
+	// Exporter is one of none, otlp, stdout or file.
+	Exporter string `yaml:"exporter"`
+	// Endpoint of the OTLP/HTTP collector, eg. otel-collector:4318.
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// Path of the file spans are written to by the file exporter.
+	Path string `yaml:"path"`
+	// SampleRatio of root spans recorded, parent decisions are honoured.
+	SampleRatio float64 `yaml:"sampleRatio"`
+	// Propagators accepted and sent: tracecontext, b3 (single header) and
+	// b3multi.
+	Propagators []string `yaml:"propagators"`
+	ServiceName string   `yaml:"serviceName"`
+}
+
+// Init installs the global tracer provider and propagators. The returned
+// function flushes pending spans and must be called before exiting.
+func Init(settings Settings) (func(context.Context) error, error) {
+	propagator, err := propagators(settings.Propagators)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTextMapPropagator(propagator)
+
+	exporter, err := newExporter(settings)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	serviceName := settings.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	ratio := settings.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(settings Settings) (sdktrace.SpanExporter, error) {
+	switch settings.Exporter {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(settings.Endpoint)}
+		if settings.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		out, err := os.OpenFile(settings.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(out))
+	}
+	return nil, fmt.Errorf("tracing: unknown exporter %q", settings.Exporter)
+}
+
+func propagators(names []string) (propagation.TextMapPropagator, error) {
+	if len(names) == 0 {
+		names = defaultPropagators
+	}
+
+	var list []propagation.TextMapPropagator
+	for _, name := range names {
+		switch name {
+		case "tracecontext":
+			list = append(list, propagation.TraceContext{})
+		case "b3":
+			list = append(list, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case "b3multi":
+			list = append(list, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("tracing: unknown propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(list...), nil
+}
+
+// Start a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer("gateway").Start(ctx, name, options...)
+}
+
+// Extract returns ctx carrying the remote span context found in carrier.
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Inject writes the span context of ctx into carrier.
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+}
@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		wantErr  bool
+	}{
+		{
+			name:     "None",
+			settings: Settings{},
+		},
+		{
+			name:     "File",
+			settings: Settings{Exporter: ExporterFile, Path: filepath.Join(t.TempDir(), "spans.json")},
+		},
+		{
+			name:     "UnknownExporter",
+			settings: Settings{Exporter: "zipkin"},
+			wantErr:  true,
+		},
+		{
+			name:     "UnknownPropagator",
+			settings: Settings{Propagators: []string{"jaeger"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := Init(tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("shutdown() error = %v", err)
+			}
+			if tt.settings.Path != "" {
+				if _, err := os.Stat(tt.settings.Path); err != nil {
+					t.Errorf("span file: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPropagators(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+
+	tests := []struct {
+		name        string
+		names       []string
+		wantHeaders []string
+	}{
+		{
+			name:        "Default",
+			wantHeaders: []string{"Traceparent", "B3"},
+		},
+		{
+			name:        "TraceContext",
+			names:       []string{"tracecontext"},
+			wantHeaders: []string{"Traceparent"},
+		},
+		{
+			name:        "B3Multi",
+			names:       []string{"b3multi"},
+			wantHeaders: []string{"X-B3-Traceid", "X-B3-Spanid"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			propagator, err := propagators(tt.names)
+			if err != nil {
+				t.Fatalf("propagators() error = %v", err)
+			}
+			header := http.Header{}
+			propagator.Inject(trace.ContextWithSpanContext(context.Background(), sc), propagation.HeaderCarrier(header))
+			for _, name := range tt.wantHeaders {
+				if header.Get(name) == "" {
+					t.Errorf("header %s not injected in %v", name, header)
+				}
+			}
+
+			got := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.HeaderCarrier(header)))
+			if got.TraceID() != traceID {
+				t.Errorf("extracted trace id = %v, want %v", got.TraceID(), traceID)
+			}
+		})
+	}
+}
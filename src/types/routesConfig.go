@@ -1,10 +1,46 @@
 package types
 
 import (
+	"accesslog"
+	"breaker"
+	"capture"
+	"crypto/sha256"
 	"filters"
+	"fmt"
+	"instrument"
+	"limiter"
+	"logging"
+	"os"
+	"time"
+	"tracing"
+
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	defaultShutdownTimeout     = 30 * time.Second
+	defaultReadHeaderTimeout   = 10 * time.Second
+	defaultReadTimeout         = 60 * time.Second
+	defaultWriteTimeout        = 60 * time.Second
+	defaultIdleTimeout         = 120 * time.Second
+	defaultMaxHeaderBytes      = 64 << 10
+	defaultMaxRequestBodyBytes = 10 << 20
+	defaultMaxConnections      = 10000
+
+	defaultConnectTimeout      = 5 * time.Second
+	defaultResponseTimeout     = 30 * time.Second
+	defaultUpstreamIdleTimeout = 90 * time.Second
+	defaultRetryWaitMin        = 50 * time.Millisecond
+	defaultRetryWaitMax        = time.Second
+	defaultRetryBudgetRatio    = 0.2
+	defaultRetryBudgetMin      = 10
+	defaultRetryBudgetWindow   = 10 * time.Second
+
+	defaultWorkersQueue       = "cmdqueue"
+	defaultWorkersPopTimeout  = 5 * time.Second
+	defaultWorkersConcurrency = 1
+)
+
 type UpstreamHost struct {
 	Url  string `yaml:"url"`
 	Port int64  `yaml:"port"`
@@ -13,6 +49,36 @@ type UpstreamHost struct {
 type Upstream struct {
 	Name  string         `yaml:"name"`
 	Hosts []UpstreamHost `yaml:"hosts"`
+	// CircuitBreaker is nil when the upstream has no circuit breaker.
+	CircuitBreaker *breaker.Settings `yaml:"circuitBreaker"`
+	// Concurrency caps requests in flight to the upstream across all routes.
+	Concurrency *limiter.Settings `yaml:"concurrency"`
+}
+
+// UpstreamTimeouts for requests proxied by a route.
+type UpstreamTimeouts struct {
+	Connect  time.Duration `yaml:"connect"`
+	Response time.Duration `yaml:"response"`
+	Idle     time.Duration `yaml:"idle"`
+}
+
+// RetryPolicy for requests proxied by a route.
+type RetryPolicy struct {
+	Max              int           `yaml:"max"`
+	WaitMin          time.Duration `yaml:"waitMin"`
+	WaitMax          time.Duration `yaml:"waitMax"`
+	OnConnectFailure bool          `yaml:"onConnectFailure"`
+	OnStatus         []int         `yaml:"onStatus"`
+	// NonIdempotent allows retrying POST and PATCH requests as well, on
+	// transport errors only when the connection could not be made.
+	NonIdempotent bool `yaml:"nonIdempotent"`
+}
+
+// RetryBudget shared by every route, see httpclient.RetryBudget.
+type RetryBudget struct {
+	Ratio        float64       `yaml:"ratio"`
+	MinPerSecond int           `yaml:"minPerSecond"`
+	Window       time.Duration `yaml:"window"`
 }
 
 type RouteConfig struct {
@@ -21,6 +87,16 @@ type RouteConfig struct {
 	BeforeFilters   []filters.Filter `yaml:"beforeFilters"`
 	AfterFilters    []filters.Filter `yaml:"afterFilters"`
 	ForwardUpstream string           `yaml:"forwardUpstream"`
+	// MaxRequestBodyBytes overrides ServerConfig.MaxRequestBodyBytes.
+	MaxRequestBodyBytes int64            `yaml:"maxRequestBodyBytes"`
+	Timeouts            UpstreamTimeouts `yaml:"timeouts"`
+	// Retry is nil when requests should not be retried.
+	Retry *RetryPolicy `yaml:"retry"`
+	// Concurrency caps requests in flight on the route.
+	Concurrency *limiter.Settings       `yaml:"concurrency"`
+	AccessLog   accesslog.RouteSettings `yaml:"accessLog"`
+	// DebugCapture records upstream exchanges, redacted, for the admin API.
+	DebugCapture *capture.Settings `yaml:"debugCapture"`
 }
 
 type ServerConfig struct {
@@ -28,6 +104,127 @@ type ServerConfig struct {
 	Upstreams       []Upstream
 	Port            string      `yaml:"port"`
 	nginxDirectives []NginxFlag `yaml:"nginxDirectives"`
+	// ShutdownTimeout bounds how long in-flight requests and worker queues
+	// are given to drain after SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// DrainDelay is how long readiness is failed before the listener is
+	// closed, so that load balancers stop routing new requests to us.
+	DrainDelay time.Duration `yaml:"drainDelay"`
+
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	MaxHeaderBytes    int           `yaml:"maxHeaderBytes"`
+	// MaxRequestBodyBytes is the default body limit for routes, larger
+	// requests are rejected with 413.
+	MaxRequestBodyBytes int64 `yaml:"maxRequestBodyBytes"`
+	// MaxConnections caps concurrently open client connections.
+	MaxConnections int `yaml:"maxConnections"`
+
+	RetryBudget RetryBudget        `yaml:"retryBudget"`
+	AccessLog   accesslog.Settings `yaml:"accessLog"`
+	// Instrument configures the statsd sink, Prometheus metrics are always
+	// served on /metrics.
+	Instrument instrument.Settings `yaml:"instrument"`
+	Tracing    tracing.Settings    `yaml:"tracing"`
+	Admin      AdminConfig         `yaml:"admin"`
+	Health     HealthConfig        `yaml:"health"`
+	Logging    logging.Settings    `yaml:"logging"`
+	Workers    WorkersConfig       `yaml:"workers"`
+	// DebugCaptureBufferSize is how many captured exchanges are kept across
+	// routes.
+	DebugCaptureBufferSize int `yaml:"debugCaptureBufferSize"`
+
+	checksum string
+}
+
+// HealthConfig configures the readiness checks.
+type HealthConfig struct {
+	// Optional dependencies are reported by /readyz without failing it,
+	// "redis" or "upstream:<name>". Upstreams no route forwards to are
+	// always optional.
+	Optional     []string      `yaml:"optional"`
+	CheckTimeout time.Duration `yaml:"checkTimeout"`
+}
+
+// Required reports whether readiness depends on dependency.
+func (h HealthConfig) Required(dependency string) bool {
+	for _, optional := range h.Optional {
+		if optional == dependency {
+			return false
+		}
+	}
+	return true
+}
+
+// WorkersConfig configures the redis backed command queue workers, they are
+// started only when Servers is not empty.
+type WorkersConfig struct {
+	// Servers are redis addresses, each gets its own queue and worker.
+	Servers []string `yaml:"servers"`
+	Queue   string   `yaml:"queue"`
+	// PopTimeout is how long a worker blocks waiting for a command, whole
+	// seconds.
+	PopTimeout time.Duration `yaml:"popTimeout"`
+	// LogLevel overrides logging.packages.worker.
+	LogLevel string `yaml:"logLevel"`
+	// Concurrency is how many commands are processed at once per server.
+	Concurrency int `yaml:"concurrency"`
+	// MaxInFlight bounds the commands popped ahead of processing per
+	// server, twice Concurrency by default.
+	MaxInFlight int `yaml:"maxInFlight"`
+	// TypeLimits bound how many commands of a type, e.g. "spark.App", are
+	// processed at once per server.
+	TypeLimits map[string]int `yaml:"typeLimits"`
+	// VisibilityTimeout is how long a popped command may go unacked before
+	// it is requeued, 5m by default.
+	VisibilityTimeout time.Duration `yaml:"visibilityTimeout"`
+	// BufferSize is how many commands are buffered for redis per server,
+	// 100 by default.
+	BufferSize int `yaml:"bufferSize"`
+	// PushTimeout is how long a push waits for room in a full buffer, 1s
+	// by default.
+	PushTimeout time.Duration `yaml:"pushTimeout"`
+	// SpillToRedis pushes to redis directly instead of waiting when the
+	// buffer is full.
+	SpillToRedis bool `yaml:"spillToRedis"`
+	// JournalDir is where commands no redis takes are spooled until redis
+	// recovers, they are dropped when empty.
+	JournalDir string `yaml:"journalDir"`
+	// Callbacks configures how command states are posted to their hooks.
+	Callbacks CallbacksConfig `yaml:"callbacks"`
+}
+
+// CallbacksConfig configures the delivery of command state callbacks. A
+// delivery which fails after its retries is kept and retried for a day.
+type CallbacksConfig struct {
+	// Retries per delivery, 3 by default waiting 1s to 10s between them.
+	Retries int           `yaml:"retries"`
+	WaitMin time.Duration `yaml:"waitMin"`
+	WaitMax time.Duration `yaml:"waitMax"`
+	// Secret signs the callbacks with HMAC-SHA256, read from the
+	// GATEWAY_CALLBACK_SECRET environment variable when empty. Callbacks
+	// are not signed without one.
+	Secret string `yaml:"secret" json:"-"`
+}
+
+// SigningSecret is the secret the callbacks are signed with, Secret or else
+// the GATEWAY_CALLBACK_SECRET environment variable.
+func (c CallbacksConfig) SigningSecret() string {
+	if c.Secret != "" {
+		return c.Secret
+	}
+	return os.Getenv("GATEWAY_CALLBACK_SECRET")
+}
+
+// AdminConfig configures the admin listener, which is disabled unless Port
+// and a token are set.
+type AdminConfig struct {
+	Port string `yaml:"port"`
+	// Token is the bearer token admin requests must carry, read from the
+	// GATEWAY_ADMIN_TOKEN environment variable when empty.
+	Token string `yaml:"token" json:"-"`
 }
 
 type NginxFlag struct {
@@ -36,5 +233,113 @@ type NginxFlag struct {
 }
 
 func (c *ServerConfig) Parse(data []byte) error {
-	return yaml.Unmarshal(data, c)
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return err
+	}
+	c.setDefaults()
+	c.checksum = fmt.Sprintf("%x", sha256.Sum256(data))
+	return nil
+}
+
+// Checksum is the SHA-256 of the config file the config was parsed from.
+func (c *ServerConfig) Checksum() string {
+	return c.checksum
+}
+
+// Routed reports whether a route forwards to upstream, readiness only
+// depending on the upstreams which serve traffic.
+func (c *ServerConfig) Routed(upstream string) bool {
+	for _, route := range c.Routes {
+		if route.ForwardUpstream == upstream {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ServerConfig) setDefaults() {
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.DrainDelay < 0 {
+		c.DrainDelay = 0
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.ReadTimeout <= 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxHeaderBytes <= 0 {
+		c.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if c.MaxRequestBodyBytes <= 0 {
+		c.MaxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+	if c.MaxConnections <= 0 {
+		c.MaxConnections = defaultMaxConnections
+	}
+	if c.RetryBudget.Ratio <= 0 {
+		c.RetryBudget.Ratio = defaultRetryBudgetRatio
+	}
+	if c.RetryBudget.MinPerSecond <= 0 {
+		c.RetryBudget.MinPerSecond = defaultRetryBudgetMin
+	}
+	if c.RetryBudget.Window <= 0 {
+		c.RetryBudget.Window = defaultRetryBudgetWindow
+	}
+	for i := range c.Routes {
+		c.Routes[i].setDefaults(c)
+	}
+	c.Workers.setDefaults(c)
+}
+
+func (w *WorkersConfig) setDefaults(c *ServerConfig) {
+	if w.Queue == "" {
+		w.Queue = defaultWorkersQueue
+	}
+	if w.PopTimeout < time.Second {
+		w.PopTimeout = defaultWorkersPopTimeout
+	}
+	if w.Concurrency <= 0 {
+		w.Concurrency = defaultWorkersConcurrency
+	}
+	if w.LogLevel != "" {
+		if c.Logging.Packages == nil {
+			c.Logging.Packages = make(map[string]string)
+		}
+		c.Logging.Packages["worker"] = w.LogLevel
+	}
+}
+
+func (r *RouteConfig) setDefaults(c *ServerConfig) {
+	if r.MaxRequestBodyBytes <= 0 {
+		r.MaxRequestBodyBytes = c.MaxRequestBodyBytes
+	}
+	if r.Timeouts.Connect <= 0 {
+		r.Timeouts.Connect = defaultConnectTimeout
+	}
+	if r.Timeouts.Response <= 0 {
+		r.Timeouts.Response = defaultResponseTimeout
+	}
+	if r.Timeouts.Idle <= 0 {
+		r.Timeouts.Idle = defaultUpstreamIdleTimeout
+	}
+	if r.Retry != nil {
+		if r.Retry.WaitMin <= 0 {
+			r.Retry.WaitMin = defaultRetryWaitMin
+		}
+		if r.Retry.WaitMax <= 0 {
+			r.Retry.WaitMax = defaultRetryWaitMax
+		}
+		if r.Retry.WaitMax < r.Retry.WaitMin {
+			r.Retry.WaitMax = r.Retry.WaitMin
+		}
+	}
 }
@@ -0,0 +1,206 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerConfig_Parse(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		check func(t *testing.T, c *ServerConfig)
+	}{
+		{
+			name: "Defaults",
+			yaml: "port: \"8080\"\nroutes:\n- name: api\n  retry:\n    max: 2\n",
+			check: func(t *testing.T, c *ServerConfig) {
+				if c.ShutdownTimeout != defaultShutdownTimeout || c.ReadHeaderTimeout != defaultReadHeaderTimeout || c.IdleTimeout != defaultIdleTimeout {
+					t.Errorf("server timeouts = %v, %v, %v", c.ShutdownTimeout, c.ReadHeaderTimeout, c.IdleTimeout)
+				}
+				if c.MaxRequestBodyBytes != defaultMaxRequestBodyBytes || c.MaxConnections != defaultMaxConnections {
+					t.Errorf("limits = %d, %d", c.MaxRequestBodyBytes, c.MaxConnections)
+				}
+				route := c.Routes[0]
+				if route.MaxRequestBodyBytes != defaultMaxRequestBodyBytes {
+					t.Errorf("route MaxRequestBodyBytes = %d, want %d", route.MaxRequestBodyBytes, defaultMaxRequestBodyBytes)
+				}
+				if route.Timeouts != (UpstreamTimeouts{defaultConnectTimeout, defaultResponseTimeout, defaultUpstreamIdleTimeout}) {
+					t.Errorf("route Timeouts = %+v", route.Timeouts)
+				}
+				if route.Retry.WaitMin != defaultRetryWaitMin || route.Retry.WaitMax != defaultRetryWaitMax {
+					t.Errorf("route Retry waits = %v, %v", route.Retry.WaitMin, route.Retry.WaitMax)
+				}
+				if c.Workers.Queue != defaultWorkersQueue || c.Workers.PopTimeout != defaultWorkersPopTimeout || c.Workers.Concurrency != defaultWorkersConcurrency {
+					t.Errorf("Workers = %+v", c.Workers)
+				}
+			},
+		},
+		{
+			name: "Overrides",
+			yaml: "maxRequestBodyBytes: 100\nroutes:\n- name: api\n  maxRequestBodyBytes: 10\n  retry:\n    waitMin: 2s\n    waitMax: 1s\n",
+			check: func(t *testing.T, c *ServerConfig) {
+				if c.MaxRequestBodyBytes != 100 {
+					t.Errorf("MaxRequestBodyBytes = %d, want 100", c.MaxRequestBodyBytes)
+				}
+				if got := c.Routes[0].MaxRequestBodyBytes; got != 10 {
+					t.Errorf("route MaxRequestBodyBytes = %d, want 10", got)
+				}
+				if got := c.Routes[0].Retry.WaitMax; got != 2*time.Second {
+					t.Errorf("route Retry.WaitMax = %v, want WaitMin", got)
+				}
+			},
+		},
+		{
+			name: "RouteInheritsBodyLimit",
+			yaml: "maxRequestBodyBytes: 100\nroutes:\n- name: api\n",
+			check: func(t *testing.T, c *ServerConfig) {
+				if got := c.Routes[0].MaxRequestBodyBytes; got != 100 {
+					t.Errorf("route MaxRequestBodyBytes = %d, want 100", got)
+				}
+				if c.Routes[0].Retry != nil {
+					t.Errorf("route Retry = %+v, want nil", c.Routes[0].Retry)
+				}
+			},
+		},
+		{
+			name: "WorkersLogLevel",
+			yaml: "workers:\n  popTimeout: 100ms\n  logLevel: debug\n",
+			check: func(t *testing.T, c *ServerConfig) {
+				if c.Workers.PopTimeout != defaultWorkersPopTimeout {
+					t.Errorf("Workers.PopTimeout = %v, want %v", c.Workers.PopTimeout, defaultWorkersPopTimeout)
+				}
+				if got := c.Logging.Packages["worker"]; got != "debug" {
+					t.Errorf("worker log level = %q, want debug", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ServerConfig{}
+			if err := c.Parse([]byte(tt.yaml)); err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if c.Checksum() == "" {
+				t.Error("Checksum() is empty")
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestServerConfig_setDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ServerConfig
+		want   ServerConfig
+	}{
+		{
+			name: "Unset",
+			want: ServerConfig{
+				ShutdownTimeout:     defaultShutdownTimeout,
+				ReadHeaderTimeout:   defaultReadHeaderTimeout,
+				ReadTimeout:         defaultReadTimeout,
+				WriteTimeout:        defaultWriteTimeout,
+				IdleTimeout:         defaultIdleTimeout,
+				MaxHeaderBytes:      defaultMaxHeaderBytes,
+				MaxRequestBodyBytes: defaultMaxRequestBodyBytes,
+				MaxConnections:      defaultMaxConnections,
+			},
+		},
+		{
+			name: "Set",
+			config: ServerConfig{
+				ShutdownTimeout:     time.Second,
+				DrainDelay:          2 * time.Second,
+				ReadHeaderTimeout:   3 * time.Second,
+				ReadTimeout:         4 * time.Second,
+				WriteTimeout:        5 * time.Second,
+				IdleTimeout:         6 * time.Second,
+				MaxHeaderBytes:      1024,
+				MaxRequestBodyBytes: 2048,
+				MaxConnections:      10,
+			},
+			want: ServerConfig{
+				ShutdownTimeout:     time.Second,
+				DrainDelay:          2 * time.Second,
+				ReadHeaderTimeout:   3 * time.Second,
+				ReadTimeout:         4 * time.Second,
+				WriteTimeout:        5 * time.Second,
+				IdleTimeout:         6 * time.Second,
+				MaxHeaderBytes:      1024,
+				MaxRequestBodyBytes: 2048,
+				MaxConnections:      10,
+			},
+		},
+		{
+			name: "Negative",
+			config: ServerConfig{
+				DrainDelay:          -time.Second,
+				ReadTimeout:         -time.Second,
+				MaxHeaderBytes:      -1,
+				MaxRequestBodyBytes: -1,
+				MaxConnections:      -1,
+			},
+			want: ServerConfig{
+				ShutdownTimeout:     defaultShutdownTimeout,
+				ReadHeaderTimeout:   defaultReadHeaderTimeout,
+				ReadTimeout:         defaultReadTimeout,
+				WriteTimeout:        defaultWriteTimeout,
+				IdleTimeout:         defaultIdleTimeout,
+				MaxHeaderBytes:      defaultMaxHeaderBytes,
+				MaxRequestBodyBytes: defaultMaxRequestBodyBytes,
+				MaxConnections:      defaultMaxConnections,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			c.setDefaults()
+			got := [...]interface{}{c.ShutdownTimeout, c.DrainDelay, c.ReadHeaderTimeout, c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.MaxHeaderBytes, c.MaxRequestBodyBytes, c.MaxConnections}
+			want := [...]interface{}{tt.want.ShutdownTimeout, tt.want.DrainDelay, tt.want.ReadHeaderTimeout, tt.want.ReadTimeout, tt.want.WriteTimeout, tt.want.IdleTimeout, tt.want.MaxHeaderBytes, tt.want.MaxRequestBodyBytes, tt.want.MaxConnections}
+			if got != want {
+				t.Errorf("setDefaults() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestServerConfig_Routed(t *testing.T) {
+	c := &ServerConfig{Routes: []RouteConfig{{Name: "api", ForwardUpstream: "backend"}, {Name: "accounts"}}}
+	tests := []struct {
+		upstream string
+		want     bool
+	}{
+		{upstream: "backend", want: true},
+		{upstream: "remote1"},
+	}
+	for _, tt := range tests {
+		if got := c.Routed(tt.upstream); got != tt.want {
+			t.Errorf("Routed(%q) = %v, want %v", tt.upstream, got, tt.want)
+		}
+	}
+}
+
+func TestCallbacksConfig_SigningSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		env    string
+		want   string
+	}{
+		{name: "config", secret: "s1", env: "s2", want: "s1"},
+		{name: "environment", env: "s2", want: "s2"},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GATEWAY_CALLBACK_SECRET", tt.env)
+			if got := (CallbacksConfig{Secret: tt.secret}).SigningSecret(); got != tt.want {
+				t.Errorf("SigningSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
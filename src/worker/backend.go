@@ -0,0 +1,90 @@
+package worker
+
+import "time"
+
+// Message is a command popped from a Backend.
+type Message struct {
+	Body []byte
+	// Receipt identifies the popped message to Ack and Nack.
+	Receipt string
+}
+
+// Backend is the queue a worker pushes commands to and pops them from.
+type Backend interface {
+	// Push appends body to the queue.
+	Push(body []byte) error
+	// PushAt makes body available to Pop once due.
+	PushAt(body []byte, due time.Time) error
+	// Pop waits up to timeout for a message, ErrEmptyQueue if none came.
+	// The message is held until acked or nacked.
+	Pop(timeout time.Duration) (Message, error)
+	// Ack removes a popped message for good.
+	Ack(m Message) error
+	// Nack gives a popped message back to the queue after delay.
+	Nack(m Message, delay time.Duration) error
+}
+
+// Maintainer is implemented by backends which need background work, such as
+// moving due messages to the queue. Maintain returns once stop is closed.
+type Maintainer interface {
+	Maintain(stop <-chan struct{})
+}
+
+// Extender is implemented by backends which give a popped message back once
+// unacked for a while, for the worker to keep the message it is still
+// processing from being popped again.
+type Extender interface {
+	// Extend keeps m hidden for another visibility timeout.
+	Extend(m Message) error
+}
+
+// TraceStore is implemented by backends which keep the trace carrier of the
+// queued commands, for the worker popping one to continue its trace.
+type TraceStore interface {
+	StoreTrace(id uint64, carrier []byte) error
+	// Trace returns nil when command id has no trace.
+	Trace(id uint64) ([]byte, error)
+}
+
+// DeadLetterStore is implemented by backends which keep dead letters, as
+// entries by id, newest first.
+type DeadLetterStore interface {
+	AddDeadLetter(id string, entry []byte) error
+	// DeadLetters returns up to limit entries from offset, along with how
+	// many there are.
+	DeadLetters(offset, limit int) ([][]byte, int, error)
+	// DeadLetter returns ErrDeadLetterNotFound if there is no entry id.
+	DeadLetter(id string) ([]byte, error)
+	// RequeueDeadLetter removes entry id and pushes body in its place to be
+	// popped once due, ErrDeadLetterNotFound if it was gone.
+	RequeueDeadLetter(id string, body []byte, due time.Time) error
+	PurgeDeadLetter(id string) error
+	PurgeDeadLetters() (int, error)
+}
+
+// OutboxStore is implemented by backends which keep the callbacks not
+// delivered yet, as entries by key.
+type OutboxStore interface {
+	// PutCallback adds entry, or replaces the entry with the same key.
+	PutCallback(key string, entry []byte) error
+	Callbacks() ([][]byte, error)
+	RemoveCallback(key string) error
+}
+
+// HistoryStore is implemented by backends which keep the state of the
+// commands, along with the transitions which led to it as entries oldest
+// first.
+type HistoryStore interface {
+	// State returns the state of command id, empty when unknown.
+	State(id uint64) (string, error)
+	// AddTransition moves command id from state from to state to and
+	// appends entry to its history, ErrStateConflict if it was no longer in
+	// state from. A command with no state is in any.
+	AddTransition(id uint64, from, to string, entry []byte) error
+	History(id uint64) ([][]byte, error)
+	// Run returns how many times command id was run again, 0 until then.
+	Run(id uint64) (int, error)
+	// NewRun starts another run of command id, with no state, and appends
+	// entry to its history. It returns the run started.
+	NewRun(id uint64, entry []byte) (int, error)
+}
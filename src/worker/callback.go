@@ -0,0 +1,257 @@
+package worker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/qubole/edith/pkg/command"
+	"github.com/qubole/edith/pkg/state"
+
+	"httpclient"
+	"metrics"
+)
+
+// Headers of the callbacks posted to the hooks of a command.
+const (
+	// IdempotencyKeyHeader is the same for every delivery of a command
+	// state within a run, for the receiver to drop the duplicates, and
+	// differs once the command is run again.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the
+	// timestamp, a dot and the body, see Sign.
+	SignatureHeader = "X-Signature"
+	// SignatureTimestampHeader is when the callback was signed, in unix
+	// seconds, for the receiver to reject stale ones.
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+var (
+	// errNoOutbox the backend does not keep callbacks.
+	errNoOutbox = errors.New("backend does not keep callbacks")
+
+	defaultCallbackRetries = 3
+	defaultCallbackWaitMin = time.Second
+	defaultCallbackWaitMax = 10 * time.Second
+
+	// outboxInterval is how often undelivered callbacks are retried, each
+	// waiting longer than the one before up to outboxMaxBackoff.
+	outboxInterval   = time.Minute
+	outboxMaxBackoff = time.Hour
+	// callbackTTL is how long a callback is retried before giving up.
+	callbackTTL = 24 * time.Hour
+)
+
+// callback is a command state to post to a hook, kept in the outbox of the
+// backend until delivered.
+type callback struct {
+	Key       string          `json:"key"`
+	CommandID uint64          `json:"commandId"`
+	State     state.State     `json:"state"`
+	Hook      string          `json:"hook"`
+	Payload   json.RawMessage `json:"payload"`
+	Created   time.Time       `json:"created"`
+	Attempts  int             `json:"attempts"`
+	// Next is when the outbox delivers it again.
+	Next time.Time `json:"next"`
+}
+
+// idempotencyKey of the callback for run of command id reaching st, the
+// same for every delivery of it and another for every run.
+func idempotencyKey(id uint64, run int, st state.State) string {
+	return fmt.Sprintf("%d-%d-%s", id, run, st)
+}
+
+// Sign returns the hex HMAC-SHA256 of timestamp, a dot and body with
+// secret, as sent in SignatureHeader after "sha256=".
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// storeState posts status to hook. A callback which cannot be delivered
+// is kept in the outbox and retried by loopOutbox, the error is only
+// returned when it could not be kept either.
+func (w *Worker) storeState(ctx context.Context, cmd command.Command, status *state.Status, hook string) error {
+	if hook == "" {
+		_ = level.Warn(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "storeState", "context", "", "error", "blank.hook")
+		return nil
+	}
+	payload, err := json.Marshal(status.Payload)
+	if err != nil {
+		return err
+	}
+	run, err := w.runOf(cmd)
+	if err != nil {
+		return fmt.Errorf("runOf: %w", err)
+	}
+
+	now := time.Now()
+	cb := &callback{
+		Key:       idempotencyKey(cmd.GetID(), run, status.State),
+		CommandID: cmd.GetID(),
+		State:     status.State,
+		Hook:      hook,
+		Payload:   payload,
+		Created:   now,
+		// the first delivery retries on its own, the outbox waits for it
+		Next: now.Add(outboxInterval),
+	}
+	outboxed := true
+	if sErr := w.putCallback(cb); sErr != nil {
+		outboxed = false
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "storeState", "context", "putCallback", "error", sErr)
+	}
+
+	err = w.deliverCallback(ctx, cb)
+	if err == nil {
+		w.callbackResult("delivered")
+		if outboxed {
+			w.removeCallback(cb)
+		}
+		return nil
+	}
+	_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "storeState", "context", "post", "hook", hook, "outboxed", outboxed, "error", err, "cmd", cmd.String())
+	if !outboxed {
+		w.callbackResult("failed")
+		return err
+	}
+	w.callbackResult("outboxed")
+	cb.Attempts++
+	if sErr := w.putCallback(cb); sErr != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "storeState", "context", "putCallback", "error", sErr)
+	}
+	return nil
+}
+
+// deliverCallback posts cb to its hook, signed when the worker has a
+// secret. Statuses other than 2xx are errors.
+func (w *Worker) deliverCallback(ctx context.Context, cb *callback) error {
+	headers := make(map[string]string)
+	headers["Content-Type"] = "application/json"
+	headers["Accept"] = "*/*"
+	headers[IdempotencyKeyHeader] = cb.Key
+	if len(w.callbackSecret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		headers[SignatureTimestampHeader] = timestamp
+		headers[SignatureHeader] = "sha256=" + Sign(w.callbackSecret, timestamp, cb.Payload)
+	}
+
+	_, st, err := httpclient.PostWithRetries(ctx, w.callbackRetry, cb.Hook, cb.Payload, headers)
+	_ = level.Info(w.loggerFor(ctx)).Log("cmdID", cb.CommandID, "method", "deliverCallback", "context", "post", "hook", cb.Hook, "http.status", st, "state", cb.State, "attempts", cb.Attempts+1)
+	if err != nil {
+		return err
+	}
+	if st < 200 || st > 299 {
+		return fmt.Errorf("callback: http status %d", st)
+	}
+	return nil
+}
+
+// flushOutbox delivers the callbacks due by now, and gives up on the ones
+// older than callbackTTL. Workers sharing a queue may deliver the same
+// callback at once, the idempotency key lets the receiver drop one. It
+// returns how many were delivered.
+func (w *Worker) flushOutbox(now time.Time) (int, error) {
+	store, ok := w.backend.(OutboxStore)
+	if !ok {
+		return 0, nil
+	}
+	entries, err := store.Callbacks()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, entry := range entries {
+		cb := &callback{}
+		if err := json.Unmarshal(entry, cb); err != nil {
+			_ = level.Error(w.logger).Log("method", "flushOutbox", "context", "unmarshal", "error", err)
+			continue
+		}
+		if cb.Next.After(now) {
+			continue
+		}
+		if now.Sub(cb.Created) > callbackTTL {
+			_ = level.Error(w.logger).Log("cmdID", cb.CommandID, "method", "flushOutbox", "context", "expired", "hook", cb.Hook, "state", cb.State, "attempts", cb.Attempts)
+			w.callbackResult("expired")
+			w.removeCallback(cb)
+			continue
+		}
+
+		if err := w.deliverCallback(context.Background(), cb); err != nil {
+			_ = level.Warn(w.logger).Log("cmdID", cb.CommandID, "method", "flushOutbox", "context", "post", "hook", cb.Hook, "attempts", cb.Attempts+1, "error", err)
+			cb.Attempts++
+			cb.Next = now.Add(outboxInterval + expBackoff(cb.Attempts, outboxInterval, outboxMaxBackoff))
+			if err := w.putCallback(cb); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		w.callbackResult("redelivered")
+		w.removeCallback(cb)
+		delivered++
+	}
+	return delivered, nil
+}
+
+// loopOutbox retries the undelivered callbacks, starting with those left
+// by a previous run.
+func (w *Worker) loopOutbox(stop <-chan struct{}) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		delivered, err := w.flushOutbox(time.Now())
+		if err != nil {
+			_ = level.Error(w.logger).Log("method", "loopOutbox", "context", "flushOutbox", "error", err)
+		} else if delivered > 0 {
+			_ = level.Info(w.logger).Log("method", "loopOutbox", "context", "flushOutbox", "delivered", delivered)
+		}
+
+		select {
+		case <-stop:
+			_ = level.Info(w.logger).Log("method", "loopOutbox", "status", "exit", "redis_server", w.server)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// putCallback adds cb to the outbox of the backend.
+func (w *Worker) putCallback(cb *callback) error {
+	store, ok := w.backend.(OutboxStore)
+	if !ok {
+		return errNoOutbox
+	}
+	entry, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+	return store.PutCallback(cb.Key, entry)
+}
+
+// removeCallback deletes cb from the outbox, a failure only means it is
+// delivered again.
+func (w *Worker) removeCallback(cb *callback) {
+	if err := w.backend.(OutboxStore).RemoveCallback(cb.Key); err != nil {
+		_ = level.Error(w.logger).Log("cmdID", cb.CommandID, "method", "removeCallback", "error", err)
+	}
+}
+
+// callbackResult counts the callbacks delivered, outboxed, redelivered,
+// expired or failed.
+func (w *Worker) callbackResult(result string) {
+	metrics.WorkerCallbacks.WithLabelValues(w.cmdQueue, result).Inc()
+}
@@ -0,0 +1,146 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qubole/edith/pkg/apps/edith"
+	"github.com/qubole/edith/pkg/command"
+	"github.com/qubole/edith/pkg/spark"
+	"github.com/qubole/edith/pkg/state"
+)
+
+func TestWorker_storeState(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		// failures before the hook answers 200
+		failures      int
+		wantDelivered int
+		wantOutboxed  int
+	}{
+		{
+			name:          "delivered",
+			secret:        "s3cret",
+			wantDelivered: 1,
+		},
+		{
+			name:          "unsigned",
+			wantDelivered: 1,
+		},
+		{
+			name:          "outboxed",
+			secret:        "s3cret",
+			failures:      2,
+			wantDelivered: 0,
+			wantOutboxed:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts := 0
+			var header http.Header
+			var body []byte
+			hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				posts++
+				header = r.Header
+				body, _ = ioutil.ReadAll(r.Body)
+				if posts <= tt.failures {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer hook.Close()
+
+			backend := NewMemoryBackend()
+			w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), CallbackSecret(tt.secret),
+				CallbackRetries(1, time.Millisecond, time.Millisecond),
+				WithBackend(func(_, _ string) Backend { return backend }))
+			cmd := &edith.Command{ID: 5, Type: "spark_app", SparkApp: &spark.App{ID: 5}, Info: &command.RunInfo{Operation: "status"}}
+			status := &state.Status{CommandID: 5, State: state.Running, Payload: state.Payload{Time: "now"}}
+
+			if err := w.storeState(context.Background(), cmd, status, hook.URL); err != nil {
+				t.Fatalf("Worker.storeState() error = %v", err)
+			}
+			if got := header.Get(IdempotencyKeyHeader); got != "5-0-running" {
+				t.Errorf("%s = %q, want %q", IdempotencyKeyHeader, got, "5-0-running")
+			}
+			wantSignature := ""
+			if tt.secret != "" {
+				wantSignature = "sha256=" + Sign([]byte(tt.secret), header.Get(SignatureTimestampHeader), body)
+			}
+			if got := header.Get(SignatureHeader); got != wantSignature {
+				t.Errorf("%s = %q, want %q", SignatureHeader, got, wantSignature)
+			}
+
+			outbox, _ := backend.Callbacks()
+			if len(outbox) != tt.wantOutboxed {
+				t.Fatalf("outbox has %d callbacks, want %d", len(outbox), tt.wantOutboxed)
+			}
+			if tt.wantOutboxed == 0 {
+				return
+			}
+
+			// nothing is due before outboxInterval
+			if delivered, err := w.flushOutbox(time.Now()); err != nil || delivered != 0 {
+				t.Errorf("Worker.flushOutbox() now = %d, %v, want 0", delivered, err)
+			}
+			if delivered, err := w.flushOutbox(time.Now().Add(outboxInterval)); err != nil || delivered != 1 {
+				t.Errorf("Worker.flushOutbox() once due = %d, %v, want 1", delivered, err)
+			}
+			if outbox, _ := backend.Callbacks(); len(outbox) != 0 {
+				t.Errorf("outbox has %d callbacks once delivered, want 0", len(outbox))
+			}
+			if got := header.Get(IdempotencyKeyHeader); got != "5-0-running" {
+				t.Errorf("redelivered %s = %q, want %q", IdempotencyKeyHeader, got, "5-0-running")
+			}
+		})
+	}
+}
+
+func TestWorker_storeStateRerun(t *testing.T) {
+	var keys []string
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+	}))
+	defer hook.Close()
+
+	backend := NewMemoryBackend()
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+	cmd := &edith.Command{ID: 5, Type: "spark_app", SparkApp: &spark.App{ID: 5}, Info: &command.RunInfo{Operation: "status"}}
+	status := &state.Status{CommandID: 5, State: state.Running}
+
+	if err := w.storeState(context.Background(), cmd, status, hook.URL); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a dead letter requeued
+	if err := w.resetState(cmd, "rerun"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.storeState(context.Background(), cmd, status, hook.URL); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"5-0-running", "5-1-running"}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("%s = %v, want %v", IdempotencyKeyHeader, keys, want)
+	}
+}
+
+func TestWorker_flushOutboxExpired(t *testing.T) {
+	backend := NewMemoryBackend()
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+	cb := &callback{Key: "6-0-errored", CommandID: 6, State: state.Errored, Hook: "http://127.0.0.1:1", Created: time.Now().Add(-callbackTTL - time.Minute)}
+	if err := w.putCallback(cb); err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered, err := w.flushOutbox(time.Now()); err != nil || delivered != 0 {
+		t.Errorf("Worker.flushOutbox() = %d, %v, want 0", delivered, err)
+	}
+	if outbox, _ := backend.Callbacks(); len(outbox) != 0 {
+		t.Errorf("outbox has %d callbacks once expired, want 0", len(outbox))
+	}
+}
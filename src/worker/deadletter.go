@@ -0,0 +1,271 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qubole/edith/pkg/command"
+)
+
+// ErrDeadLetterNotFound no dead letter has the given id.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a command which failed more than its MaxRetries.
+type DeadLetter struct {
+	// ID is unique across workers.
+	ID        string          `json:"id"`
+	Server    string          `json:"server"`
+	Queue     string          `json:"queue"`
+	CommandID uint64          `json:"commandId"`
+	Command   json.RawMessage `json:"command"`
+	// Body of a message which does not decode to a command, Command is
+	// empty then.
+	Body     []byte    `json:"body,omitempty"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	DeadAt   time.Time `json:"deadAt"`
+}
+
+// errNoDeadLetters the backend does not keep dead letters.
+var errNoDeadLetters = errors.New("backend does not keep dead letters")
+
+// deadLetterStore returns the backend as a DeadLetterStore.
+func (w *Worker) deadLetterStore() (DeadLetterStore, error) {
+	store, ok := w.backend.(DeadLetterStore)
+	if !ok {
+		return nil, errNoDeadLetters
+	}
+	return store, nil
+}
+
+// deadLetter stores cmd, which failed for the last time with err.
+func (w *Worker) deadLetter(cmd command.Command, err error) error {
+	store, sErr := w.deadLetterStore()
+	if sErr != nil {
+		return sErr
+	}
+	b, mErr := w.cmdManager.MarshalCommand(cmd)
+	if mErr != nil {
+		return mErr
+	}
+	now := time.Now()
+	d := DeadLetter{
+		ID:        fmt.Sprintf("%d-%d", cmd.GetID(), now.UnixNano()),
+		Server:    w.server,
+		Queue:     w.cmdQueue,
+		CommandID: cmd.GetID(),
+		Command:   b,
+		Error:     err.Error(),
+		Attempts:  cmd.RunInfo().RetryCount + 1,
+		DeadAt:    now,
+	}
+	entry, mErr := json.Marshal(d)
+	if mErr != nil {
+		return mErr
+	}
+	return store.AddDeadLetter(d.ID, entry)
+}
+
+// deadLetterBody stores body, a message which does not decode to a command
+// with err, for operators to look into.
+func (w *Worker) deadLetterBody(body []byte, err error) error {
+	store, sErr := w.deadLetterStore()
+	if sErr != nil {
+		return sErr
+	}
+	now := time.Now()
+	d := DeadLetter{
+		ID:       fmt.Sprintf("undecodable-%d", now.UnixNano()),
+		Server:   w.server,
+		Queue:    w.cmdQueue,
+		Body:     body,
+		Error:    err.Error(),
+		Attempts: 1,
+		DeadAt:   now,
+	}
+	entry, mErr := json.Marshal(d)
+	if mErr != nil {
+		return mErr
+	}
+	return store.AddDeadLetter(d.ID, entry)
+}
+
+// DeadLetterPage is a page of the dead letters, newest first within each
+// worker.
+type DeadLetterPage struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+	Offset      int          `json:"offset"`
+	// Total is how many dead letters there are over all the pages.
+	Total int `json:"total"`
+}
+
+// deadLetters returns up to limit dead letters of the worker from offset,
+// newest first, along with how many it holds.
+func (w *Worker) deadLetters(offset, limit int) ([]DeadLetter, int, error) {
+	store, err := w.deadLetterStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, total, err := store.DeadLetters(offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		var d DeadLetter
+		if err := json.Unmarshal(entry, &d); err != nil {
+			return nil, 0, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, total, nil
+}
+
+// getDeadLetter returns dead letter id of the worker.
+func (w *Worker) getDeadLetter(id string) (*DeadLetter, error) {
+	store, err := w.deadLetterStore()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := store.DeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	var d DeadLetter
+	if err := json.Unmarshal(entry, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// requeueDead pushes the command of dead letter id again, with its retries
+// and state reset. The state is reset first, for the command not to be
+// popped while still finished.
+func (w *Worker) requeueDead(id string) error {
+	d, err := w.getDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	if len(d.Command) == 0 {
+		return fmt.Errorf("dead letter %s holds no command", id)
+	}
+	cmd, err := w.cmdManager.UnMarshalCommand(d.Command)
+	if err != nil {
+		return err
+	}
+	cmd.RunInfo().RetryCount = 0
+	b, err := w.cmdManager.MarshalCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	store, err := w.deadLetterStore()
+	if err != nil {
+		return err
+	}
+	// run it again from the start
+	if err := w.resetState(cmd, "dead letter "+id+" requeued"); err != nil {
+		return fmt.Errorf("resetState: %w", err)
+	}
+	return store.RequeueDeadLetter(id, b, time.Now())
+}
+
+// purgeDead deletes dead letter id.
+func (w *Worker) purgeDead(id string) error {
+	store, err := w.deadLetterStore()
+	if err != nil {
+		return err
+	}
+	return store.PurgeDeadLetter(id)
+}
+
+// purgeAllDead deletes every dead letter of the worker, returning how many
+// there were.
+func (w *Worker) purgeAllDead() (int, error) {
+	store, err := w.deadLetterStore()
+	if err != nil {
+		return 0, err
+	}
+	return store.PurgeDeadLetters()
+}
+
+// DeadLetters returns up to limit dead letters from offset, over the
+// workers in turn.
+func (m *Manager) DeadLetters(offset, limit int) (*DeadLetterPage, error) {
+	page := &DeadLetterPage{DeadLetters: []DeadLetter{}, Offset: offset}
+	// the offset within the worker
+	skip := offset
+	for _, w := range m.workers {
+		l, total, err := w.deadLetters(skip, limit-len(page.DeadLetters))
+		if err != nil {
+			return nil, fmt.Errorf("worker.%d.deadLetters: %w", w.id, err)
+		}
+		page.DeadLetters = append(page.DeadLetters, l...)
+		page.Total += total
+		if skip -= total; skip < 0 {
+			skip = 0
+		}
+	}
+	return page, nil
+}
+
+// DeadLetter returns dead letter id.
+func (m *Manager) DeadLetter(id string) (*DeadLetter, error) {
+	w, err := m.deadLetterWorker(id)
+	if err != nil {
+		return nil, err
+	}
+	return w.getDeadLetter(id)
+}
+
+// RequeueDeadLetter pushes the command of dead letter id to its queue again
+// with its retries reset, and removes the dead letter.
+func (m *Manager) RequeueDeadLetter(id string) error {
+	w, err := m.deadLetterWorker(id)
+	if err != nil {
+		return err
+	}
+	return w.requeueDead(id)
+}
+
+// PurgeDeadLetter deletes dead letter id.
+func (m *Manager) PurgeDeadLetter(id string) error {
+	w, err := m.deadLetterWorker(id)
+	if err != nil {
+		return err
+	}
+	return w.purgeDead(id)
+}
+
+// PurgeDeadLetters deletes every dead letter, returning how many there were.
+func (m *Manager) PurgeDeadLetters() (int, error) {
+	purged := 0
+	for _, w := range m.workers {
+		n, err := w.purgeAllDead()
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("worker.%d.purgeAllDead: %w", w.id, err)
+		}
+	}
+	return purged, nil
+}
+
+// deadLetterWorker returns the worker holding dead letter id, whichever its
+// position, so that ids outlive changes to the list of servers.
+func (m *Manager) deadLetterWorker(id string) (*Worker, error) {
+	for _, w := range m.workers {
+		store, err := w.deadLetterStore()
+		if err != nil {
+			continue
+		}
+		if _, err := store.DeadLetter(id); err == nil {
+			return w, nil
+		} else if err != ErrDeadLetterNotFound {
+			return nil, fmt.Errorf("worker.%d.DeadLetter: %w", w.id, err)
+		}
+	}
+	return nil, ErrDeadLetterNotFound
+}
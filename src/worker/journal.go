@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// journal spools the commands no redis accepted to a local file, to push
+// them once redis recovers.
+type journal struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newJournal(dir, queue string) *journal {
+	return &journal{path: filepath.Join(dir, queue+".journal")}
+}
+
+// append r to the journal, synced to disk before returning.
+func (j *journal) append(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay hands the journaled records to push, oldest first, until it
+// fails. It keeps the records not pushed and returns how many were.
+func (j *journal) replay(push func(record) error) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	pushed := 0
+	var pushErr error
+	for _, line := range lines {
+		var r record
+		// a line torn by a crash mid append
+		if json.Unmarshal(line, &r) != nil {
+			pushed++
+			continue
+		}
+		if pushErr = push(r); pushErr != nil {
+			break
+		}
+		pushed++
+	}
+	if pushed == 0 {
+		return 0, pushErr
+	}
+
+	if pushed == len(lines) {
+		if err := os.Remove(j.path); err != nil {
+			return pushed, err
+		}
+		return pushed, pushErr
+	}
+	// keep the rest, replacing the file atomically
+	tmp := j.path + ".tmp"
+	f, err = os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return pushed, err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines[pushed:] {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return pushed, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return pushed, err
+	}
+	if err := f.Close(); err != nil {
+		return pushed, err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return pushed, err
+	}
+	return pushed, pushErr
+}
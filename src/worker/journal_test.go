@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJournal_replay(t *testing.T) {
+	tests := []struct {
+		name string
+		// failAt is the record push fails on, -1 for none
+		failAt       int
+		wantReplayed int
+		wantErr      bool
+		wantLeft     []uint64
+	}{
+		{name: "All", failAt: -1, wantReplayed: 3},
+		{name: "RedisDown", failAt: 0, wantReplayed: 0, wantErr: true, wantLeft: []uint64{1, 2, 3}},
+		{name: "RedisDownMidway", failAt: 1, wantReplayed: 1, wantErr: true, wantLeft: []uint64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "journal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			j := newJournal(dir, "cmdqueue_0")
+			due := time.Now().Add(time.Minute).Round(0)
+			for id := uint64(1); id <= 3; id++ {
+				if err := j.append(record{CommandID: id, Command: []byte(`{"id":1}`), Due: due}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			calls := 0
+			replayed, err := j.replay(func(r record) error {
+				defer func() { calls++ }()
+				if !r.Due.Equal(due) {
+					t.Errorf("replayed Due = %v, want %v", r.Due, due)
+				}
+				if calls == tt.failAt {
+					return errors.New("redis down")
+				}
+				return nil
+			})
+			if replayed != tt.wantReplayed || (err != nil) != tt.wantErr {
+				t.Errorf("replay() = %d, %v, want %d, error %v", replayed, err, tt.wantReplayed, tt.wantErr)
+			}
+
+			var left []uint64
+			if _, err := j.replay(func(r record) error {
+				left = append(left, r.CommandID)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != len(tt.wantLeft) {
+				t.Fatalf("left %v, want %v", left, tt.wantLeft)
+			}
+			for i := range left {
+				if left[i] != tt.wantLeft[i] {
+					t.Errorf("left %v, want %v", left, tt.wantLeft)
+				}
+			}
+			if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+				t.Errorf("journal kept once replayed: %v", err)
+			}
+		})
+	}
+}
@@ -1,18 +1,23 @@
 package worker
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 
-	"github.com/qubole/edith/internal/logger"
 	"github.com/qubole/edith/pkg/command"
+
+	"httpclient"
+	"logging"
 )
 
 // PushInterface to enqueue to redis
 type PushInterface interface {
-	Push(command.Command)
+	Push(command.Command) error
 }
 
 // Codec manages pool of workers
@@ -30,8 +35,17 @@ func NewManager(servers []string, cmdManager command.Codec,options ...Option) *M
 	// apply
 	for idx, s := range servers {
 		w := newWorker(idx, s, cmdManager, options...)
+		w.owner = m.workerFor
 		m.workers = append(m.workers, w)
 	}
+	shardKeys(m.workers)
+	for _, w := range m.workers {
+		for _, peer := range m.workers {
+			if peer != w {
+				w.peers = append(w.peers, peer)
+			}
+		}
+	}
 
 	return m
 }
@@ -40,18 +54,32 @@ func NewManager(servers []string, cmdManager command.Codec,options ...Option) *M
 // labels are key, val pair .. so even in number always.
 func Logger(level string, labels ...interface{}) Option {
 	return func(w *Worker) {
-		w.logger = logger.Create(level)
+		loggers, err := logging.New(logging.Settings{Level: level}, os.Stdout)
+		if err != nil {
+			// an unknown level logs at info
+			loggers, _ = logging.New(logging.Settings{}, os.Stdout)
+		}
+		w.logger = loggers.For("worker")
 
 		labels := append(labels, "worker_id", fmt.Sprintf("%d", w.id))
 		w.logger = log.With(w.logger, labels...)
 	}
 }
 
+// BaseLogger sets the logger the worker logs through, e.g. one handed out
+// by the gateway, instead of creating one like Logger does.
+func BaseLogger(base log.Logger, labels ...interface{}) Option {
+	return func(w *Worker) {
+		labels := append(labels, "worker_id", fmt.Sprintf("%d", w.id))
+		w.logger = log.With(base, labels...)
+	}
+}
+
 // CmdQueue sets cmdQueue.
 func CmdQueue(queue string) Option {
 	return func(w *Worker) {
-		w.cmdQueue = strings.ToLower(queue) + fmt.Sprintf("_%d", w.id)
-		w.cmdQueueBackup = "_" + w.cmdQueue + "_backup_"
+		w.cmdQueueBase = strings.ToLower(queue)
+		w.cmdQueue = w.cmdQueueBase + fmt.Sprintf("_%d", w.id)
 	}
 }
 
@@ -62,6 +90,114 @@ func CmdQueueTimeout(timeout int64) Option {
 	}
 }
 
+// VisibilityTimeout sets how long a popped command may go unacked before it
+// is requeued for another worker.
+func VisibilityTimeout(timeout time.Duration) Option {
+	return func(w *Worker) {
+		if timeout > 0 {
+			w.visibilityTimeout = timeout
+		}
+	}
+}
+
+// Concurrency sets how many commands a worker processes at once.
+func Concurrency(n int) Option {
+	return func(w *Worker) {
+		if n > 0 {
+			w.concurrency = n
+		}
+	}
+}
+
+// MaxInFlight sets how many commands a worker pops ahead of processing
+// them, twice its concurrency by default.
+func MaxInFlight(n int) Option {
+	return func(w *Worker) {
+		if n > 0 {
+			w.maxInFlight = n
+		}
+	}
+}
+
+// TypeLimits sets how many commands of a type, named like "spark.App", a
+// worker processes at once. Types without a limit are only bound by
+// Concurrency.
+func TypeLimits(limits map[string]int) Option {
+	return func(w *Worker) {
+		w.typeLimits = make(map[string]int)
+		for kind, n := range limits {
+			if n > 0 {
+				w.typeLimits[kind] = n
+			}
+		}
+	}
+}
+
+// BufferSize sets how many commands a worker buffers before pushing them to
+// redis.
+func BufferSize(n int) Option {
+	return func(w *Worker) {
+		if n > 0 {
+			w.bufferSize = n
+		}
+	}
+}
+
+// PushTimeout sets how long Push waits for room in a full buffer.
+func PushTimeout(timeout time.Duration) Option {
+	return func(w *Worker) {
+		if timeout > 0 {
+			w.pushTimeout = timeout
+		}
+	}
+}
+
+// SpillToRedis makes Push write to redis directly, instead of waiting, when
+// the buffer is full.
+func SpillToRedis(spill bool) Option {
+	return func(w *Worker) {
+		w.spill = spill
+	}
+}
+
+// Journal spools the commands no redis takes to files in dir, pushed again
+// once redis recovers. Without it they are dropped.
+func Journal(dir string) Option {
+	return func(w *Worker) {
+		w.journalDir = dir
+	}
+}
+
+// CallbackRetries sets how many times, and how long apart, each delivery
+// of a callback is retried before it is left to the outbox.
+func CallbackRetries(max int, waitMin, waitMax time.Duration) Option {
+	return func(w *Worker) {
+		if max <= 0 {
+			return
+		}
+		w.callbackRetry = &httpclient.RetryOptions{
+			Max:     max,
+			WaitMin: waitMin.Seconds(),
+			WaitMax: waitMax.Seconds(),
+		}
+	}
+}
+
+// CallbackSecret signs the callbacks with HMAC-SHA256, see Sign.
+func CallbackSecret(secret string) Option {
+	return func(w *Worker) {
+		w.callbackSecret = []byte(secret)
+	}
+}
+
+// WithBackend sets how the backend of each worker is created from its
+// server and queue, redis by default.
+func WithBackend(newBackend func(server, queue string) Backend) Option {
+	return func(w *Worker) {
+		w.newBackend = newBackend
+	}
+}
+
 // RunFn type to encapsulate a goroutine.
 type RunFn func(<-chan struct{}) error
 
@@ -69,22 +205,94 @@ type RunFn func(<-chan struct{}) error
 func (m *Manager) Runnables() []RunFn {
 	var fs []RunFn
 
+	if len(m.workers) > 0 {
+		fs = append(fs, func(stop <-chan struct{}) error {
+			m.loopMigrate(stop)
+			return fmt.Errorf("worker.loopMigrate.interrupted")
+		})
+	}
 	for _, worker := range m.workers {
 		w := worker
 		fs = append(fs, func(stop <-chan struct{}) error {
 			w.loopPushCmd(stop)
 			return fmt.Errorf("worker.%d.loopPushCmd.interrupted", w.id)
 		})
+		if w.journal != nil {
+			fs = append(fs, func(stop <-chan struct{}) error {
+				w.loopReplay(stop)
+				return fmt.Errorf("worker.%d.loopReplay.interrupted", w.id)
+			})
+		}
 		fs = append(fs, func(stop <-chan struct{}) error {
-			_ = w.loopProcessCmd(stop)
-			return fmt.Errorf("worker.%d.loopProcessCmd.interrupted", w.id)
+			w.loopFetchCmd(stop)
+			return fmt.Errorf("worker.%d.loopFetchCmd.interrupted", w.id)
 		})
+		if _, ok := w.backend.(OutboxStore); ok {
+			fs = append(fs, func(stop <-chan struct{}) error {
+				w.loopOutbox(stop)
+				return fmt.Errorf("worker.%d.loopOutbox.interrupted", w.id)
+			})
+		}
+		if extender, ok := w.backend.(Extender); ok && w.visibilityTimeout > 0 {
+			fs = append(fs, func(stop <-chan struct{}) error {
+				w.loopExtend(extender, stop)
+				return fmt.Errorf("worker.%d.loopExtend.interrupted", w.id)
+			})
+		}
+		if maintainer, ok := w.backend.(Maintainer); ok {
+			fs = append(fs, func(stop <-chan struct{}) error {
+				maintainer.Maintain(stop)
+				return fmt.Errorf("worker.%d.Maintain.interrupted", w.id)
+			})
+		}
+		for i := 0; i < w.concurrency; i++ {
+			fs = append(fs, func(stop <-chan struct{}) error {
+				_ = w.loopProcessCmd(stop)
+				return fmt.Errorf("worker.%d.loopProcessCmd.interrupted", w.id)
+			})
+		}
 	}
 	return fs
 }
 
-// Push a command to worker.
-func (m *Manager) Push(cmd command.Command) {
-	idx := cmd.GetID() % uint64(len(m.workers))
-	m.workers[idx].push(cmd)
+// Push a command to worker, see PushContext.
+func (m *Manager) Push(cmd command.Command) error {
+	return m.PushContext(context.Background(), cmd)
+}
+
+// PushContext pushes a command to the worker owning it, carrying the trace
+// in ctx along with it through the queue. It returns ErrQueueFull if the
+// worker buffer stays full until ctx is done, or for PushTimeout when ctx
+// has no deadline.
+func (m *Manager) PushContext(ctx context.Context, cmd command.Command) error {
+	w := m.workerFor(cmd)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.pushTimeout)
+		defer cancel()
+	}
+	return w.push(ctx, cmd)
+}
+
+// logger of the manager, the one of its first worker.
+func (m *Manager) logger() log.Logger {
+	return m.workers[0].logger
+}
+
+// Drain waits until every worker has delivered its buffered commands,
+// including those taken off the buffer and still being pushed, or ctx is
+// done. Commands pushed while draining may not be waited for.
+func (m *Manager) Drain(ctx context.Context) error {
+	for _, w := range m.workers {
+		select {
+		case <-w.buffered.idle():
+		case <-ctx.Done():
+			pending := 0
+			for _, w := range m.workers {
+				pending += len(w.cmdChan)
+			}
+			return fmt.Errorf("worker.drain.%d.pending: %w", pending, ctx.Err())
+		}
+	}
+	return nil
 }
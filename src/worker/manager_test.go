@@ -1,8 +1,11 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	`fmt`
 	"testing"
+	"time"
 
 	`github.com/qubole/edith/pkg/apps/edith`
 	`github.com/qubole/edith/pkg/command`
@@ -36,7 +39,8 @@ func TestManager_Push(t *testing.T) {
 		stopChan := make(chan struct{})
 		exit := false
 
-		for _, fn := range tt.fields.m.Runnables() {
+		// only the push loops, the fetch loops would pop the command first
+		for _, fn := range testPushRunnables(tt.fields.m) {
 			t.Run("Runnable ", getRunnableMethod(fn, &exit, stopChan))
 		}
 
@@ -51,8 +55,7 @@ func TestManager_Push(t *testing.T) {
 			var got command.Command
 			var err error
 			for {
-				idx := tt.args.cmd.ID % uint64(len(tt.fields.m.workers))
-				got, err = tt.fields.m.workers[idx].pop()
+				got, _, err = tt.fields.m.workerFor(tt.args.cmd).pop()
 				if got != nil {
 					break
 				} else {
@@ -80,7 +83,19 @@ func testCreateManager(n int) *Manager {
 		ss = append(ss, testRedisServer)
 	}
 	cmdManager := &edith.Codec{}
-	return NewManager(ss, cmdManager, Logger("nil"))
+	return NewManager(ss, cmdManager, Logger("nil"), WithBackend(testMemoryBackend))
+}
+
+func testPushRunnables(m *Manager) []RunFn {
+	var fs []RunFn
+	for _, w := range m.workers {
+		w := w
+		fs = append(fs, func(stop <-chan struct{}) error {
+			w.loopPushCmd(stop)
+			return nil
+		})
+	}
+	return fs
 }
 
 func getRunnableMethod(fn RunFn, exit *bool, stopChan <-chan struct{}) func (t *testing.T) {
@@ -91,3 +106,45 @@ func getRunnableMethod(fn RunFn, exit *bool, stopChan <-chan struct{}) func (t *
 		}
 	}
 }
+
+// blockingBackend holds every push until release is closed.
+type blockingBackend struct {
+	*MemoryBackend
+	pushing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Push(body []byte) error {
+	b.pushing <- struct{}{}
+	<-b.release
+	return b.MemoryBackend.Push(body)
+}
+
+func TestManager_Drain(t *testing.T) {
+	backend := &blockingBackend{MemoryBackend: NewMemoryBackend(), pushing: make(chan struct{}, 1), release: make(chan struct{})}
+	m := NewManager([]string{testRedisServer}, &edith.Codec{}, Logger("nil"), WithBackend(func(_, _ string) Backend { return backend }))
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.workers[0].loopPushCmd(stop)
+
+	cmd := &edith.Command{ID: 12, Type: "spark_app", SparkApp: &spark.App{ID: 12}, Info: &command.RunInfo{Operation: "create"}}
+	if err := m.Push(cmd); err != nil {
+		t.Fatal(err)
+	}
+	// taken off the buffer, not delivered yet
+	<-backend.pushing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Manager.Drain() while delivering error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(backend.release)
+	if err := m.Drain(context.Background()); err != nil {
+		t.Errorf("Manager.Drain() once delivered error = %v", err)
+	}
+	if queued, _ := backend.Len(); queued != 1 {
+		t.Errorf("queued %d commands once drained, want 1", queued)
+	}
+}
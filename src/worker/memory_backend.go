@@ -0,0 +1,310 @@
+package worker
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBackend queues commands in memory, for tests and running without
+// redis. Commands are lost when the process exits.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	queue   [][]byte
+	delayed []delayedMessage
+	held    map[string][]byte
+	receipt int
+	traces  map[uint64][]byte
+	dead    map[string][]byte
+	// deadOrder lists the dead letter ids, oldest first.
+	deadOrder []string
+	outbox    map[string][]byte
+	states    map[uint64]string
+	runs      map[uint64]int
+	histories map[uint64][][]byte
+	// changed is closed, and replaced, whenever a message is pushed.
+	changed chan struct{}
+}
+
+type delayedMessage struct {
+	body []byte
+	due  time.Time
+}
+
+// NewMemoryBackend is constructor for MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		held:      make(map[string][]byte),
+		traces:    make(map[uint64][]byte),
+		dead:      make(map[string][]byte),
+		outbox:    make(map[string][]byte),
+		states:    make(map[uint64]string),
+		runs:      make(map[uint64]int),
+		histories: make(map[uint64][][]byte),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Push appends body to the queue.
+func (b *MemoryBackend) Push(body []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue = append(b.queue, body)
+	b.notify()
+	return nil
+}
+
+// PushAt makes body available to Pop once due.
+func (b *MemoryBackend) PushAt(body []byte, due time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delayed = append(b.delayed, delayedMessage{body: body, due: due})
+	sort.SliceStable(b.delayed, func(i, j int) bool { return b.delayed[i].due.Before(b.delayed[j].due) })
+	b.notify()
+	return nil
+}
+
+// Pop waits up to timeout for a message.
+func (b *MemoryBackend) Pop(timeout time.Duration) (Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		for len(b.delayed) > 0 && !b.delayed[0].due.After(now) {
+			b.queue = append(b.queue, b.delayed[0].body)
+			b.delayed = b.delayed[1:]
+		}
+		if len(b.queue) > 0 {
+			body := b.queue[0]
+			b.queue = b.queue[1:]
+			b.receipt++
+			receipt := strconv.Itoa(b.receipt)
+			b.held[receipt] = body
+			b.mu.Unlock()
+			return Message{Body: body, Receipt: receipt}, nil
+		}
+
+		wait := deadline.Sub(now)
+		if len(b.delayed) > 0 && b.delayed[0].due.Sub(now) < wait {
+			wait = b.delayed[0].due.Sub(now)
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		if wait <= 0 {
+			return Message{}, ErrEmptyQueue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Ack removes a popped message for good.
+func (b *MemoryBackend) Ack(m Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.held, m.Receipt)
+	return nil
+}
+
+// Nack gives a popped message back, ahead of the others unless delayed.
+func (b *MemoryBackend) Nack(m Message, delay time.Duration) error {
+	b.mu.Lock()
+	body, ok := b.held[m.Receipt]
+	delete(b.held, m.Receipt)
+	if ok && delay <= 0 {
+		b.queue = append([][]byte{body}, b.queue...)
+		b.notify()
+	}
+	b.mu.Unlock()
+
+	if ok && delay > 0 {
+		return b.PushAt(body, time.Now().Add(delay))
+	}
+	return nil
+}
+
+// Len returns how many messages are queued, delayed included, and held.
+func (b *MemoryBackend) Len() (queued, held int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue) + len(b.delayed), len(b.held)
+}
+
+// StoreTrace keeps the trace of command id.
+func (b *MemoryBackend) StoreTrace(id uint64, carrier []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.traces[id] = carrier
+	return nil
+}
+
+// Trace of command id, nil when there is none.
+func (b *MemoryBackend) Trace(id uint64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.traces[id], nil
+}
+
+// AddDeadLetter stores entry as dead letter id.
+func (b *MemoryBackend) AddDeadLetter(id string, entry []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dead[id] = entry
+	b.deadOrder = append(b.deadOrder, id)
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters from offset, newest first,
+// along with how many there are.
+func (b *MemoryBackend) DeadLetters(offset, limit int) ([][]byte, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := len(b.deadOrder)
+	entries := [][]byte{}
+	for i := total - 1 - offset; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, b.dead[b.deadOrder[i]])
+	}
+	return entries, total, nil
+}
+
+// DeadLetter returns dead letter id.
+func (b *MemoryBackend) DeadLetter(id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.dead[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return entry, nil
+}
+
+// RequeueDeadLetter replaces dead letter id by body, popped once due.
+func (b *MemoryBackend) RequeueDeadLetter(id string, body []byte, due time.Time) error {
+	b.mu.Lock()
+	removed := b.removeDead(id)
+	b.mu.Unlock()
+	if !removed {
+		return ErrDeadLetterNotFound
+	}
+	return b.PushAt(body, due)
+}
+
+// PurgeDeadLetter deletes dead letter id.
+func (b *MemoryBackend) PurgeDeadLetter(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.removeDead(id) {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// PurgeDeadLetters deletes every dead letter, returning how many there
+// were.
+func (b *MemoryBackend) PurgeDeadLetters() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	purged := len(b.dead)
+	b.dead = make(map[string][]byte)
+	b.deadOrder = nil
+	return purged, nil
+}
+
+// removeDead deletes dead letter id, with b.mu held.
+func (b *MemoryBackend) removeDead(id string) bool {
+	if _, ok := b.dead[id]; !ok {
+		return false
+	}
+	delete(b.dead, id)
+	for i, deadID := range b.deadOrder {
+		if deadID == id {
+			b.deadOrder = append(b.deadOrder[:i:i], b.deadOrder[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// PutCallback adds entry, or replaces the entry with the same key.
+func (b *MemoryBackend) PutCallback(key string, entry []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outbox[key] = entry
+	return nil
+}
+
+// Callbacks returns every undelivered callback.
+func (b *MemoryBackend) Callbacks() ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := make([][]byte, 0, len(b.outbox))
+	for _, entry := range b.outbox {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// RemoveCallback deletes callback key.
+func (b *MemoryBackend) RemoveCallback(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.outbox, key)
+	return nil
+}
+
+// State returns the state of command id, empty when unknown.
+func (b *MemoryBackend) State(id uint64) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.states[id], nil
+}
+
+// AddTransition moves command id from state from to state to and appends
+// entry to its history.
+func (b *MemoryBackend) AddTransition(id uint64, from, to string, entry []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current, ok := b.states[id]; ok && current != from {
+		return ErrStateConflict
+	}
+	b.states[id] = to
+	b.histories[id] = append(b.histories[id], entry)
+	return nil
+}
+
+// Run returns how many times command id was run again.
+func (b *MemoryBackend) Run(id uint64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.runs[id], nil
+}
+
+// NewRun starts another run of command id and appends entry to its
+// history.
+func (b *MemoryBackend) NewRun(id uint64, entry []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.runs[id]++
+	delete(b.states, id)
+	b.histories[id] = append(b.histories[id], entry)
+	return b.runs[id], nil
+}
+
+// History returns the transitions of command id, oldest first.
+func (b *MemoryBackend) History(id uint64) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte{}, b.histories[id]...), nil
+}
+
+// notify wakes up the goroutines waiting in Pop, with b.mu held.
+func (b *MemoryBackend) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	tests := []struct {
+		name string
+		// run pushes and pops on b, returning the bodies popped in order
+		run  func(t *testing.T, b *MemoryBackend) []string
+		want []string
+	}{
+		{
+			name: "fifo",
+			run: func(t *testing.T, b *MemoryBackend) []string {
+				b.Push([]byte("a"))
+				b.Push([]byte("b"))
+				return testPopAll(t, b)
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "nack goes first",
+			run: func(t *testing.T, b *MemoryBackend) []string {
+				b.Push([]byte("a"))
+				b.Push([]byte("b"))
+				m, _ := b.Pop(0)
+				b.Nack(m, 0)
+				return testPopAll(t, b)
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "acked is gone",
+			run: func(t *testing.T, b *MemoryBackend) []string {
+				b.Push([]byte("a"))
+				m, _ := b.Pop(0)
+				b.Ack(m)
+				b.Nack(m, 0)
+				return testPopAll(t, b)
+			},
+			want: nil,
+		},
+		{
+			name: "delayed once due",
+			run: func(t *testing.T, b *MemoryBackend) []string {
+				b.PushAt([]byte("later"), time.Now().Add(20*time.Millisecond))
+				b.PushAt([]byte("never"), time.Now().Add(time.Hour))
+				b.Push([]byte("now"))
+				got := testPopAll(t, b)
+				m, err := b.Pop(time.Second)
+				if err != nil {
+					t.Fatalf("MemoryBackend.Pop() error = %v, want the delayed message", err)
+				}
+				return append(got, string(m.Body))
+			},
+			want: []string{"now", "later"},
+		},
+		{
+			name: "nack with delay",
+			run: func(t *testing.T, b *MemoryBackend) []string {
+				b.Push([]byte("a"))
+				m, _ := b.Pop(0)
+				b.Nack(m, time.Hour)
+				return testPopAll(t, b)
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.run(t, NewMemoryBackend())
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("popped %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBackend_deadLetters(t *testing.T) {
+	b := NewMemoryBackend()
+	b.AddDeadLetter("1", []byte("one"))
+	b.AddDeadLetter("2", []byte("two"))
+
+	entries, total, _ := b.DeadLetters(0, 10)
+	if len(entries) != 2 || total != 2 || string(entries[0]) != "two" {
+		t.Fatalf("MemoryBackend.DeadLetters() = %q, %d, want newest first", entries, total)
+	}
+	if entries, total, _ := b.DeadLetters(1, 10); len(entries) != 1 || total != 2 || string(entries[0]) != "one" {
+		t.Fatalf("MemoryBackend.DeadLetters() from 1 = %q, %d, want [one] of 2", entries, total)
+	}
+	if err := b.RequeueDeadLetter("1", []byte("cmd"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RequeueDeadLetter("1", []byte("cmd"), time.Now()); err != ErrDeadLetterNotFound {
+		t.Errorf("MemoryBackend.RequeueDeadLetter() twice error = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+	if got := testPopAll(t, b); len(got) != 1 || got[0] != "cmd" {
+		t.Errorf("requeued %q, want [cmd]", got)
+	}
+	if purged, _ := b.PurgeDeadLetters(); purged != 1 {
+		t.Errorf("MemoryBackend.PurgeDeadLetters() = %d, want 1", purged)
+	}
+}
+
+// testPopAll pops and acks what is queued without waiting.
+func testPopAll(t *testing.T, b *MemoryBackend) []string {
+	var got []string
+	for {
+		m, err := b.Pop(0)
+		if err == ErrEmptyQueue {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Ack(m)
+		got = append(got, string(m.Body))
+	}
+}
@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/qubole/edith/pkg/command"
+)
+
+// task is a popped command waiting to be, or being, processed.
+type task struct {
+	cmd command.Command
+	// msg is the command as popped, to ack it once processed.
+	msg Message
+	// kind is the command type, see commandKind.
+	kind string
+}
+
+// commandKind names the type of cmd as its Go type, e.g. "spark.App", empty
+// when it has none.
+func commandKind(cmd command.Command) string {
+	t, err := cmd.GetType()
+	if err != nil || t == nil {
+		return ""
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", t), "*")
+}
+
+// pool hands the popped commands of a worker to its processing goroutines.
+// At most maxInFlight commands are popped and not yet processed, a command
+// type runs at most its limit at once, types take turns, and commands with
+// the same ID run one at a time in the order they were popped, whichever
+// their type.
+type pool struct {
+	mu          sync.Mutex
+	maxInFlight int
+	limits      map[string]int
+	inFlight    int
+	running     map[string]int
+	busy        map[uint64]bool
+	ready       map[string][]*task
+	// waiting lists the tasks not taken yet by ID, in the order they were
+	// added.
+	waiting map[uint64][]*task
+	// held are the tasks added and not done yet, taken or not.
+	held map[*task]bool
+	// kinds in the order they take turns.
+	kinds []string
+	turn  int
+	// changed is closed, and replaced, whenever a task is added or done.
+	changed chan struct{}
+}
+
+func newPool(maxInFlight int, limits map[string]int) *pool {
+	return &pool{
+		maxInFlight: maxInFlight,
+		limits:      limits,
+		running:     make(map[string]int),
+		busy:        make(map[uint64]bool),
+		ready:       make(map[string][]*task),
+		waiting:     make(map[uint64][]*task),
+		held:        make(map[*task]bool),
+		changed:     make(chan struct{}),
+	}
+}
+
+// waitRoom blocks until another command may be popped, false if stopped
+// first.
+func (p *pool) waitRoom(stop <-chan struct{}) bool {
+	for {
+		p.mu.Lock()
+		room, changed := p.inFlight < p.maxInFlight, p.changed
+		p.mu.Unlock()
+		if room {
+			return true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// add a popped task.
+func (p *pool) add(t *task) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.running[t.kind]; !ok {
+		p.running[t.kind] = 0
+		p.kinds = append(p.kinds, t.kind)
+	}
+	p.ready[t.kind] = append(p.ready[t.kind], t)
+	p.waiting[t.cmd.GetID()] = append(p.waiting[t.cmd.GetID()], t)
+	p.held[t] = true
+	p.inFlight++
+	p.notify()
+}
+
+// take blocks until a task may run, nil if stopped first. The task must be
+// handed back to done.
+func (p *pool) take(stop <-chan struct{}) *task {
+	for {
+		p.mu.Lock()
+		t, changed := p.next(), p.changed
+		p.mu.Unlock()
+		if t != nil {
+			return t
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// next returns the first runnable task of the next kind under its limit.
+func (p *pool) next() *task {
+	for i := range p.kinds {
+		kind := p.kinds[(p.turn+i)%len(p.kinds)]
+		if limit, ok := p.limits[kind]; ok && p.running[kind] >= limit {
+			continue
+		}
+
+		queue := p.ready[kind]
+		for j, t := range queue {
+			id := t.cmd.GetID()
+			// an earlier task of the ID, of any type, has to run first
+			if p.busy[id] || p.waiting[id][0] != t {
+				continue
+			}
+			p.ready[kind] = append(queue[:j:j], queue[j+1:]...)
+			p.unwait(t)
+			p.running[kind]++
+			p.busy[id] = true
+			p.turn = (p.turn + i + 1) % len(p.kinds)
+			return t
+		}
+	}
+	return nil
+}
+
+// done releases a task returned by take.
+func (p *pool) done(t *task) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running[t.kind]--
+	delete(p.busy, t.cmd.GetID())
+	delete(p.held, t)
+	p.inFlight--
+	p.notify()
+}
+
+// drain removes and returns the tasks not taken yet.
+func (p *pool) drain() []*task {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var drained []*task
+	for kind, queue := range p.ready {
+		for _, t := range queue {
+			p.unwait(t)
+			delete(p.held, t)
+		}
+		drained = append(drained, queue...)
+		p.inFlight -= len(queue)
+		delete(p.ready, kind)
+	}
+	p.notify()
+	return drained
+}
+
+// messages returns the messages of the tasks held, taken or not.
+func (p *pool) messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	messages := make([]Message, 0, len(p.held))
+	for t := range p.held {
+		messages = append(messages, t.msg)
+	}
+	return messages
+}
+
+// unwait removes t from the tasks waiting for its ID, with p.mu held.
+func (p *pool) unwait(t *task) {
+	id := t.cmd.GetID()
+	for i, w := range p.waiting[id] {
+		if w == t {
+			p.waiting[id] = append(p.waiting[id][:i:i], p.waiting[id][i+1:]...)
+			break
+		}
+	}
+	if len(p.waiting[id]) == 0 {
+		delete(p.waiting, id)
+	}
+}
+
+// notify wakes up the goroutines waiting on the pool, with p.mu held.
+func (p *pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
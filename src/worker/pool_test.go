@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/qubole/edith/pkg/command"
+)
+
+type poolCommand struct {
+	id uint64
+}
+
+func (c poolCommand) GetID() uint64                  { return c.id }
+func (c poolCommand) GetType() (command.Type, error) { return nil, fmt.Errorf("no type") }
+func (c poolCommand) RunInfo() *command.RunInfo      { return &command.RunInfo{} }
+func (c poolCommand) String() string                 { return fmt.Sprintf("%d", c.id) }
+
+func poolTask(id uint64, kind string) *task {
+	return &task{cmd: poolCommand{id: id}, msg: Message{Receipt: fmt.Sprintf("%s-%d", kind, id)}, kind: kind}
+}
+
+func TestPool_take(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits map[string]int
+		added  []*task
+		// takes before the first task taken is done
+		want []string
+	}{
+		{
+			name:  "SameIDInOrder",
+			added: []*task{poolTask(1, "a"), poolTask(1, "a"), poolTask(2, "a")},
+			want:  []string{"a-1", "a-2"},
+		},
+		{
+			name:   "SameIDAcrossTypes",
+			limits: map[string]int{"a": 1},
+			added:  []*task{poolTask(2, "a"), poolTask(1, "a"), poolTask(1, "b")},
+			want:   []string{"a-2"},
+		},
+		{
+			name:   "TypeLimit",
+			limits: map[string]int{"a": 1},
+			added:  []*task{poolTask(1, "a"), poolTask(2, "a"), poolTask(3, "b")},
+			want:   []string{"a-1", "b-3"},
+		},
+		{
+			name:  "TypesTakeTurns",
+			added: []*task{poolTask(1, "a"), poolTask(2, "a"), poolTask(3, "a"), poolTask(4, "b"), poolTask(5, "b")},
+			want:  []string{"a-1", "b-4", "a-2", "b-5", "a-3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := make(chan struct{})
+			close(stop)
+			p := newPool(len(tt.added), tt.limits)
+			for _, task := range tt.added {
+				p.add(task)
+			}
+
+			var got []string
+			for task := p.take(stop); task != nil; task = p.take(stop) {
+				got = append(got, task.msg.Receipt)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("take() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_done(t *testing.T) {
+	stop := make(chan struct{})
+	p := newPool(2, nil)
+	p.add(poolTask(1, "a"))
+	p.add(poolTask(1, "a"))
+
+	closed := make(chan struct{})
+	close(closed)
+	if p.waitRoom(closed) {
+		t.Fatal("waitRoom() = true with maxInFlight tasks, want false")
+	}
+
+	first := p.take(stop)
+	taken := make(chan *task)
+	go func() { taken <- p.take(stop) }()
+
+	p.done(first)
+	if second := <-taken; second == nil || second == first {
+		t.Errorf("take() after done = %v, want the second task of ID 1", second)
+	}
+	if !p.waitRoom(closed) {
+		t.Error("waitRoom() = false after done, want true")
+	}
+}
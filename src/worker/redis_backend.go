@@ -0,0 +1,822 @@
+package worker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-redis/redis"
+)
+
+// redisBackend queues commands in a redis list. Popped commands move to the
+// backup list of the consumer which popped them until acked, and go back to
+// the queue if not acked within the visibility timeout, or once the
+// consumer stops beating. Delayed commands wait in a sorted set scored by
+// when they are due in unix milliseconds.
+type redisBackend struct {
+	// receipts numbers the pops of the consumer, first for 64-bit alignment.
+	receipts uint64
+	client   *redis.Client
+	server   string
+	// base is the name the queues of every server derive from.
+	base  string
+	queue string
+	// consumer identifies the process popping from queue, among the ones
+	// sharing it.
+	consumer          string
+	backup            string
+	visibilityTimeout time.Duration
+	logger            log.Logger
+}
+
+func newRedisBackend(server, base, queue string, visibilityTimeout time.Duration, logger log.Logger) *redisBackend {
+	b := &redisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr: server,
+		}),
+		server:            server,
+		base:              base,
+		queue:             queue,
+		consumer:          newConsumerID(),
+		visibilityTimeout: visibilityTimeout,
+		logger:            logger,
+	}
+	b.backup = b.backupKey(b.consumer)
+	return b
+}
+
+// newConsumerID returns an ID unique to this backend, readable enough to
+// tell which host a backup list belongs to.
+func newConsumerID() string {
+	host, _ := os.Hostname()
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// Push appends body on the right, Pop takes from the left to keep FIFO
+// order.
+func (b *redisBackend) Push(body []byte) error {
+	return b.client.RPush(b.queue, body).Err()
+}
+
+// PushAt adds body to the delayed set, Maintain moves it to the queue once
+// due.
+func (b *redisBackend) PushAt(body []byte, due time.Time) error {
+	return b.client.ZAdd(b.delayedKey(), redis.Z{Score: unixMilli(due), Member: body}).Err()
+}
+
+// Pop moves a command from the queue to the backup list of the consumer,
+// where it stays until acked so that a crash mid-run does not lose it. The
+// receipt is unique to the pop, identical commands popped at once are
+// acked and recovered apart. BLMOVE needs redis 6.2.
+func (b *redisBackend) Pop(timeout time.Duration) (Message, error) {
+	// the client waits for the reply of a command it has no helper for
+	// within its read timeout only, BLMOVE blocks for less
+	if limit := b.client.Options().ReadTimeout - time.Second; timeout <= 0 || timeout > limit {
+		timeout = limit
+	}
+	raw, err := b.client.Do("blmove", b.queue, b.backup, "LEFT", "RIGHT", timeout.Seconds()).String()
+	if err == redis.Nil {
+		return Message{}, ErrEmptyQueue
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	receipt := strconv.FormatUint(atomic.AddUint64(&b.receipts, 1), 10)
+	now := time.Now()
+	_, err = b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(b.receiptsKey(b.consumer), receipt, raw)
+		pipe.ZAdd(b.deadlinesKey(b.consumer), redis.Z{Score: unixMilli(now.Add(b.visibilityTimeout)), Member: receipt})
+		pipe.ZAdd(b.consumersKey(), redis.Z{Score: unixMilli(now), Member: b.consumer})
+		return nil
+	})
+	if err != nil {
+		// still recovered along with the backup list should the consumer die
+		_ = level.Error(b.logger).Log("method", "Pop", "context", "receipt", "error", err)
+	}
+	return Message{Body: []byte(raw), Receipt: receipt}, nil
+}
+
+// ackScript removes the command ARGV[2] of receipt ARGV[1] from the backup
+// list KEYS[1], its receipts KEYS[2] and deadlines KEYS[3].
+var ackScript = redis.NewScript(`
+redis.call("LREM", KEYS[1], 1, ARGV[2])
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+// Ack removes a processed command from the backup list.
+func (b *redisBackend) Ack(m Message) error {
+	keys := []string{b.backup, b.receiptsKey(b.consumer), b.deadlinesKey(b.consumer)}
+	return ackScript.Run(b.client, keys, m.Receipt, m.Body).Err()
+}
+
+// Extend hides a popped command for another visibility timeout, for a
+// command still being processed not to be recovered.
+func (b *redisBackend) Extend(m Message) error {
+	deadline := unixMilli(time.Now().Add(b.visibilityTimeout))
+	return b.client.ZAddXX(b.deadlinesKey(b.consumer), redis.Z{Score: deadline, Member: m.Receipt}).Err()
+}
+
+// nackScript moves the backed up command of receipt ARGV[1], or ARGV[2]
+// when it has none, to the pop end of the queue, or to the delayed set when
+// ARGV[3] is a due time, unless it was acked in the meantime.
+var nackScript = redis.NewScript(`
+local raw = redis.call("HGET", KEYS[2], ARGV[1]) or ARGV[2]
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+if raw ~= "" and redis.call("LREM", KEYS[1], 1, raw) == 1 then
+	if ARGV[3] == "" then
+		redis.call("LPUSH", KEYS[4], raw)
+	else
+		redis.call("ZADD", KEYS[5], ARGV[3], raw)
+	end
+	return 1
+end
+return 0
+`)
+
+// Nack gives a popped command back to the queue, ahead of the others unless
+// delayed.
+func (b *redisBackend) Nack(m Message, delay time.Duration) error {
+	_, err := b.nack(m.Receipt, string(m.Body), delay)
+	return err
+}
+
+// nack gives back the command of receipt, raw when the receipt is not
+// recorded, 0 if it was acked already.
+func (b *redisBackend) nack(receipt, raw string, delay time.Duration) (int, error) {
+	due := ""
+	if delay > 0 {
+		due = strconv.FormatInt(int64(unixMilli(time.Now().Add(delay))), 10)
+	}
+	keys := []string{b.backup, b.receiptsKey(b.consumer), b.deadlinesKey(b.consumer), b.queue, b.delayedKey()}
+	return nackScript.Run(b.client, keys, receipt, raw, due).Int()
+}
+
+// claimScript moves the command ARGV[1] from the list, or the sorted set
+// when ARGV[4] is "1", KEYS[1] to the backup list KEYS[2] as if popped, with
+// receipt ARGV[2] in KEYS[3] hidden until ARGV[3] in KEYS[4], unless
+// another consumer took it in the meantime.
+var claimScript = redis.NewScript(`
+local removed
+if ARGV[4] == "1" then
+	removed = redis.call("ZREM", KEYS[1], ARGV[1])
+else
+	removed = redis.call("LREM", KEYS[1], 1, ARGV[1])
+end
+if removed == 0 then
+	return 0
+end
+redis.call("RPUSH", KEYS[2], ARGV[1])
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[1])
+redis.call("ZADD", KEYS[4], ARGV[3], ARGV[2])
+return 1
+`)
+
+// claim atomically takes raw out of the list, or the sorted set when
+// sorted, key on the server of b and holds it in the backup list of the
+// consumer until acked, false if another consumer took it first. A command
+// claimed by a consumer which dies is requeued on the queue of b.
+func (b *redisBackend) claim(key, raw string, sorted bool) (Message, bool, error) {
+	receipt := strconv.FormatUint(atomic.AddUint64(&b.receipts, 1), 10)
+	deadline := int64(unixMilli(time.Now().Add(b.visibilityTimeout)))
+	set := "0"
+	if sorted {
+		set = "1"
+	}
+	keys := []string{key, b.backup, b.receiptsKey(b.consumer), b.deadlinesKey(b.consumer)}
+	claimed, err := claimScript.Run(b.client, keys, raw, receipt, deadline, set).Int()
+	if err != nil || claimed == 0 {
+		return Message{}, false, err
+	}
+	return Message{Body: []byte(raw), Receipt: receipt}, true, nil
+}
+
+// forQueue returns a backend for another queue on the server of b, to
+// recover the commands its consumers left behind.
+func (b *redisBackend) forQueue(queue string) *redisBackend {
+	other := &redisBackend{
+		client:            b.client,
+		server:            b.server,
+		base:              b.base,
+		queue:             queue,
+		consumer:          b.consumer,
+		visibilityTimeout: b.visibilityTimeout,
+		logger:            b.logger,
+	}
+	other.backup = other.backupKey(other.consumer)
+	return other
+}
+
+// backupKey is the list of commands popped by consumer and not acked yet.
+// The one of no consumer is shared by the workers predating consumers.
+func (b *redisBackend) backupKey(consumer string) string {
+	return "_" + b.queue + "_backup_" + consumer
+}
+
+// receiptsKey is the hash of the commands backed up by consumer by
+// receipt.
+func (b *redisBackend) receiptsKey(consumer string) string {
+	return b.backupKey(consumer) + "_receipts"
+}
+
+// deadlinesKey is the sorted set of the receipts of consumer scored by when
+// they become visible again in unix milliseconds.
+func (b *redisBackend) deadlinesKey(consumer string) string {
+	return b.backupKey(consumer) + "_deadlines"
+}
+
+// consumersKey is the sorted set of the consumers of the queue scored by
+// when they last beat in unix milliseconds.
+func (b *redisBackend) consumersKey() string {
+	return "_" + b.queue + "_consumers"
+}
+
+// delayedKey is the sorted set of delayed commands.
+func (b *redisBackend) delayedKey() string {
+	return b.queue + "_delayed"
+}
+
+// Maintain moves due delayed commands to the queue, beats for the consumer,
+// and requeues stale commands on start and then every visibility timeout.
+func (b *redisBackend) Maintain(stop <-chan struct{}) {
+	schedule := time.NewTicker(scheduleInterval)
+	defer schedule.Stop()
+	beat := time.NewTicker(b.visibilityTimeout / 4)
+	defer beat.Stop()
+	stale := time.NewTicker(b.visibilityTimeout)
+	defer stale.Stop()
+
+	b.heartbeat()
+	b.requeueStale()
+	for {
+		select {
+		case <-stop:
+			_ = level.Info(b.logger).Log("method", "Maintain", "status", "exit", "redis_server", b.server)
+			return
+		case now := <-schedule.C:
+			if _, err := b.schedule(now); err != nil {
+				_ = level.Error(b.logger).Log("method", "Maintain", "context", "schedule", "error", err)
+			}
+		case <-beat.C:
+			b.heartbeat()
+		case <-stale.C:
+			b.requeueStale()
+		}
+	}
+}
+
+// heartbeat tells the other consumers this one is alive.
+func (b *redisBackend) heartbeat() {
+	if err := b.client.ZAdd(b.consumersKey(), redis.Z{Score: unixMilli(time.Now()), Member: b.consumer}).Err(); err != nil {
+		_ = level.Error(b.logger).Log("method", "Maintain", "context", "heartbeat", "error", err)
+	}
+}
+
+func (b *redisBackend) requeueStale() {
+	now := time.Now()
+	recovered, err := b.recoverStale(now)
+	b.requeued("recoverStale", recovered, err)
+	recovered, err = b.recoverConsumers(now)
+	b.requeued("recoverConsumers", recovered, err)
+	recovered, err = b.recoverLegacy(now)
+	b.requeued("recoverLegacy", recovered, err)
+}
+
+func (b *redisBackend) requeued(context string, recovered int, err error) {
+	if err != nil {
+		_ = level.Error(b.logger).Log("method", "Maintain", "context", context, "error", err)
+	} else if recovered > 0 {
+		_ = level.Warn(b.logger).Log("method", "Maintain", "context", context, "requeued", recovered)
+	}
+}
+
+// recoverStale requeues the commands of the consumer which have not been
+// acked nor extended within the visibility timeout.
+func (b *redisBackend) recoverStale(now time.Time) (int, error) {
+	receipts, err := b.client.ZRangeByScore(b.deadlinesKey(b.consumer), redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(int64(unixMilli(now)), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for _, receipt := range receipts {
+		moved, err := b.nack(receipt, "", 0)
+		if err != nil {
+			return recovered, err
+		}
+		recovered += moved
+	}
+	return recovered, nil
+}
+
+// recoverConsumerScript moves the backup list KEYS[2] of consumer ARGV[1]
+// to the pop end of the queue KEYS[5], oldest first, and forgets the
+// consumer, unless it beat after ARGV[2] in the meantime.
+var recoverConsumerScript = redis.NewScript(`
+local beat = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if beat and tonumber(beat) > tonumber(ARGV[2]) then
+	return -1
+end
+local moved = 0
+local raw = redis.call("RPOP", KEYS[2])
+while raw do
+	redis.call("LPUSH", KEYS[5], raw)
+	moved = moved + 1
+	raw = redis.call("RPOP", KEYS[2])
+end
+redis.call("DEL", KEYS[3], KEYS[4])
+redis.call("ZREM", KEYS[1], ARGV[1])
+return moved
+`)
+
+// recoverConsumers requeues the commands of the consumers which have not
+// beaten within the visibility timeout, their process having likely died.
+func (b *redisBackend) recoverConsumers(now time.Time) (int, error) {
+	cutoff := strconv.FormatInt(int64(unixMilli(now.Add(-b.visibilityTimeout))), 10)
+	consumers, err := b.client.ZRangeByScore(b.consumersKey(), redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for _, consumer := range consumers {
+		if consumer == b.consumer {
+			continue
+		}
+		keys := []string{b.consumersKey(), b.backupKey(consumer), b.receiptsKey(consumer), b.deadlinesKey(consumer), b.queue}
+		moved, err := recoverConsumerScript.Run(b.client, keys, consumer, cutoff).Int()
+		if err != nil {
+			return recovered, err
+		}
+		if moved > 0 {
+			recovered += moved
+		}
+	}
+	return recovered, nil
+}
+
+// legacyNackScript moves the command ARGV[1] of the shared backup list
+// KEYS[1] to the pop end of the queue KEYS[3] and forgets when it was
+// popped, unless it was acked in the meantime.
+var legacyNackScript = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 1 then
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	redis.call("LPUSH", KEYS[3], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// recoverLegacy requeues the commands which have been in the backup list
+// shared by the workers predating consumers for longer than the visibility
+// timeout, so that none is lost while they are rolled out.
+func (b *redisBackend) recoverLegacy(now time.Time) (int, error) {
+	backup := b.backupKey("")
+	times := backup + "times"
+	entries, err := b.client.LRange(backup, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for _, raw := range entries {
+		popped, err := b.client.HGet(times, raw).Int64()
+		if err == redis.Nil {
+			// popped before the time was recorded, give it a full
+			// visibility timeout from here
+			b.client.HSetNX(times, raw, now.Unix())
+			continue
+		}
+		if err != nil {
+			return recovered, err
+		}
+		if now.Sub(time.Unix(popped, 0)) < b.visibilityTimeout {
+			continue
+		}
+
+		moved, err := legacyNackScript.Run(b.client, []string{backup, times, b.queue}, raw).Int()
+		if err != nil {
+			return recovered, err
+		}
+		recovered += moved
+	}
+	return recovered, nil
+}
+
+// scheduleScript moves up to ARGV[2] commands due by ARGV[1] from the
+// delayed set to the queue.
+var scheduleScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, raw in ipairs(due) do
+	redis.call("ZREM", KEYS[1], raw)
+	redis.call("RPUSH", KEYS[2], raw)
+end
+return #due
+`)
+
+// schedule moves the due delayed commands to the queue.
+func (b *redisBackend) schedule(now time.Time) (int, error) {
+	moved := 0
+	for {
+		n, err := scheduleScript.Run(b.client, []string{b.delayedKey(), b.queue}, int64(unixMilli(now)), scheduleBatch).Int()
+		moved += n
+		if err != nil || n < scheduleBatch {
+			return moved, err
+		}
+	}
+}
+
+func (b *redisBackend) traceKey(id uint64) string {
+	return b.queue + "_trace_" + strconv.FormatUint(id, 10)
+}
+
+// StoreTrace keeps the trace for traceTTL.
+func (b *redisBackend) StoreTrace(id uint64, carrier []byte) error {
+	return b.client.Set(b.traceKey(id), carrier, traceTTL).Err()
+}
+
+// Trace of command id, nil when there is none.
+func (b *redisBackend) Trace(id uint64) ([]byte, error) {
+	carrier, err := b.client.Get(b.traceKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return carrier, err
+}
+
+// deadKey is the list of dead letter ids, newest first.
+func (b *redisBackend) deadKey() string {
+	return b.queue + "_dead"
+}
+
+// deadEntriesKey is the hash of dead letters by id.
+func (b *redisBackend) deadEntriesKey() string {
+	return b.queue + "_dead_entries"
+}
+
+// AddDeadLetter stores entry as dead letter id.
+func (b *redisBackend) AddDeadLetter(id string, entry []byte) error {
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(b.deadEntriesKey(), id, entry)
+		pipe.LPush(b.deadKey(), id)
+		return nil
+	})
+	return err
+}
+
+// DeadLetters returns up to limit dead letters from offset, newest first,
+// along with how many there are.
+func (b *redisBackend) DeadLetters(offset, limit int) ([][]byte, int, error) {
+	if limit <= 0 {
+		total, err := b.client.LLen(b.deadKey()).Result()
+		return nil, int(total), err
+	}
+	var total *redis.IntCmd
+	var page *redis.StringSliceCmd
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		total = pipe.LLen(b.deadKey())
+		page = pipe.LRange(b.deadKey(), int64(offset), int64(offset+limit-1))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	ids := page.Val()
+	if len(ids) == 0 {
+		return nil, int(total.Val()), nil
+	}
+	values, err := b.client.HMGet(b.deadEntriesKey(), ids...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([][]byte, 0, len(values))
+	for _, value := range values {
+		// purged since the ids were listed
+		if s, ok := value.(string); ok {
+			entries = append(entries, []byte(s))
+		}
+	}
+	return entries, int(total.Val()), nil
+}
+
+// DeadLetter returns dead letter id.
+func (b *redisBackend) DeadLetter(id string) ([]byte, error) {
+	entry, err := b.client.HGet(b.deadEntriesKey(), id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrDeadLetterNotFound
+	}
+	return entry, err
+}
+
+// requeueDeadScript moves dead letter ARGV[1] back to the delayed set as
+// command ARGV[2] due at ARGV[3], unless it was requeued or purged in the
+// meantime.
+var requeueDeadScript = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 1 then
+	redis.call("LREM", KEYS[2], 1, ARGV[1])
+	redis.call("ZADD", KEYS[3], ARGV[3], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// RequeueDeadLetter atomically replaces dead letter id by body, moved to
+// the queue once due.
+func (b *redisBackend) RequeueDeadLetter(id string, body []byte, due time.Time) error {
+	keys := []string{b.deadEntriesKey(), b.deadKey(), b.delayedKey()}
+	moved, err := requeueDeadScript.Run(b.client, keys, id, body, int64(unixMilli(due))).Int()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// PurgeDeadLetter deletes dead letter id.
+func (b *redisBackend) PurgeDeadLetter(id string) error {
+	var deleted *redis.IntCmd
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		deleted = pipe.HDel(b.deadEntriesKey(), id)
+		pipe.LRem(b.deadKey(), 1, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted.Val() == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// PurgeDeadLetters deletes every dead letter, returning how many there
+// were.
+func (b *redisBackend) PurgeDeadLetters() (int, error) {
+	var count *redis.IntCmd
+	_, err := b.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		count = pipe.HLen(b.deadEntriesKey())
+		pipe.Del(b.deadEntriesKey(), b.deadKey())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
+
+// outboxKey is the hash of undelivered callbacks by key, shared by the
+// workers of the server whichever their queue.
+func (b *redisBackend) outboxKey() string {
+	return b.base + "_outbox"
+}
+
+// legacyOutboxKey is the outbox of the queue of the workers predating the
+// shared outbox.
+func (b *redisBackend) legacyOutboxKey() string {
+	return b.queue + "_outbox"
+}
+
+// mergeOutboxScript moves the callbacks of outbox KEYS[1] to outbox KEYS[2],
+// keeping those already there.
+var mergeOutboxScript = redis.NewScript(`
+local entries = redis.call("HGETALL", KEYS[1])
+for i = 1, #entries, 2 do
+	redis.call("HSETNX", KEYS[2], entries[i], entries[i + 1])
+end
+redis.call("DEL", KEYS[1])
+return #entries / 2
+`)
+
+// mergeOutbox moves the callbacks of the legacy outbox of the queue to the
+// shared outbox, returning how many there were.
+func (b *redisBackend) mergeOutbox() (int, error) {
+	return mergeOutboxScript.Run(b.client, []string{b.legacyOutboxKey(), b.outboxKey()}).Int()
+}
+
+// ringKey is the hash of the ring of servers the queues of the server were
+// last sharded for, and of when it changed.
+func (b *redisBackend) ringKey() string {
+	return b.base + "_ring"
+}
+
+// ringScript records ARGV[1] as the ring of KEYS[1] changed at ARGV[2],
+// unless it is the ring already, and returns when the ring changed.
+var ringScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "ring") ~= ARGV[1] then
+	redis.call("HSET", KEYS[1], "ring", ARGV[1], "changed", ARGV[2])
+end
+return redis.call("HGET", KEYS[1], "changed")
+`)
+
+// ringChanged records ring as the ring the queues of the server are sharded
+// for and returns when the ring last changed, now when it was another.
+func (b *redisBackend) ringChanged(ring string, now time.Time) (time.Time, error) {
+	changed, err := ringScript.Run(b.client, []string{b.ringKey()}, ring, int64(unixMilli(now))).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, changed*int64(time.Millisecond)), nil
+}
+
+// PutCallback adds entry, or replaces the entry with the same key.
+func (b *redisBackend) PutCallback(key string, entry []byte) error {
+	return b.client.HSet(b.outboxKey(), key, entry).Err()
+}
+
+// Callbacks returns every undelivered callback.
+func (b *redisBackend) Callbacks() ([][]byte, error) {
+	values, err := b.client.HVals(b.outboxKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(values))
+	for _, value := range values {
+		entries = append(entries, []byte(value))
+	}
+	return entries, nil
+}
+
+// RemoveCallback deletes callback key, delivered or given up on.
+func (b *redisBackend) RemoveCallback(key string) error {
+	return b.client.HDel(b.outboxKey(), key).Err()
+}
+
+// commandKey is the key named name of command id, shared by the queues of
+// the server so that it does not depend on the position of the queue.
+func (b *redisBackend) commandKey(name string, id uint64) string {
+	return b.base + "_" + name + "_" + strconv.FormatUint(id, 10)
+}
+
+// stateKey is the state of command id.
+func (b *redisBackend) stateKey(id uint64) string {
+	return b.commandKey("state", id)
+}
+
+// historyKey is the list of transitions of command id, oldest first.
+func (b *redisBackend) historyKey(id uint64) string {
+	return b.commandKey("history", id)
+}
+
+// runKey is how many times command id was run again.
+func (b *redisBackend) runKey(id uint64) string {
+	return b.commandKey("run", id)
+}
+
+// handOffState moves the state, history and run of command id to the
+// server of to, which the command moved to, unless it has them already.
+func (b *redisBackend) handOffState(id uint64, to *redisBackend) error {
+	if to.server == b.server {
+		return nil
+	}
+	for _, key := range []string{b.stateKey(id), b.historyKey(id), b.runKey(id)} {
+		if err := b.moveKey(key, to, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handOffTrace moves the trace of command id, kept by queue, to the queue of
+// to, which the command moved to.
+func (b *redisBackend) handOffTrace(id uint64, to *redisBackend) error {
+	if to.server == b.server && to.queue == b.queue {
+		return nil
+	}
+	return b.moveKey(b.traceKey(id), to, to.traceKey(id))
+}
+
+// moveKey moves key along with its expiry to toKey on the server of to,
+// unless it is gone or to has toKey already, e.g. handed off before.
+func (b *redisBackend) moveKey(key string, to *redisBackend, toKey string) error {
+	dump, err := b.client.Dump(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := b.client.PTTL(key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	err = to.client.Restore(toKey, ttl, dump).Err()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return nil
+		}
+		return err
+	}
+	return b.client.Del(key).Err()
+}
+
+// legacyStateKey is the state of command id kept by queue before states
+// were shared, read until it expires.
+func (b *redisBackend) legacyStateKey(id uint64) string {
+	return b.queue + "_state_" + strconv.FormatUint(id, 10)
+}
+
+// State returns the state of command id, empty when unknown.
+func (b *redisBackend) State(id uint64) (string, error) {
+	st, err := b.client.Get(b.stateKey(id)).Result()
+	if err == redis.Nil {
+		st, err = b.client.Get(b.legacyStateKey(id)).Result()
+	}
+	if err == redis.Nil {
+		return "", nil
+	}
+	return st, err
+}
+
+// transitionScript sets the state KEYS[1] from ARGV[1] to ARGV[2] and
+// appends ARGV[3] to the history KEYS[2], both expiring in ARGV[4] seconds,
+// unless the state is no longer ARGV[1].
+var transitionScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current and current ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[4])
+redis.call("RPUSH", KEYS[2], ARGV[3])
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+return 1
+`)
+
+// AddTransition atomically moves command id from state from to state to
+// and appends entry to its history.
+func (b *redisBackend) AddTransition(id uint64, from, to string, entry []byte) error {
+	keys := []string{b.stateKey(id), b.historyKey(id)}
+	moved, err := transitionScript.Run(b.client, keys, from, to, entry, int64(historyTTL/time.Second)).Int()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrStateConflict
+	}
+	return nil
+}
+
+// Run returns how many times command id was run again.
+func (b *redisBackend) Run(id uint64) (int, error) {
+	run, err := b.client.Get(b.runKey(id)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return run, err
+}
+
+// newRunScript counts another run in KEYS[1], clears the state KEYS[2] and
+// its legacy KEYS[4], and appends ARGV[1] to the history KEYS[3], expiring
+// in ARGV[2] seconds.
+var newRunScript = redis.NewScript(`
+local run = redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+redis.call("DEL", KEYS[2], KEYS[4])
+redis.call("RPUSH", KEYS[3], ARGV[1])
+redis.call("EXPIRE", KEYS[3], ARGV[2])
+return run
+`)
+
+// NewRun atomically starts another run of command id and appends entry to
+// its history.
+func (b *redisBackend) NewRun(id uint64, entry []byte) (int, error) {
+	keys := []string{b.runKey(id), b.stateKey(id), b.historyKey(id), b.legacyStateKey(id)}
+	return newRunScript.Run(b.client, keys, entry, int64(historyTTL/time.Second)).Int()
+}
+
+// History returns the transitions of command id, oldest first.
+func (b *redisBackend) History(id uint64) ([][]byte, error) {
+	values, err := b.client.LRange(b.historyKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(values))
+	for _, value := range values {
+		entries = append(entries, []byte(value))
+	}
+	return entries, nil
+}
+
+func unixMilli(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testRedisBackend(t *testing.T, queue string) *redisBackend {
+	b := newRedisBackend(testRedisServer, queue, queue+"_0", time.Minute, log.NewNopLogger())
+	if err := b.client.Ping().Err(); err != nil {
+		t.Skipf("redis unreachable: %v", err)
+	}
+	b.client.Del(b.queue, b.backup, b.receiptsKey(b.consumer), b.deadlinesKey(b.consumer), b.consumersKey(), b.delayedKey())
+	return b
+}
+
+func TestRedisBackend_schedule(t *testing.T) {
+	b := testRedisBackend(t, "testschedulequeue")
+
+	if err := b.PushAt([]byte("delayed"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := b.schedule(time.Now()); err != nil || moved != 0 {
+		t.Fatalf("redisBackend.schedule() before due = %d, %v, want 0", moved, err)
+	}
+	if moved, err := b.schedule(time.Now().Add(2 * time.Minute)); err != nil || moved != 1 {
+		t.Fatalf("redisBackend.schedule() once due = %d, %v, want 1", moved, err)
+	}
+
+	m, err := b.Pop(time.Second)
+	if err != nil {
+		t.Fatalf("redisBackend.Pop() error = %v", err)
+	}
+	defer b.Ack(m)
+	if string(m.Body) != "delayed" {
+		t.Errorf("redisBackend.Pop() = %q, want %q", m.Body, "delayed")
+	}
+}
+
+func TestRedisBackend_recoverStale(t *testing.T) {
+	b := testRedisBackend(t, "teststalequeue")
+
+	// identical commands are acked and recovered apart
+	for i := 0; i < 2; i++ {
+		if err := b.Push([]byte("stale")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := b.Pop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Pop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Receipt == second.Receipt {
+		t.Fatalf("redisBackend.Pop() receipts = %q twice, want them apart", first.Receipt)
+	}
+	if recovered, err := b.recoverStale(time.Now()); err != nil || recovered != 0 {
+		t.Fatalf("redisBackend.recoverStale() within the visibility timeout = %d, %v, want 0", recovered, err)
+	}
+
+	if err := b.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(b.visibilityTimeout + time.Second)
+	if recovered, err := b.recoverStale(later); err != nil || recovered != 1 {
+		t.Fatalf("redisBackend.recoverStale() past the visibility timeout = %d, %v, want 1", recovered, err)
+	}
+	m, err := b.Pop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an extended command stays hidden
+	b.visibilityTimeout = time.Hour
+	if err := b.Extend(m); err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err := b.recoverStale(later); err != nil || recovered != 0 {
+		t.Fatalf("redisBackend.recoverStale() once extended = %d, %v, want 0", recovered, err)
+	}
+	b.Ack(m)
+}
+
+func TestRedisBackend_recoverConsumers(t *testing.T) {
+	dead := testRedisBackend(t, "testconsumerqueue")
+	alive := newRedisBackend(testRedisServer, dead.base, dead.queue, dead.visibilityTimeout, dead.logger)
+	defer dead.client.Del(alive.consumersKey())
+
+	for _, body := range []string{"first", "second"} {
+		if err := dead.Push([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dead.Pop(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alive.heartbeat()
+
+	if recovered, err := alive.recoverConsumers(time.Now()); err != nil || recovered != 0 {
+		t.Fatalf("redisBackend.recoverConsumers() of a beating consumer = %d, %v, want 0", recovered, err)
+	}
+	later := time.Now().Add(dead.visibilityTimeout + time.Second)
+	if recovered, err := alive.recoverConsumers(later); err != nil || recovered != 2 {
+		t.Fatalf("redisBackend.recoverConsumers() past the visibility timeout = %d, %v, want 2", recovered, err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		m, err := alive.Pop(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alive.Ack(m)
+		if string(m.Body) != want {
+			t.Errorf("redisBackend.Pop() once recovered = %q, want %q", m.Body, want)
+		}
+	}
+}
+
+func TestRedisBackend_claim(t *testing.T) {
+	b := testRedisBackend(t, "testclaimqueue")
+	other := newRedisBackend(testRedisServer, b.base, b.queue, b.visibilityTimeout, b.logger)
+
+	if err := b.Push([]byte("migrated")); err != nil {
+		t.Fatal(err)
+	}
+	m, claimed, err := b.claim(b.queue, "migrated", false)
+	if err != nil || !claimed {
+		t.Fatalf("redisBackend.claim() = %v, %v, want claimed", claimed, err)
+	}
+	if _, claimed, err := other.claim(b.queue, "migrated", false); err != nil || claimed {
+		t.Errorf("redisBackend.claim() by another consumer = %v, %v, want it taken", claimed, err)
+	}
+
+	// held until acked, requeued if the claimer dies
+	if n, _ := b.client.LLen(b.backup).Result(); n != 1 {
+		t.Errorf("backup list holds %d, want the claimed command", n)
+	}
+	if err := b.Ack(m); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := b.client.LLen(b.backup).Result(); n != 0 {
+		t.Errorf("backup list holds %d once acked, want 0", n)
+	}
+}
+
+func TestRedisBackend_mergeOutbox(t *testing.T) {
+	b := testRedisBackend(t, "testoutboxqueue")
+	defer b.client.Del(b.outboxKey(), b.legacyOutboxKey())
+	b.client.Del(b.outboxKey())
+
+	b.client.HSet(b.legacyOutboxKey(), "1-0-running", "legacy")
+	b.client.HSet(b.legacyOutboxKey(), "2-0-running", "legacy")
+	if err := b.PutCallback("2-0-running", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+
+	if merged, err := b.mergeOutbox(); err != nil || merged != 2 {
+		t.Fatalf("redisBackend.mergeOutbox() = %d, %v, want 2", merged, err)
+	}
+	entries, err := b.client.HGetAll(b.outboxKey()).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries["2-0-running"] != "shared" {
+		t.Errorf("outbox once merged = %v, want both keeping the shared one", entries)
+	}
+}
+
+func TestRedisBackend_stateShared(t *testing.T) {
+	b := testRedisBackend(t, "teststatequeue")
+	// the queue of the same server at another position
+	other := newRedisBackend(testRedisServer, b.base, b.base+"_1", b.visibilityTimeout, b.logger)
+	defer b.client.Del(b.stateKey(13), b.historyKey(13), b.runKey(13))
+
+	if err := b.AddTransition(13, "", "running", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := other.State(13); err != nil || st != "running" {
+		t.Errorf("redisBackend.State() from another queue = %q, %v, want running", st, err)
+	}
+	if run, err := other.NewRun(13, []byte("{}")); err != nil || run != 1 {
+		t.Fatalf("redisBackend.NewRun() = %d, %v, want 1", run, err)
+	}
+	if st, err := b.State(13); err != nil || st != "" {
+		t.Errorf("redisBackend.State() once run again = %q, %v, want none", st, err)
+	}
+}
+
+func TestRedisBackend_ringChanged(t *testing.T) {
+	b := testRedisBackend(t, "testringqueue")
+	defer b.client.Del(b.ringKey())
+	b.client.Del(b.ringKey())
+
+	start := time.Now().Truncate(time.Millisecond)
+	steps := []struct {
+		ring string
+		now  time.Time
+		want time.Time
+	}{
+		{ring: "r1:6379", now: start, want: start},
+		{ring: "r1:6379", now: start.Add(time.Minute), want: start},
+		{ring: "r1:6379,r2:6379", now: start.Add(2 * time.Minute), want: start.Add(2 * time.Minute)},
+	}
+	for i, step := range steps {
+		got, err := b.ringChanged(step.ring, step.now)
+		if err != nil || !got.Equal(step.want) {
+			t.Errorf("step %d: redisBackend.ringChanged(%q) = %v, %v, want %v", i, step.ring, got, err, step.want)
+		}
+	}
+}
+
+func TestRedisBackend_handOffTrace(t *testing.T) {
+	b := testRedisBackend(t, "testtracequeue")
+	// the queue of the same server at another position
+	to := newRedisBackend(testRedisServer, b.base, b.base+"_1", b.visibilityTimeout, b.logger)
+	defer b.client.Del(b.traceKey(14), to.traceKey(14))
+
+	if err := b.StoreTrace(14, []byte("carrier")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.handOffTrace(14, to); err != nil {
+		t.Fatal(err)
+	}
+	if carrier, err := to.Trace(14); err != nil || string(carrier) != "carrier" {
+		t.Errorf("redisBackend.Trace() once handed off = %q, %v, want carrier", carrier, err)
+	}
+	if carrier, _ := b.Trace(14); carrier != nil {
+		t.Errorf("redisBackend.Trace() of the former queue = %q, want none", carrier)
+	}
+}
@@ -0,0 +1,363 @@
+package worker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/qubole/edith/pkg/command"
+)
+
+// migrateInterval is how often commands queued on a worker which no longer
+// owns them are moved to their owner.
+var migrateInterval = time.Minute
+
+// migrateWindow is how long after the ring of servers changed commands are
+// migrated, for the processes still running with the former ring to be
+// rolled out in the meantime.
+var migrateWindow = 30 * time.Minute
+
+// migratePage is how many commands of a queue are read at once.
+const migratePage = 500
+
+// shardKeys sets the key every worker is hashed by: its server, suffixed
+// when the server is listed more than once so that the key does not depend
+// on the position of the server in the list.
+func shardKeys(workers []*Worker) {
+	seen := make(map[string]int)
+	for _, w := range workers {
+		key := w.server
+		if n := seen[w.server]; n > 0 {
+			key = fmt.Sprintf("%s#%d", w.server, n)
+		}
+		seen[w.server]++
+
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		w.shardHash = h.Sum64()
+	}
+}
+
+// workerFor returns the worker owning cmd by rendezvous hashing, so that
+// adding or removing a server only moves the commands it gains or loses.
+func (m *Manager) workerFor(cmd command.Command) *Worker {
+	var owner *Worker
+	var best uint64
+	for _, w := range m.workers {
+		if score := mix(w.shardHash ^ cmd.GetID()); owner == nil || score > best {
+			owner, best = w, score
+		}
+	}
+	return owner
+}
+
+// mix is the splitmix64 finalizer, spreading close IDs over the workers.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Migrate moves the commands queued on a worker which no longer owns them to
+// their owner, including those left in the queues of a former list of
+// servers, along with their states and traces. Each command is claimed
+// atomically before being pushed to its owner, so that managers migrating
+// at once move it once, and held until pushed, so that an interrupted
+// migration duplicates rather than loses it. The callbacks of the outboxes
+// kept by queue before they were shared are merged into the outbox of the
+// server. Servers are only migrated within migrateWindow of their ring of
+// servers changing, the commands being where they belong otherwise. Only
+// redis queues outlive the process, so workers on other backends are
+// skipped. It returns how many commands were moved.
+func (m *Manager) Migrate() (int, error) {
+	moved := 0
+	now := time.Now()
+	ring := m.ring()
+	for _, w := range m.workers {
+		rb, ok := w.backend.(*redisBackend)
+		if !ok {
+			continue
+		}
+		changed, err := rb.ringChanged(ring, now)
+		if err != nil {
+			return moved, err
+		}
+		if now.Sub(changed) > migrateWindow {
+			continue
+		}
+		n, err := m.migrateQueue(w, rb, rb.queue, true)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+		n, err = m.migrateDelayed(w, rb, rb.delayedKey(), true)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+		if err := mergeOutbox(w, rb); err != nil {
+			return moved, err
+		}
+
+		orphans, err := m.orphanQueues(w, rb)
+		if err != nil {
+			return moved, err
+		}
+		for _, queue := range orphans {
+			n, err := m.migrateOrphan(w, rb, queue)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
+
+// ring lists the servers of the workers in order, which commands and queues
+// are sharded by.
+func (m *Manager) ring() string {
+	servers := make([]string, 0, len(m.workers))
+	for _, w := range m.workers {
+		servers = append(servers, w.server)
+	}
+	return strings.Join(servers, ",")
+}
+
+// orphanKeys are the patterns of the keys of a queue, {base} standing for
+// the base name of the queues and {idx} for its index. A queue is found by
+// any of its keys, its list being gone once empty.
+var orphanKeys = []string{"{base}_{idx}", "{base}_{idx}_delayed", "{base}_{idx}_outbox", "_{base}_{idx}_consumers", "_{base}_{idx}_backup_"}
+
+// scanIndexes match the indexes of the queues in a SCAN pattern. The keys
+// ending with the index are matched by width, up to 999, not to match the
+// keys of the commands starting with the queue name.
+func scanIndexes(pattern string) []string {
+	if strings.HasSuffix(pattern, "{idx}") {
+		return []string{"[0-9]", "[0-9][0-9]", "[0-9][0-9][0-9]"}
+	}
+	return []string{"[0-9]*"}
+}
+
+// orphanQueues returns the queues on the server of w which belong to no
+// worker, e.g. "cmdqueue_3" once there are three servers. Only the keys of
+// queues are matched, not the other keys sharing their prefix.
+func (m *Manager) orphanQueues(w *Worker, rb *redisBackend) ([]string, error) {
+	seen := make(map[string]bool)
+	var orphans []string
+	for _, pattern := range orphanKeys {
+		for _, idx := range scanIndexes(pattern) {
+			match := strings.NewReplacer("{base}", w.cmdQueueBase, "{idx}", idx).Replace(pattern)
+			var cursor uint64
+			for {
+				keys, next, err := rb.client.Scan(cursor, match, 1000).Result()
+				if err != nil {
+					return nil, err
+				}
+				for _, key := range keys {
+					queue, idx, ok := queueOf(w.cmdQueueBase, key)
+					if !ok || seen[queue] || (idx < len(m.workers) && m.workers[idx].server == w.server) {
+						continue
+					}
+					seen[queue] = true
+					orphans = append(orphans, queue)
+				}
+				if cursor = next; cursor == 0 {
+					break
+				}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// queueOf returns the queue key belongs to and its index, false when key
+// is not one of orphanKeys.
+func queueOf(base, key string) (string, int, bool) {
+	for _, pattern := range orphanKeys {
+		prefix := strings.Split(strings.Replace(pattern, "{base}", base, 1), "{idx}")
+		if !strings.HasPrefix(key, prefix[0]) || !strings.HasSuffix(key, prefix[1]) || len(key) < len(prefix[0])+len(prefix[1]) {
+			continue
+		}
+		digits := key[len(prefix[0]) : len(key)-len(prefix[1])]
+		idx, err := strconv.Atoi(digits)
+		if err != nil || idx < 0 || strconv.Itoa(idx) != digits {
+			continue
+		}
+		return base + "_" + digits, idx, true
+	}
+	return "", 0, false
+}
+
+// migrateOrphan moves every command of an orphaned queue and its delayed
+// set to their owners. The commands popped from it are left to their
+// consumers, possibly still running with the former servers, and only
+// requeued once they are stale.
+func (m *Manager) migrateOrphan(w *Worker, rb *redisBackend, queue string) (int, error) {
+	orphan := rb.forQueue(queue)
+	now := time.Now()
+	recovered, err := orphan.recoverConsumers(now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := orphan.recoverLegacy(now)
+	recovered += n
+	if err != nil {
+		return 0, err
+	}
+	if recovered > 0 {
+		_ = level.Warn(w.logger).Log("method", "migrateOrphan", "queue", queue, "requeued", recovered)
+	}
+	if err := mergeOutbox(w, orphan); err != nil {
+		return 0, err
+	}
+
+	moved, err := m.migrateQueue(w, rb, queue, false)
+	if err != nil {
+		return moved, err
+	}
+	n, err = m.migrateDelayed(w, rb, queue+"_delayed", false)
+	return moved + n, err
+}
+
+// mergeOutbox moves the callbacks of the outbox of the queue of rb, from
+// before the outbox was shared, to the shared outbox.
+func mergeOutbox(w *Worker, rb *redisBackend) error {
+	merged, err := rb.mergeOutbox()
+	if merged > 0 {
+		_ = level.Info(w.logger).Log("method", "mergeOutbox", "queue", rb.queue, "merged", merged)
+	}
+	return err
+}
+
+// migrateQueue moves the commands of list key in rb, the backend of w, to
+// the queues of their owners, oldest first, a page at a time. With
+// keepOwned the commands owned by w stay where they are.
+func (m *Manager) migrateQueue(w *Worker, rb *redisBackend, key string, keepOwned bool) (int, error) {
+	moved := 0
+	// the commands moved leave the list, only the kept ones are skipped
+	var offset int64
+	for {
+		entries, err := rb.client.LRange(key, offset, offset+migratePage-1).Result()
+		if err != nil || len(entries) == 0 {
+			return moved, err
+		}
+		for _, raw := range entries {
+			owner := m.ownerOf(w, raw)
+			if keepOwned && owner == w {
+				offset++
+				continue
+			}
+			n, err := m.migrate(rb, key, raw, false, owner, func(body []byte) error {
+				return owner.backend.Push(body)
+			})
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+}
+
+// migrateDelayed moves the commands of sorted set key in rb, the backend of
+// w, to their owners, keeping when they are due, a page at a time.
+func (m *Manager) migrateDelayed(w *Worker, rb *redisBackend, key string, keepOwned bool) (int, error) {
+	moved := 0
+	// the commands moved leave the set, only the kept ones are skipped
+	var offset int64
+	for {
+		entries, err := rb.client.ZRangeWithScores(key, offset, offset+migratePage-1).Result()
+		if err != nil || len(entries) == 0 {
+			return moved, err
+		}
+		for _, z := range entries {
+			raw, ok := z.Member.(string)
+			owner := w
+			if ok {
+				owner = m.ownerOf(w, raw)
+			}
+			if !ok || (keepOwned && owner == w) {
+				offset++
+				continue
+			}
+			due := time.Unix(0, int64(z.Score)*int64(time.Millisecond))
+			n, err := m.migrate(rb, key, raw, true, owner, func(body []byte) error {
+				return owner.backend.PushAt(body, due)
+			})
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+}
+
+// migrate claims raw out of key in rb and pushes it to owner with push, 0
+// if another manager claimed it first, handing off its state and trace
+// along with it. A command which could not be pushed is given back to the queue of rb.
+func (m *Manager) migrate(rb *redisBackend, key, raw string, sorted bool, owner *Worker, push func([]byte) error) (int, error) {
+	msg, claimed, err := rb.claim(key, raw, sorted)
+	if err != nil || !claimed {
+		return 0, err
+	}
+	if err := push(msg.Body); err != nil {
+		if nackErr := rb.Nack(msg, 0); nackErr != nil {
+			_ = level.Error(rb.logger).Log("method", "migrate", "context", "nack", "error", nackErr)
+		}
+		return 0, err
+	}
+	if to, ok := owner.backend.(*redisBackend); ok {
+		if cmd, err := owner.cmdManager.UnMarshalCommand(msg.Body); err == nil {
+			if err := rb.handOffState(cmd.GetID(), to); err != nil {
+				_ = level.Error(rb.logger).Log("cmdID", cmd.GetID(), "method", "migrate", "context", "handOffState", "error", err)
+			}
+			if err := rb.handOffTrace(cmd.GetID(), to); err != nil {
+				_ = level.Error(rb.logger).Log("cmdID", cmd.GetID(), "method", "migrate", "context", "handOffTrace", "error", err)
+			}
+		}
+	}
+	if err := rb.Ack(msg); err != nil {
+		_ = level.Error(rb.logger).Log("method", "migrate", "context", "ack", "error", err)
+	}
+	return 1, nil
+}
+
+// ownerOf returns the owner of the raw command, w when it does not
+// unmarshal so that its pop reports it.
+func (m *Manager) ownerOf(w *Worker, raw string) *Worker {
+	cmd, err := w.cmdManager.UnMarshalCommand([]byte(raw))
+	if err != nil {
+		return w
+	}
+	return m.workerFor(cmd)
+}
+
+// loopMigrate migrates commands on start and then periodically, picking up
+// the ones pushed by processes still running with the former servers.
+func (m *Manager) loopMigrate(stop <-chan struct{}) {
+	ticker := time.NewTicker(migrateInterval)
+	defer ticker.Stop()
+
+	for {
+		moved, err := m.Migrate()
+		if err != nil {
+			_ = level.Error(m.logger()).Log("method", "loopMigrate", "context", "Migrate", "error", err)
+		} else if moved > 0 {
+			_ = level.Info(m.logger()).Log("method", "loopMigrate", "context", "Migrate", "moved", moved)
+		}
+
+		select {
+		case <-stop:
+			_ = level.Info(m.logger()).Log("method", "loopMigrate", "status", "exit")
+			return
+		case <-ticker.C:
+		}
+	}
+}
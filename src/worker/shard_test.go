@@ -0,0 +1,103 @@
+package worker
+
+import "testing"
+
+func testShardManager(servers ...string) *Manager {
+	m := &Manager{}
+	for idx, s := range servers {
+		m.workers = append(m.workers, &Worker{id: idx, server: s})
+	}
+	shardKeys(m.workers)
+	return m
+}
+
+func TestManager_workerFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+	}{
+		{name: "ServerAdded", before: []string{"r1:6379", "r2:6379", "r3:6379"}, after: []string{"r1:6379", "r2:6379", "r3:6379", "r4:6379"}},
+		{name: "ServerRemoved", before: []string{"r1:6379", "r2:6379", "r3:6379"}, after: []string{"r1:6379", "r3:6379"}},
+		{name: "ServersReordered", before: []string{"r1:6379", "r2:6379", "r3:6379"}, after: []string{"r3:6379", "r1:6379", "r2:6379"}},
+	}
+	const commands = 3000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := testShardManager(tt.before...), testShardManager(tt.after...)
+			kept := make(map[string]bool)
+			for _, s := range tt.after {
+				kept[s] = true
+			}
+
+			perServer := make(map[string]int)
+			for id := uint64(1); id <= commands; id++ {
+				cmd := poolCommand{id: id}
+				from, to := before.workerFor(cmd).server, after.workerFor(cmd).server
+				perServer[to]++
+				if from == to {
+					continue
+				}
+				// only commands of a removed server, or taken by an added
+				// one, may move
+				if kept[from] && contains(tt.before, to) {
+					t.Fatalf("command %d moved from %s to %s, both before and after", id, from, to)
+				}
+			}
+
+			for _, s := range tt.after {
+				if share := perServer[s]; share < commands/len(tt.after)/2 {
+					t.Errorf("%s owns %d of %d commands, want about %d", s, share, commands, commands/len(tt.after))
+				}
+			}
+		})
+	}
+}
+
+func contains(servers []string, server string) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQueueOf(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantIdx int
+		wantOk  bool
+	}{
+		{key: "cmdqueue_3", want: "cmdqueue_3", wantIdx: 3, wantOk: true},
+		{key: "cmdqueue_12_delayed", want: "cmdqueue_12", wantIdx: 12, wantOk: true},
+		{key: "_cmdqueue_4_consumers", want: "cmdqueue_4", wantIdx: 4, wantOk: true},
+		{key: "_cmdqueue_5_backup_", want: "cmdqueue_5", wantIdx: 5, wantOk: true},
+		{key: "cmdqueue_6_outbox", want: "cmdqueue_6", wantIdx: 6, wantOk: true},
+		{key: "cmdqueue_outbox"},
+		{key: "cmdqueue_1_trace_42"},
+		{key: "cmdqueue_1_dead"},
+		{key: "cmdqueue_01"},
+		{key: "cmdqueue_"},
+		{key: "otherqueue_1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, idx, ok := queueOf("cmdqueue", tt.key)
+			if got != tt.want || idx != tt.wantIdx || ok != tt.wantOk {
+				t.Errorf("queueOf() = %q, %d, %v, want %q, %d, %v", got, idx, ok, tt.want, tt.wantIdx, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestManager_ring(t *testing.T) {
+	if got, want := testShardManager("r1:6379", "r2:6379").ring(), "r1:6379,r2:6379"; got != want {
+		t.Errorf("Manager.ring() = %q, want %q", got, want)
+	}
+	// queues are named by position, reordering the servers changes the ring
+	if a, b := testShardManager("r1:6379", "r2:6379").ring(), testShardManager("r2:6379", "r1:6379").ring(); a == b {
+		t.Errorf("Manager.ring() = %q for reordered servers", a)
+	}
+}
@@ -0,0 +1,243 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/qubole/edith/pkg/command"
+	"github.com/qubole/edith/pkg/state"
+)
+
+var (
+	// ErrIllegalTransition the command cannot move from its state to the
+	// reported one.
+	ErrIllegalTransition = errors.New("illegal state transition")
+	// ErrStateConflict the state of the command changed while moving it.
+	ErrStateConflict = errors.New("command state changed concurrently")
+	// ErrHistoryNotFound no worker has a history for the command.
+	ErrHistoryNotFound = errors.New("command history not found")
+
+	// historyTTL is how long the state and history of a command are kept
+	// after its last transition.
+	historyTTL = 7 * 24 * time.Hour
+)
+
+// transitions lists the states each state may move to, the empty state
+// being a command which has not reported any yet. Terminal states move
+// nowhere.
+var transitions = map[state.State][]state.State{
+	"":            {state.Pending, state.Running, state.Success, state.Errored, state.Terminated},
+	state.Pending: {state.Running, state.Success, state.Errored, state.Terminated},
+	state.Running: {state.Success, state.Errored, state.Terminated},
+}
+
+// isTerminal reports whether a command in state s is done for good.
+func isTerminal(s state.State) bool {
+	return s == state.Success || s == state.Errored || s == state.Terminated
+}
+
+// isFinished reports whether a command of info is done in state s, commands
+// having finished states of their own besides the terminal ones.
+var isFinished = func(info *command.RunInfo, s state.State) bool {
+	return isTerminal(s) || info.IsFinished(s)
+}
+
+// canTransition reports whether a command may move from state from to
+// state to.
+func canTransition(from, to state.State) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is a change of state of a command.
+type Transition struct {
+	CommandID uint64      `json:"commandId"`
+	From      state.State `json:"from"`
+	To        state.State `json:"to"`
+	At        time.Time   `json:"at"`
+	Queue     string      `json:"queue"`
+	// Reason is set for the transitions made by an operator, such as a
+	// dead letter requeued.
+	Reason string `json:"reason,omitempty"`
+}
+
+// currentState of cmd, as kept by the backend when it keeps states so that
+// it survives restarts.
+func (w *Worker) currentState(cmd command.Command) state.State {
+	if store, ok := w.backend.(HistoryStore); ok {
+		if st, err := store.State(cmd.GetID()); err == nil && st != "" {
+			cmd.RunInfo().CurrentState = state.State(st)
+		}
+	}
+	return cmd.RunInfo().CurrentState
+}
+
+// transition moves cmd to state to, recording it in its history. It
+// returns false when cmd already is in that state, ErrIllegalTransition
+// when it may not move there.
+func (w *Worker) transition(cmd command.Command, to state.State) (bool, error) {
+	from := w.currentState(cmd)
+	if from == to {
+		return false, nil
+	}
+	if !canTransition(from, to) {
+		return false, fmt.Errorf("%w: %s to %s", ErrIllegalTransition, stateName(from), to)
+	}
+	if err := w.addTransition(cmd, from, to, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// finish moves cmd to the finished state to from any unfinished state,
+// whether transitions list the move or not, for its finish callback to be
+// posted once.
+func (w *Worker) finish(cmd command.Command, to state.State) (bool, error) {
+	from := w.currentState(cmd)
+	if from == to {
+		return false, nil
+	}
+	if isFinished(cmd.RunInfo(), from) {
+		return false, fmt.Errorf("%w: %s to %s", ErrIllegalTransition, stateName(from), to)
+	}
+	if err := w.addTransition(cmd, from, to, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// resetState starts another run of cmd in the empty state whatever its
+// state, for it to run again.
+func (w *Worker) resetState(cmd command.Command, reason string) error {
+	from := w.currentState(cmd)
+	if store, ok := w.backend.(HistoryStore); ok {
+		entry, err := json.Marshal(Transition{
+			CommandID: cmd.GetID(),
+			From:      from,
+			At:        time.Now(),
+			Queue:     w.cmdQueue,
+			Reason:    reason,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := store.NewRun(cmd.GetID(), entry); err != nil {
+			return err
+		}
+	}
+	cmd.RunInfo().CurrentState = ""
+	return nil
+}
+
+// beginRun reports whether cmd is to be created, starting another run of it
+// when it is created again once finished, the states of the former run not
+// holding for this one. A create recovered or redelivered while its run is
+// in progress is not.
+func (w *Worker) beginRun(cmd command.Command) (bool, error) {
+	current := w.currentState(cmd)
+	switch {
+	case current == "":
+		return true, nil
+	case !isFinished(cmd.RunInfo(), current):
+		return false, nil
+	}
+	if err := w.resetState(cmd, "created again"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runOf cmd, how many times it was run again, 0 when the backend does not
+// keep states.
+func (w *Worker) runOf(cmd command.Command) (int, error) {
+	store, ok := w.backend.(HistoryStore)
+	if !ok {
+		return 0, nil
+	}
+	return store.Run(cmd.GetID())
+}
+
+func (w *Worker) addTransition(cmd command.Command, from, to state.State, reason string) error {
+	if store, ok := w.backend.(HistoryStore); ok {
+		entry, err := json.Marshal(Transition{
+			CommandID: cmd.GetID(),
+			From:      from,
+			To:        to,
+			At:        time.Now(),
+			Queue:     w.cmdQueue,
+			Reason:    reason,
+		})
+		if err != nil {
+			return err
+		}
+		if err := store.AddTransition(cmd.GetID(), string(from), string(to), entry); err != nil {
+			return err
+		}
+	}
+	cmd.RunInfo().CurrentState = to
+	return nil
+}
+
+// history of command id kept by the worker, oldest first.
+func (w *Worker) history(id uint64) ([]Transition, error) {
+	store, ok := w.backend.(HistoryStore)
+	if !ok {
+		return nil, nil
+	}
+	entries, err := store.History(id)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Transition, 0, len(entries))
+	for _, entry := range entries {
+		var t Transition
+		if err := json.Unmarshal(entry, &t); err != nil {
+			return nil, err
+		}
+		history = append(history, t)
+	}
+	return history, nil
+}
+
+// History returns the transitions of command id, oldest first. The history
+// of a command moves along with it when servers are added or removed, but
+// may be spread over them until then.
+func (m *Manager) History(id uint64) ([]Transition, error) {
+	var history []Transition
+	// the workers of a redis server share its histories
+	servers := make(map[string]bool)
+	for _, w := range m.workers {
+		if rb, ok := w.backend.(*redisBackend); ok {
+			if servers[rb.server] {
+				continue
+			}
+			servers[rb.server] = true
+		}
+		h, err := w.history(id)
+		if err != nil {
+			return nil, fmt.Errorf("worker.%d.history: %w", w.id, err)
+		}
+		history = append(history, h...)
+	}
+	if len(history) == 0 {
+		return nil, ErrHistoryNotFound
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].At.Before(history[j].At) })
+	return history, nil
+}
+
+// stateName of s for logs and errors, "new" for the empty state.
+func stateName(s state.State) string {
+	if s == "" {
+		return "new"
+	}
+	return string(s)
+}
@@ -0,0 +1,190 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qubole/edith/pkg/apps/edith"
+	"github.com/qubole/edith/pkg/command"
+	"github.com/qubole/edith/pkg/spark"
+	"github.com/qubole/edith/pkg/state"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to state.State
+		want     bool
+	}{
+		{"", state.Pending, true},
+		{"", state.Errored, true},
+		{state.Pending, state.Running, true},
+		{state.Pending, state.Success, true},
+		{state.Running, state.Terminated, true},
+		{state.Running, state.Pending, false},
+		{state.Success, state.Running, false},
+		{state.Errored, state.Terminated, false},
+		{state.Terminated, state.Pending, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestWorker_transition(t *testing.T) {
+	backend := NewMemoryBackend()
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+	m := &Manager{workers: []*Worker{w}}
+	newCmd := func() command.Command {
+		return &edith.Command{ID: 9, Type: "spark_app", SparkApp: &spark.App{ID: 9}, Info: &command.RunInfo{Operation: "status"}}
+	}
+
+	steps := []struct {
+		to        state.State
+		wantMoved bool
+		wantErr   error
+	}{
+		{to: state.Pending, wantMoved: true},
+		{to: state.Pending},
+		{to: state.Running, wantMoved: true},
+		{to: state.Pending, wantErr: ErrIllegalTransition},
+		{to: state.Success, wantMoved: true},
+		{to: state.Running, wantErr: ErrIllegalTransition},
+	}
+	for i, step := range steps {
+		// a fresh copy each time, as popped by a restarted worker
+		moved, err := w.transition(newCmd(), step.to)
+		if moved != step.wantMoved || !errors.Is(err, step.wantErr) {
+			t.Errorf("step %d: Worker.transition(%q) = %v, %v, want %v, %v", i, step.to, moved, err, step.wantMoved, step.wantErr)
+		}
+	}
+
+	history, err := m.History(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []state.State{state.Pending, state.Running, state.Success}
+	if len(history) != len(want) {
+		t.Fatalf("Manager.History() = %+v, want moves to %v", history, want)
+	}
+	for i, transition := range history {
+		if transition.To != want[i] {
+			t.Errorf("Manager.History()[%d].To = %q, want %q", i, transition.To, want[i])
+		}
+	}
+	if _, err := m.History(10); err != ErrHistoryNotFound {
+		t.Errorf("Manager.History() of an unknown command error = %v, want %v", err, ErrHistoryNotFound)
+	}
+}
+
+func TestWorker_processStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   state.State
+		status    state.State
+		wantState state.State
+		// wantPolled the status is requeued to be polled again
+		wantPolled bool
+	}{
+		{name: "pending", status: state.Pending, wantState: state.Pending, wantPolled: true},
+		{name: "running", current: state.Pending, status: state.Running, wantState: state.Running, wantPolled: true},
+		{name: "errored", current: state.Running, status: state.Errored, wantState: state.Errored},
+		{name: "late status", current: state.Success, status: state.Running, wantState: state.Success},
+		{name: "going back", current: state.Running, status: state.Pending, wantState: state.Running, wantPolled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+			cmd := &edith.Command{ID: 11, Type: "spark_app", SparkApp: &spark.App{ID: 11}, Info: &command.RunInfo{Operation: "create"}}
+			if tt.current != "" {
+				backend.AddTransition(11, "", string(tt.current), []byte("{}"))
+			}
+
+			w.processStatus(context.Background(), cmd, &state.Status{CommandID: 11, State: tt.status})
+
+			if got, _ := backend.State(11); state.State(got) != tt.wantState {
+				t.Errorf("state = %q, want %q", got, tt.wantState)
+			}
+			if queued, _ := backend.Len(); (queued > 0) != tt.wantPolled {
+				t.Errorf("polled again = %v, want %v", queued > 0, tt.wantPolled)
+			}
+		})
+	}
+}
+
+func TestWorker_processStatusFinished(t *testing.T) {
+	// a command type finishing in a state of its own, unknown to transitions
+	const done = state.State("done")
+	defer func(f func(*command.RunInfo, state.State) bool) { isFinished = f }(isFinished)
+	isFinished = func(info *command.RunInfo, s state.State) bool {
+		return isTerminal(s) || s == done
+	}
+
+	posts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		posts++
+	}))
+	defer hook.Close()
+
+	backend := NewMemoryBackend()
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+	cmd := &edith.Command{ID: 13, Type: "spark_app", SparkApp: &spark.App{ID: 13}, Info: &command.RunInfo{Operation: "status", Callbacks: map[string]string{"finished": hook.URL}}}
+	backend.AddTransition(13, "", string(state.Running), []byte("{}"))
+
+	w.processStatus(context.Background(), cmd, &state.Status{CommandID: 13, State: done})
+	// a late status once done is dropped
+	w.processStatus(context.Background(), cmd, &state.Status{CommandID: 13, State: state.Running})
+
+	if got, _ := backend.State(13); state.State(got) != done {
+		t.Errorf("state = %q, want %q", got, done)
+	}
+	if posts != 1 {
+		t.Errorf("finish callbacks posted = %d, want 1", posts)
+	}
+	if queued, _ := backend.Len(); queued > 0 {
+		t.Errorf("polled again = %d times, want 0", queued)
+	}
+}
+
+func TestWorker_beginRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   state.State
+		wantBegin bool
+		want      state.State
+		wantRun   int
+	}{
+		{name: "new", wantBegin: true, want: ""},
+		{name: "pending", current: state.Pending, want: state.Pending},
+		{name: "running", current: state.Running, want: state.Running},
+		{name: "finished", current: state.Success, wantBegin: true, want: "", wantRun: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+			cmd := &edith.Command{ID: 12, Type: "spark_app", SparkApp: &spark.App{ID: 12}, Info: &command.RunInfo{Operation: "create"}}
+			if tt.current != "" {
+				backend.AddTransition(12, "", string(tt.current), []byte("{}"))
+			}
+
+			begin, err := w.beginRun(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if begin != tt.wantBegin {
+				t.Errorf("Worker.beginRun() = %v, want %v", begin, tt.wantBegin)
+			}
+			st, _ := backend.State(12)
+			run, _ := backend.Run(12)
+			if state.State(st) != tt.want || cmd.RunInfo().CurrentState != tt.want || run != tt.wantRun {
+				t.Errorf("state, run = %q, %d, want %q, %d", st, run, tt.want, tt.wantRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	defaultRestartMinBackoff = 100 * time.Millisecond
+	defaultRestartMaxBackoff = 10 * time.Second
+)
+
+// Supervisor runs RunFns until stopped, restarting the ones which exit or
+// panic before that.
+type Supervisor struct {
+	logger log.Logger
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewSupervisor is constructor for Supervisor.
+func NewSupervisor(logger log.Logger) *Supervisor {
+	return &Supervisor{
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start runs every fn in its own goroutine.
+func (s *Supervisor) Start(fns ...RunFn) {
+	for idx, fn := range fns {
+		s.wg.Add(1)
+		go s.supervise(idx, fn)
+	}
+}
+
+// Stop closes the stop channel and waits for every RunFn to return or ctx
+// to be done.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.once.Do(func() { close(s.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("worker.supervisor.stop: %w", ctx.Err())
+	}
+}
+
+func (s *Supervisor) supervise(idx int, fn RunFn) {
+	defer s.wg.Done()
+
+	for restarts := 0; ; restarts++ {
+		start := time.Now()
+		err := s.run(fn)
+		if time.Since(start) > defaultRestartMaxBackoff {
+			// it ran fine for a while, start backing off afresh
+			restarts = 0
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		backoff := expBackoff(restarts, defaultRestartMinBackoff, defaultRestartMaxBackoff)
+		_ = level.Error(s.logger).Log("method", "supervise", "runnable", idx, "error", err, "restarts", restarts, "backoff", backoff)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// run fn, turning a panic into an error.
+func (s *Supervisor) run(fn RunFn) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("worker.supervisor.panic: %v", r)
+		}
+	}()
+	return fn(s.stop)
+}
@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestSupervisor(t *testing.T) {
+	defaultRestartMinBackoff, defaultRestartMaxBackoff = time.Millisecond, 2*time.Millisecond
+
+	tests := []struct {
+		name string
+		fn   func(runs *int32) RunFn
+	}{
+		{
+			name: "ExitsEarly",
+			fn: func(runs *int32) RunFn {
+				return func(stop <-chan struct{}) error {
+					atomic.AddInt32(runs, 1)
+					return errors.New("exited")
+				}
+			},
+		},
+		{
+			name: "Panics",
+			fn: func(runs *int32) RunFn {
+				return func(stop <-chan struct{}) error {
+					atomic.AddInt32(runs, 1)
+					panic("boom")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs int32
+			s := NewSupervisor(log.NewNopLogger())
+			s.Start(tt.fn(&runs))
+
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&runs) < 3 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := atomic.LoadInt32(&runs); got < 3 {
+				t.Errorf("runs = %v, want the runnable restarted", got)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := s.Stop(ctx); err != nil {
+				t.Errorf("Stop() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSupervisor_StopWaits(t *testing.T) {
+	s := NewSupervisor(log.NewNopLogger())
+	var stopped int32
+	s.Start(func(stop <-chan struct{}) error {
+		<-stop
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&stopped, 1)
+		return nil
+	})
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Errorf("Stop() returned before the runnable did")
+	}
+
+	s = NewSupervisor(log.NewNopLogger())
+	s.Start(func(stop <-chan struct{}) error {
+		select {}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); err == nil {
+		t.Errorf("Stop() error = nil, want timeout")
+	}
+}
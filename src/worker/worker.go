@@ -2,59 +2,176 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 
-	"github.com/qubole/edith/internal/httpclient"
-
-	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/qubole/edith/pkg/command"
 	"github.com/qubole/edith/pkg/state"
+
+	"httpclient"
+	"metrics"
+	"requestid"
 )
 
 // Worker struct..
 type Worker struct {
 	id              int
 	server          string
+	cmdQueueBase    string
 	cmdQueue        string
-	cmdQueueBackup  string
 	cmdQueueTimeOut int64
-	redis           *redis.Client
-	logger          log.Logger
-	cmdChan         chan command.Command
-	cmdManager      command.Codec
-	stop            <-chan struct{}
-	quit            bool
+	// shardHash places the worker for rendezvous hashing.
+	shardHash uint64
+	// owner returns the worker a command is requeued on, nil outside a
+	// Manager.
+	owner func(command.Command) *Worker
+	// visibilityTimeout is how long a popped command may go unacked before
+	// it is considered abandoned and requeued.
+	visibilityTimeout time.Duration
+	concurrency       int
+	// maxInFlight bounds the commands popped and not yet processed.
+	maxInFlight int
+	// typeLimits bound how many commands of a type are processed at once.
+	typeLimits map[string]int
+	pool       *pool
+	backend    Backend
+	// newBackend creates the backend, redis when nil.
+	newBackend func(server, queue string) Backend
+	logger     log.Logger
+	cmdChan    chan queued
+	bufferSize int
+	// buffered counts the commands sent to cmdChan and not yet delivered,
+	// for Drain to wait on.
+	buffered counter
+	// pushTimeout bounds how long Push waits for room in cmdChan.
+	pushTimeout time.Duration
+	// spill pushes to redis directly when cmdChan is full.
+	spill bool
+	// peers are the other workers of the Manager, failed over to when the
+	// redis of w is down.
+	peers []*Worker
+	// callbackRetry is how each delivery of a callback is retried.
+	callbackRetry *httpclient.RetryOptions
+	// callbackSecret signs the callbacks, unsigned when empty.
+	callbackSecret []byte
+	// journal spools commands no redis took, nil when disabled.
+	journal    *journal
+	journalDir string
+	cmdManager command.Codec
+	stop       <-chan struct{}
+	quit       bool
 }
 
 var (
-	// ErrEmptyQueue redis command queue is empty/
-	ErrEmptyQueue = errors.New("empty redis queue")
+	// ErrEmptyQueue command queue is empty/
+	ErrEmptyQueue = errors.New("empty queue")
+	// ErrQueueFull the command buffer of the worker stayed full.
+	ErrQueueFull = errors.New("worker queue full")
 
 	defaultLogLevel        = "info"
 	defaultCmdQueueTimeout = int64(5)
 	defaultCmdQueue        = "cmdqueue"
+	defaultConcurrency     = 1
+	defaultVisibility      = 5 * time.Minute
+	defaultBufferSize      = 100
+	defaultPushTimeout     = time.Second
+
+	// traceTTL bounds how long a trace carrier outlives its command.
+	traceTTL = 24 * time.Hour
+
+	// scheduleInterval is how often due delayed commands are moved to the
+	// queue.
+	scheduleInterval = time.Second
+	// scheduleBatch bounds how many due commands are moved at once.
+	scheduleBatch = 100
+
+	// pushAttempts is how many times a command is pushed to its redis
+	// before failing over.
+	pushAttempts        = 3
+	pushRetryMinBackoff = 100 * time.Millisecond
+	pushRetryMaxBackoff = time.Second
+	// journalReplayInterval is how often journaled commands are retried.
+	journalReplayInterval = 10 * time.Second
 )
 
+// queued is a command waiting to be pushed along with the trace and request
+// it belongs to.
+type queued struct {
+	cmd     command.Command
+	carrier propagation.MapCarrier
+	// delay before the command may be popped again, none when zero.
+	delay time.Duration
+}
+
+// counter counts operations in progress, for a caller to wait until there
+// are none while others may still start.
+type counter struct {
+	mu sync.Mutex
+	n  int
+	// zero is closed once n drops back to 0.
+	zero chan struct{}
+}
+
+// alwaysIdle is returned by idle when nothing is in progress.
+var alwaysIdle = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (c *counter) add() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == 0 {
+		c.zero = make(chan struct{})
+	}
+	c.n++
+}
+
+func (c *counter) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n--
+	if c.n == 0 {
+		close(c.zero)
+	}
+}
+
+// idle returns a channel closed once nothing started so far is in
+// progress anymore.
+func (c *counter) idle() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == 0 {
+		return alwaysIdle
+	}
+	return c.zero
+}
+
 // New is worker constructor.
 func newWorker(id int, server string, cmdManager command.Codec, options ...Option) *Worker {
 	w := &Worker{
 		id:         id,
 		server:     server,
 		cmdManager: cmdManager,
-		redis: redis.NewClient(&redis.Options{
-			Addr: server,
-		}),
 	}
 
 	// set defaults
-	opts := append([]Option{}, Logger(defaultLogLevel), CmdQueueTimeout(defaultCmdQueueTimeout), CmdQueue(defaultCmdQueue))
+	opts := append([]Option{}, Logger(defaultLogLevel), CmdQueueTimeout(defaultCmdQueueTimeout), CmdQueue(defaultCmdQueue), Concurrency(defaultConcurrency), VisibilityTimeout(defaultVisibility), BufferSize(defaultBufferSize), PushTimeout(defaultPushTimeout))
 
 	// set overrides
 	opts = append(opts, options...)
@@ -64,43 +181,189 @@ func newWorker(id int, server string, cmdManager command.Codec, options ...Optio
 		opt(w)
 	}
 
-	w.cmdChan = make(chan command.Command, 100)
+	if w.newBackend != nil {
+		w.backend = w.newBackend(server, w.cmdQueue)
+	} else {
+		w.backend = newRedisBackend(server, w.cmdQueueBase, w.cmdQueue, w.visibilityTimeout, w.logger)
+	}
+	w.cmdChan = make(chan queued, w.bufferSize)
+	metrics.WorkerBufferCapacity.WithLabelValues(w.cmdQueue).Set(float64(w.bufferSize))
+	if w.maxInFlight <= 0 {
+		w.maxInFlight = 2 * w.concurrency
+	}
+	w.pool = newPool(w.maxInFlight, w.typeLimits)
+	if w.journalDir != "" {
+		w.journal = newJournal(w.journalDir, w.cmdQueue)
+	}
+	if w.callbackRetry == nil {
+		w.callbackRetry = &httpclient.RetryOptions{
+			Max:     defaultCallbackRetries,
+			WaitMin: defaultCallbackWaitMin.Seconds(),
+			WaitMax: defaultCallbackWaitMax.Seconds(),
+		}
+	}
+	w.callbackRetry.Logger = w.logger
+	w.callbackRetry.Name = "callbacks"
 
 	return w
 }
 
 // push cmd in queue.
-func (w *Worker) push(cmd command.Command) {
-	w.cmdChan <- cmd
+func (w *Worker) push(ctx context.Context, cmd command.Command) error {
+	return w.pushAfter(ctx, cmd, 0)
 }
 
-// loopProcessCmd Workers to fetch commands.
-func (w *Worker) loopProcessCmd(stop <-chan struct{}) error {
-	for {
-		select {
-		case <-stop:
-			_ = w.logger.Log("method", "loopProcessCmd", "status", "exit", "redis_server", w.server)
-			return fmt.Errorf("worker.loopProcessCmd.interrupted")
-		default:
+// requeue pushes cmd after delay to the worker owning it, which is not w
+// once servers were added or removed. It writes to redis directly rather
+// than through the buffer, which the processing goroutines must not block
+// on.
+func (w *Worker) requeue(ctx context.Context, cmd command.Command, delay time.Duration) {
+	owner := w
+	if w.owner != nil {
+		owner = w.owner(cmd)
+	}
+	if err := owner.deliver(owner.queued(ctx, cmd, delay)); err != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "requeue", "context", "deliver", "error", err)
+	}
+}
+
+// pushAfter buffers cmd for loopPushCmd to push once delay has passed. When
+// the buffer is full it spills cmd to redis directly if enabled, or waits
+// for room until ctx is done and returns ErrQueueFull.
+func (w *Worker) pushAfter(ctx context.Context, cmd command.Command, delay time.Duration) error {
+	q := w.queued(ctx, cmd, delay)
+	// counted before the send, loopPushCmd may deliver it right away
+	w.buffered.add()
+	select {
+	case w.cmdChan <- q:
+		w.pushed("buffered")
+		return nil
+	default:
+	}
+
+	if w.spill {
+		w.buffered.done()
+		err := w.deliver(q)
+		if err == nil {
+			w.pushed("spilled")
 		}
+		return err
+	}
+	select {
+	case w.cmdChan <- q:
+		w.pushed("buffered")
+		return nil
+	case <-ctx.Done():
+		w.buffered.done()
+		w.pushed("rejected")
+		return fmt.Errorf("%w: %v", ErrQueueFull, ctx.Err())
+	}
+}
 
-		cmd, err := w.pop()
+// queued wraps cmd with the trace and request ID of ctx.
+func (w *Worker) queued(ctx context.Context, cmd command.Command, delay time.Duration) queued {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if id := requestid.FromContext(ctx); id != "" {
+		carrier.Set(requestid.Header, id)
+	}
+	return queued{cmd: cmd, carrier: carrier, delay: delay}
+}
+
+// pushed counts a push by its result and updates the buffer depth.
+func (w *Worker) pushed(result string) {
+	metrics.WorkerPushes.WithLabelValues(w.cmdQueue, result).Inc()
+	metrics.WorkerBufferDepth.WithLabelValues(w.cmdQueue).Set(float64(len(w.cmdChan)))
+}
+
+// loopFetchCmd pops commands into the pool while it has room.
+func (w *Worker) loopFetchCmd(stop <-chan struct{}) {
+	for w.pool.waitRoom(stop) {
+		cmd, msg, err := w.pop()
 
 		if err == ErrEmptyQueue {
 			continue
 		}
 
 		if err != nil {
-			_ = w.logger.Log("method", "loopProcessCmd", "context", "pop", "error", err)
+			_ = level.Error(w.logger).Log("method", "loopFetchCmd", "context", "pop", "error", err)
 			continue
 		}
 
-		err = w.run(cmd)
-		if err != nil {
-			_ = w.logger.Log("method", "loopProcessCmd", "context", "run", "error", err, "cmd", cmd.String())
-			continue
+		w.pool.add(&task{cmd: cmd, msg: msg, kind: commandKind(cmd)})
+	}
+
+	// give back what the processing goroutines will not get to
+	for _, t := range w.pool.drain() {
+		if err := w.backend.Nack(t.msg, 0); err != nil {
+			_ = level.Error(w.logger).Log("method", "loopFetchCmd", "context", "nack", "error", err, "cmd", t.cmd.String())
+		}
+	}
+	_ = level.Info(w.logger).Log("method", "loopFetchCmd", "status", "exit", "redis_server", w.server)
+}
+
+// loopProcessCmd Workers to process fetched commands.
+func (w *Worker) loopProcessCmd(stop <-chan struct{}) error {
+	for {
+		t := w.pool.take(stop)
+		if t == nil {
+			_ = level.Info(w.logger).Log("method", "loopProcessCmd", "status", "exit", "redis_server", w.server)
+			return fmt.Errorf("worker.loopProcessCmd.interrupted")
+		}
+		w.process(t)
+	}
+}
+
+// process runs the command of t and acks it.
+func (w *Worker) process(t *task) {
+	defer w.pool.done(t)
+	cmd := t.cmd
+
+	ctx, span := otel.Tracer("worker").Start(w.traceContext(cmd), "worker.run",
+		trace.WithAttributes(attribute.Int64("command.id", int64(cmd.GetID())), attribute.String("command.type", t.kind)))
+	err := w.run(ctx, cmd)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	// run has either finished the command or pushed it again, so it no
+	// longer needs its backup.
+	if ackErr := w.backend.Ack(t.msg); ackErr != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("method", "process", "context", "ack", "error", ackErr, "cmd", cmd.String())
+	}
+	if err != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("method", "process", "context", "run", "error", err, "cmd", cmd.String())
+		return
+	}
+	_ = level.Info(w.loggerFor(ctx)).Log("method", "process", "context", "run", "cmd", cmd.String())
+}
+
+// loopExtend keeps the commands held by the pool hidden, whether waiting or
+// running, for none to be popped again by another worker however long it
+// is held.
+func (w *Worker) loopExtend(extender Extender, stop <-chan struct{}) {
+	ticker := time.NewTicker(w.visibilityTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			_ = level.Info(w.logger).Log("method", "loopExtend", "status", "exit", "redis_server", w.server)
+			return
+		case <-ticker.C:
+			w.extendHeld(extender)
+		}
+	}
+}
+
+// extendHeld extends the visibility of the commands held by the pool.
+func (w *Worker) extendHeld(extender Extender) {
+	for _, m := range w.pool.messages() {
+		if err := extender.Extend(m); err != nil {
+			_ = level.Error(w.logger).Log("method", "extendHeld", "context", "extend", "error", err)
 		}
-		_ = w.logger.Log("method", "loopProcessCmd", "context", "run", "cmd", cmd.String())
 	}
 }
 
@@ -108,37 +371,196 @@ func (w *Worker) loopPushCmd(stop <-chan struct{}) {
 	for {
 		select {
 		case <-stop:
-			_ = w.logger.Log("method", "loopPushCmd", "status", "exit", "redis_server", w.server)
+			_ = level.Info(w.logger).Log("method", "loopPushCmd", "status", "exit", "redis_server", w.server)
 			return
-		case cmd := <-w.cmdChan:
-			b, err := w.cmdManager.MarshalCommand(cmd)
-			if err != nil {
-				_ = w.logger.Log("method", "loopPushCmd", "context", "json.marshal", "error", err, "cmd", cmd.String())
-				continue
+		case q := <-w.cmdChan:
+			metrics.WorkerBufferDepth.WithLabelValues(w.cmdQueue).Set(float64(len(w.cmdChan)))
+			if err := w.deliver(q); err != nil {
+				logger := withRequestID(w.logger, q.carrier.Get(requestid.Header))
+				_ = level.Error(logger).Log("method", "loopPushCmd", "context", "deliver", "error", err, "delay", q.delay, "cmd", q.cmd.String())
 			}
+			w.buffered.done()
+		}
+	}
+}
 
-			_, err = w.redis.RPush(w.cmdQueue, b).Result()
-			if err != nil {
-				_ = w.logger.Log("method", "loopPushCmd", "context", "redis.rpush", "error", err, "cmd", cmd.String())
-				continue
-			}
+// record is a marshaled command on its way to redis.
+type record struct {
+	CommandID uint64                 `json:"commandId"`
+	Command   []byte                 `json:"command"`
+	Carrier   propagation.MapCarrier `json:"carrier,omitempty"`
+	// Due is when a delayed command may be popped, zero when not delayed.
+	Due time.Time `json:"due,omitempty"`
+}
+
+// deliver pushes q to redis, retrying with backoff, then to the redis of
+// the other workers, whose migration gives it back to its owner, and as a
+// last resort to the journal, replayed once redis recovers.
+func (w *Worker) deliver(q queued) error {
+	b, err := w.cmdManager.MarshalCommand(q.cmd)
+	if err != nil {
+		// retrying would fail all the same
+		w.pushFallback("dropped")
+		return fmt.Errorf("json.marshal: %w", err)
+	}
+	r := record{CommandID: q.cmd.GetID(), Command: b, Carrier: q.carrier}
+	if q.delay > 0 {
+		r.Due = time.Now().Add(q.delay)
+	}
+	logger := withRequestID(w.logger, q.carrier.Get(requestid.Header))
+
+	for attempt := 0; ; attempt++ {
+		if err = w.store(r); err == nil {
+			return nil
 		}
+		if attempt+1 >= pushAttempts {
+			break
+		}
+		_ = level.Warn(logger).Log("method", "deliver", "context", "store", "attempt", attempt+1, "error", err, "cmd", q.cmd.String())
+		time.Sleep(expBackoff(attempt, pushRetryMinBackoff, pushRetryMaxBackoff))
 	}
+
+	for _, peer := range w.peers {
+		if peerErr := peer.store(r); peerErr == nil {
+			_ = level.Warn(logger).Log("method", "deliver", "context", "failover", "redis_server", peer.server, "error", err, "cmd", q.cmd.String())
+			w.pushFallback("failover")
+			return nil
+		}
+	}
+
+	if w.journal != nil {
+		jErr := w.journal.append(r)
+		if jErr == nil {
+			_ = level.Warn(logger).Log("method", "deliver", "context", "journal", "error", err, "cmd", q.cmd.String())
+			w.pushFallback("journal")
+			return nil
+		}
+		err = fmt.Errorf("%v, journal: %w", err, jErr)
+	}
+	w.pushFallback("dropped")
+	return err
+}
+
+// pushFallback counts the pushes redis did not take at once.
+func (w *Worker) pushFallback(fallback string) {
+	metrics.WorkerPushFallbacks.WithLabelValues(w.cmdQueue, fallback).Inc()
+}
+
+// store pushes r to the backend, delayed if it is due later.
+func (w *Worker) store(r record) error {
+	var err error
+	if !r.Due.IsZero() {
+		err = w.backend.PushAt(r.Command, r.Due)
+	} else {
+		err = w.backend.Push(r.Command)
+	}
+	if err != nil {
+		return fmt.Errorf("backend.push: %w", err)
+	}
+
+	if err = w.storeTrace(r.CommandID, r.Carrier); err != nil {
+		logger := withRequestID(w.logger, r.Carrier.Get(requestid.Header))
+		_ = level.Error(logger).Log("cmdID", r.CommandID, "method", "store", "context", "storeTrace", "error", err)
+	}
+	return nil
+}
+
+// loopReplay pushes the journaled commands once redis takes them again.
+func (w *Worker) loopReplay(stop <-chan struct{}) {
+	ticker := time.NewTicker(journalReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		replayed, err := w.journal.replay(w.store)
+		if err != nil {
+			_ = level.Warn(w.logger).Log("method", "loopReplay", "context", "replay", "replayed", replayed, "error", err)
+		} else if replayed > 0 {
+			_ = level.Info(w.logger).Log("method", "loopReplay", "context", "replay", "replayed", replayed)
+		}
+
+		select {
+		case <-stop:
+			_ = level.Info(w.logger).Log("method", "loopReplay", "status", "exit", "redis_server", w.server)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// storeTrace keeps the trace carrier of command id, which also holds its
+// request ID, in the backend so that whichever worker pops it continues the
+// same trace.
+func (w *Worker) storeTrace(id uint64, carrier propagation.MapCarrier) error {
+	traces, ok := w.backend.(TraceStore)
+	if !ok || len(carrier) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+	return traces.StoreTrace(id, b)
+}
+
+// traceContext restores the trace and request ID stored for cmd, if any.
+func (w *Worker) traceContext(cmd command.Command) context.Context {
+	ctx := context.Background()
+	traces, ok := w.backend.(TraceStore)
+	if !ok {
+		return ctx
+	}
+	b, err := traces.Trace(cmd.GetID())
+	if err != nil {
+		_ = level.Error(w.logger).Log("cmdID", cmd.GetID(), "method", "traceContext", "context", "backend.trace", "error", err)
+		return ctx
+	}
+	if b == nil {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal(b, &carrier); err != nil {
+		return ctx
+	}
+	if id := carrier.Get(requestid.Header); id != "" {
+		ctx = requestid.NewContext(ctx, id)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// loggerFor returns the worker logger annotated with the request ID in ctx.
+func (w *Worker) loggerFor(ctx context.Context) log.Logger {
+	return withRequestID(w.logger, requestid.FromContext(ctx))
+}
+
+func withRequestID(logger log.Logger, id string) log.Logger {
+	if id == "" {
+		return logger
+	}
+	return log.With(logger, "request_id", id)
 }
 
-func (w *Worker) run(cmd command.Command) error {
+func (w *Worker) run(ctx context.Context, cmd command.Command) error {
 	t, err := cmd.GetType()
 	if err != nil {
 		return err
 	}
 
 	t.SetCommandID(fmt.Sprintf("%d", cmd.GetID()))
-	t.SetLogger(w.logger)
+	t.SetLogger(w.loggerFor(ctx))
 
 	op := strings.ToLower(cmd.RunInfo().Operation)
 	var status *state.Status
 	switch op {
 	case "run", "create":
+		begin, err := w.beginRun(cmd)
+		if err != nil {
+			return err
+		}
+		if !begin {
+			_ = level.Warn(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "run", "context", "beginRun", "error", "run.in.progress", "state", cmd.RunInfo().CurrentState)
+			return nil
+		}
 		status, err = t.Create()
 	case "status", "get":
 		status, err = t.Get(cmd.RunInfo().GetStartOperation())
@@ -148,133 +570,126 @@ func (w *Worker) run(cmd command.Command) error {
 		return fmt.Errorf("worker.run.invalid_command: %s", op)
 	}
 	if err == nil {
-		w.processStatus(cmd, status)
+		w.processStatus(ctx, cmd, status)
 	} else {
-		w.processError(cmd, err)
+		w.processError(ctx, cmd, err)
 	}
 
 	return err
 }
 
-// processStatus of command.
-func (w *Worker) processStatus(cmd command.Command, status *state.Status) {
+// processStatus moves cmd to the state status reports, posting the
+// callback of the state it moved to, and polls the status of cmd again
+// until it is finished.
+func (w *Worker) processStatus(ctx context.Context, cmd command.Command, status *state.Status) {
 	cmdId, cmdRunInfo := cmd.GetID(), cmd.RunInfo()
-	var err error
-	_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "begin", "state", status.State, "startOp", cmdRunInfo.GetStartOperation())
-	switch status.State {
-	case state.Running:
-		if cmdRunInfo.CurrentState != state.Running {
-			if err = w.storeState(cmd, status, cmdRunInfo.RunningHook); err == nil {
-				cmdRunInfo.CurrentState = state.Running
-			} else {
-				_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", cmdRunInfo.RunningHook, "error", err.Error())
-			}
-		}
+	_ = level.Debug(w.loggerFor(ctx)).Log("cmdID", cmdId, "method", "processStatus", "context", "begin", "state", status.State, "startOp", cmdRunInfo.GetStartOperation())
 
-	case state.Pending:
-		// TODO: remove if block
-		if cmdRunInfo.CurrentState != state.Pending {
-			cmdRunInfo.PendingHook = cmdRunInfo.Callbacks["started"]
-			status.Payload = state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1}}
-			_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", cmdRunInfo.PendingHook, "cmd_new_state", status.State)
-			if err = w.storeState(cmd, status, cmdRunInfo.PendingHook); err == nil {
-				cmdRunInfo.CurrentState = state.Pending
-			}
-		}
-	case state.Errored, state.Terminated:
-		if status.State == state.Errored {
-			cmdRunInfo.ExitCode = 1
-		}
-		cmdRunInfo.FinishHook = cmdRunInfo.Callbacks["finished"]
-		status.Payload = state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1, WrapperExitCode: cmdRunInfo.ExitCode}}
-		cmdRunInfo.CurrentState = status.State
-		if err = w.storeState(cmd, status, cmdRunInfo.FinishHook); err == nil {
-			return
-		}
-		_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", cmdRunInfo.FinishHook, "error", err.Error())
+	finished := isFinished(cmdRunInfo, status.State)
+	move := w.transition
+	if finished {
+		move = w.finish
 	}
-
-	if cmdRunInfo.IsFinished(status.State) {
-		cmdRunInfo.FinishHook = cmdRunInfo.Callbacks["finished"]
-		status.Payload = state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1, WrapperExitCode: cmdRunInfo.ExitCode}}
-		if err = w.storeState(cmd, status, cmdRunInfo.FinishHook); err == nil {
-			return
+	moved, err := move(cmd, status.State)
+	switch {
+	case errors.Is(err, ErrIllegalTransition):
+		_ = level.Warn(w.loggerFor(ctx)).Log("cmdID", cmdId, "method", "processStatus", "context", "transition", "error", err)
+		// a late status of a finished command is dropped, any other is
+		// polled again
+		finished = isFinished(cmdRunInfo, cmdRunInfo.CurrentState)
+	case err != nil:
+		// polled again to record it
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmdId, "method", "processStatus", "context", "transition", "error", err, "cmd_new_state", status.State)
+		finished = false
+	case moved:
+		hook := callbackFor(cmdRunInfo, status, finished)
+		_ = level.Info(w.loggerFor(ctx)).Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", hook, "cmd_new_state", status.State)
+		if err := w.storeState(ctx, cmd, status, hook); err != nil {
+			_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", hook, "error", err)
 		}
-		_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "callback", cmdRunInfo.FinishHook, "error", err.Error())
-		return
 	}
-
-	// log for bookkeeping purpose.
-	if err != nil {
-		_ = w.logger.Log("cmdID", cmdId, "method", "processStatus", "context", "storeState", "error", err, "cmd_new_state", status.State)
+	if finished {
+		return
 	}
 
 	cmdRunInfo.Operation = "status"
-	<-time.NewTicker(expBackoff(1, 2*time.Second, 7*time.Second)).C
-	w.push(cmd)
+	w.requeue(ctx, cmd, expBackoff(1, 2*time.Second, 7*time.Second))
+}
+
+// callbackFor returns the hook of the state status reports, filling in the
+// payload of the states which carry none of their own.
+func callbackFor(info *command.RunInfo, status *state.Status, finished bool) string {
+	switch {
+	case finished:
+		if status.State == state.Errored {
+			info.ExitCode = 1
+		}
+		info.FinishHook = info.Callbacks["finished"]
+		status.Payload = state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1, WrapperExitCode: info.ExitCode}}
+		return info.FinishHook
+	case status.State == state.Pending:
+		info.PendingHook = info.Callbacks["started"]
+		status.Payload = state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1}}
+		return info.PendingHook
+	case status.State == state.Running:
+		return info.RunningHook
+	}
+	return ""
 }
 
-// processError of command.
-// TODO add redundancy if things fail here.
-// Need to backup and rerun
-func (w *Worker) processError(cmd command.Command, err error) {
+func (w *Worker) processError(ctx context.Context, cmd command.Command, err error) {
 	if cmd.RunInfo().RetryCount < cmd.RunInfo().MaxRetries {
 		cmd.RunInfo().RetryCount++
 
 		// randomize time to enqueue.
-		<-time.NewTicker(expBackoff(1, 2*time.Second, 7*time.Second)).C
-		w.push(cmd)
+		w.requeue(ctx, cmd, expBackoff(1, 2*time.Second, 7*time.Second))
 
 		return
 	}
-	cmd.RunInfo().FinishHook = cmd.RunInfo().Callbacks["finished"]
-	cmd.RunInfo().ExitCode = 1
-	payload := state.Payload{Time: time.Now().String(), Message: state.Message{Pid: -1, WrapperExitCode: cmd.RunInfo().ExitCode}}
-
-	if err := w.storeState(cmd, &state.Status{CommandID: cmd.GetID(), State: state.Errored, Payload: payload}, cmd.RunInfo().FinishHook); err != nil {
-		_ = w.logger.Log("cmdID", cmd.GetID(), "method", "processError", "context", "storeState", "error", err, "cmd", cmd.String())
+	// keep it for operators to requeue once the cause is fixed
+	if dlErr := w.deadLetter(cmd, err); dlErr != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "processError", "context", "deadLetter", "error", dlErr, "cmd", cmd.String())
 	}
-}
 
-// storeState in redis/external-store.
-func (w *Worker) storeState(cmd command.Command, status *state.Status, hook string) error {
-	if hook == "" {
-		_ = w.logger.Log("cmdID", cmd.GetID(), "method", "storeState", "context", "", "error", "blank.hook")
-		return nil
+	moved, tErr := w.transition(cmd, state.Errored)
+	if errors.Is(tErr, ErrIllegalTransition) || (tErr == nil && !moved) {
+		// finished already, its callback was posted then
+		_ = level.Warn(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "processError", "context", "transition", "error", tErr, "state", cmd.RunInfo().CurrentState)
+		return
 	}
-	headers := make(map[string]string)
-	headers["Content-Type"] = "application/json"
-	headers["Accept"] = "*/*"
-
-	// fmt.Printf("Sending payload: %+v\n", status.Payload)
-
-	st, _, err := httpclient.Post(context.Background(), hook, status.Payload, headers)
-	_ = w.logger.Log("cmdID", cmd.GetID(), "method", "storeState", "context", "post", "hook", hook, "http.status", st, "cmd", cmd.String())
-	if err != nil {
-		_ = w.logger.Log("cmdID", cmd.GetID(), "method", "storeState", "context", "post", "error", err, "http.status", st, "cmd", cmd.String())
+	if tErr != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "processError", "context", "transition", "error", tErr, "cmd", cmd.String())
 	}
 
-	return err
+	status := &state.Status{CommandID: cmd.GetID(), State: state.Errored}
+	if err := w.storeState(ctx, cmd, status, callbackFor(cmd.RunInfo(), status, true)); err != nil {
+		_ = level.Error(w.loggerFor(ctx)).Log("cmdID", cmd.GetID(), "method", "processError", "context", "storeState", "error", err, "cmd", cmd.String())
+	}
 }
 
-func (w *Worker) pop() (command.Command, error) {
-	var result []string
-	var err error
-
-	result, err = w.redis.BLPop(time.Duration(w.cmdQueueTimeOut)*time.Second, w.cmdQueue).Result()
-
-	if err == redis.Nil {
-		return nil, ErrEmptyQueue
-	}
+// pop a command from the backend, which holds it until acked so that a
+// crash mid-run does not lose it.
+func (w *Worker) pop() (command.Command, Message, error) {
+	msg, err := w.backend.Pop(time.Duration(w.cmdQueueTimeOut) * time.Second)
 	if err != nil {
-		return nil, err
+		return nil, Message{}, err
 	}
 
-	if v, err := w.cmdManager.UnMarshalCommand([]byte(result[1])); err != nil {
-		return nil, err
-	} else {
-		return v, nil
+	v, err := w.cmdManager.UnMarshalCommand(msg.Body)
+	if err != nil {
+		// it will never unmarshal, keep it aside for operators
+		dlErr := w.deadLetterBody(msg.Body, err)
+		if dlErr != nil && dlErr != errNoDeadLetters {
+			// held until recovered, to be dead lettered again
+			_ = level.Error(w.logger).Log("method", "pop", "context", "deadLetterBody", "error", dlErr)
+			return nil, Message{}, err
+		}
+		if ackErr := w.backend.Ack(msg); ackErr != nil {
+			_ = level.Error(w.logger).Log("method", "pop", "context", "ack", "error", ackErr)
+		}
+		return nil, Message{}, err
 	}
+	return v, msg, nil
 }
 
 func expBackoff(retry int, minBackoff, maxBackoff time.Duration) time.Duration {
@@ -292,24 +707,3 @@ func expBackoff(retry int, minBackoff, maxBackoff time.Duration) time.Duration {
 	}
 	return time.Duration(rand.Int63n(int64(backoff)))
 }
-
-// rmBackup removes command from backup processing queue.
-// TODO - incomplete
-// func (w *Worker) rmBackup(cmd *command.EdithCommand) error {
-// 	// randomize time to enqueue.
-// 	<-time.NewTicker(expBackoff(1, 2*time.Second, 7*time.Second)).C
-
-// 	if _, err := w.redis.LRem(w.cmdQueueBackup, 1, w.cmdIDPrefix(cmd)).Result(); err != nil {
-// 		return err
-// 	}
-
-// 	return w.rmBackup(cmd)
-// }
-
-// func (w *Worker) cmdIDPrefix(cmd *command.EdithCommand) string {
-// 	return fmt.Sprintf("%d:", cmd.ID)
-// }
-
-// func (w *Worker) stripCmdIDPrefix(result string) []byte {
-// 	return stripRegex.ReplaceAll([]byte(result), []byte(""))
-// }
@@ -1,11 +1,16 @@
 package worker
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	`github.com/qubole/edith/pkg/apps/edith`
 	`github.com/qubole/edith/pkg/command`
 	"github.com/qubole/edith/pkg/spark"
+	"github.com/qubole/edith/pkg/state"
 )
 
 var (
@@ -45,7 +50,7 @@ func TestWorker_pop(t *testing.T) {
 
 		t.Run(tt.name+"Push", func(t *testing.T) {
 			t.Parallel()
-			w.push(tt.want)
+			w.push(context.Background(), tt.want)
 		})
 
 		t.Run(tt.name+"Pop", func(t *testing.T) {
@@ -54,7 +59,7 @@ func TestWorker_pop(t *testing.T) {
 			var got command.Command
 			var err error
 			for {
-				got, err = w.pop()
+				got, _, err = w.pop()
 				if got != nil {
 					break
 				}
@@ -73,7 +78,122 @@ func TestWorker_pop(t *testing.T) {
 	}
 }
 
+func TestManager_deadLetters(t *testing.T) {
+	// the dead letter is found whichever worker holds it
+	other := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), CmdQueue("testotherqueue"), WithBackend(testMemoryBackend))
+	w := newWorker(1, testRedisServer, &edith.Codec{}, Logger("info"), CmdQueue("testdeadqueue"), WithBackend(testMemoryBackend))
+	m := &Manager{workers: []*Worker{other, w}}
+
+	cmd := &edith.Command{ID: 3, Type: "spark_app", SparkApp: &spark.App{ID: 3}, Info: &command.RunInfo{Operation: "create", RetryCount: 2, MaxRetries: 2}}
+	if err := w.deadLetter(cmd, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := m.DeadLetters(0, 10)
+	if err != nil || len(page.DeadLetters) != 1 || page.Total != 1 {
+		t.Fatalf("Manager.DeadLetters() = %+v, %v, want one", page, err)
+	}
+	letters := page.DeadLetters
+	if d := letters[0]; d.CommandID != 3 || d.Attempts != 3 || d.Error != "boom" {
+		t.Errorf("Manager.DeadLetters() = %+v, want command 3 after 3 attempts", d)
+	}
+
+	if _, err := w.transition(cmd, state.Errored); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RequeueDeadLetter(letters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := w.backend.(HistoryStore).State(3); st != "" {
+		t.Errorf("state once requeued = %q, want it reset", st)
+	}
+	if err := m.RequeueDeadLetter(letters[0].ID); err != ErrDeadLetterNotFound {
+		t.Errorf("Manager.RequeueDeadLetter() twice error = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+	got, msg, err := w.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.backend.Ack(msg)
+	if got.GetID() != 3 || got.RunInfo().RetryCount != 0 {
+		t.Errorf("requeued command = %v, want command 3 with retries reset", got)
+	}
+}
+
+func TestWorker_popUndecodable(t *testing.T) {
+	backend := NewMemoryBackend()
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+	if err := backend.Push([]byte("not a command")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := w.pop(); err == nil {
+		t.Fatal("Worker.pop() of an undecodable message should fail")
+	}
+	if queued, held := backend.Len(); queued != 0 || held != 0 {
+		t.Errorf("queued, held = %d, %d, want the message acked", queued, held)
+	}
+	page, err := (&Manager{workers: []*Worker{w}}).DeadLetters(0, 10)
+	if err != nil || len(page.DeadLetters) != 1 {
+		t.Fatalf("Manager.DeadLetters() = %+v, %v, want one", page, err)
+	}
+	if d := page.DeadLetters[0]; string(d.Body) != "not a command" || d.Error == "" {
+		t.Errorf("dead letter = %+v, want the message and why it did not decode", d)
+	}
+}
+
+func TestWorker_pushFull(t *testing.T) {
+	// nothing drains the buffer, the backend is never reached
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), BufferSize(1), WithBackend(testMemoryBackend))
+	cmd := &edith.Command{ID: 4, Type: "spark_app", SparkApp: &spark.App{ID: 4}, Info: &command.RunInfo{Operation: "create"}}
+
+	if err := w.push(context.Background(), cmd); err != nil {
+		t.Fatalf("Worker.push() error = %v, want nil", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.push(ctx, cmd); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Worker.push() on a full buffer error = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+// extendingBackend counts the messages extended.
+type extendingBackend struct {
+	*MemoryBackend
+	extended int32
+}
+
+func (b *extendingBackend) Extend(m Message) error {
+	atomic.AddInt32(&b.extended, 1)
+	return nil
+}
+
+func TestWorker_extendHeld(t *testing.T) {
+	backend := &extendingBackend{MemoryBackend: NewMemoryBackend()}
+	w := newWorker(0, testRedisServer, &edith.Codec{}, Logger("info"), WithBackend(func(_, _ string) Backend { return backend }))
+
+	// one running, one waiting in the pool behind it
+	w.pool.add(poolTask(1, "a"))
+	w.pool.add(poolTask(1, "a"))
+	running := w.pool.take(nil)
+	w.extendHeld(backend)
+	if got := atomic.LoadInt32(&backend.extended); got != 2 {
+		t.Fatalf("Worker.extendHeld() extended %d, want the 2 held", got)
+	}
+
+	w.pool.done(running)
+	w.pool.done(w.pool.take(nil))
+	w.extendHeld(backend)
+	if got := atomic.LoadInt32(&backend.extended); got != 2 {
+		t.Errorf("Worker.extendHeld() extended %d once done, want none more", got)
+	}
+}
+
 func testNewWorker(queue string) *Worker {
 	cmdManager := &edith.Codec{}
-	return newWorker(1, testRedisServer, cmdManager, Logger("info"), CmdQueue(queue))
+	return newWorker(1, testRedisServer, cmdManager, Logger("info"), CmdQueue(queue), WithBackend(testMemoryBackend))
+}
+
+func testMemoryBackend(server, queue string) Backend {
+	return NewMemoryBackend()
 }